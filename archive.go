@@ -0,0 +1,378 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+/*
+	"gocker save" and "gocker load" move images around as tarballs in
+	one of two formats:
+	- docker-archive: what "docker save" writes. A manifest.json in the
+	  format of our manifest type lists, per image, the config file, the
+	  tags (RepoTags) and the layer tarballs.
+	- oci: an OCI image layout with an index.json pointing to manifests,
+	  configs and layers under blobs/sha256. The image's name goes in the
+	  "org.opencontainers.image.ref.name" annotation.
+*/
+
+const ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+type savedImage struct {
+	imageShaHex string
+	tags        []string
+}
+
+func getImagesToSave(srcs []string) []savedImage {
+	var images []savedImage
+	for _, src := range srcs {
+		imageShaHex, exists := resolveImage(src)
+		if !exists {
+			log.Fatalf("No such image: %s\n", src)
+		}
+		var tags []string
+		if imageShaHex == src {
+			tags = getTagsForHash(imageShaHex)
+		} else {
+			tags = []string{formatImageNameAndTag(getImageNameAndTag(src))}
+		}
+		/* Images pulled by digest have no tag to save them under */
+		var repoTags []string
+		for _, tag := range tags {
+			if !strings.Contains(tag, "@") {
+				repoTags = append(repoTags, tag)
+			}
+		}
+		images = append(images, savedImage{imageShaHex: imageShaHex, tags: repoTags})
+	}
+	return images
+}
+
+func writeTarEntry(tw *tar.Writer, path string, r io.Reader, size int64) error {
+	header := &tar.Header{
+		Name:     path,
+		Size:     size,
+		Mode:     0644,
+		Typeflag: tar.TypeReg,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, r)
+	return err
+}
+
+func writeDockerArchive(w io.Writer, images []savedImage) error {
+	tw := tar.NewWriter(w)
+	mani := manifest{}
+	writtenLayers := make(map[string]bool)
+	for _, si := range images {
+		img, cleanup := getStoredImage(si.imageShaHex)
+		entry, err := writeDockerArchiveImage(tw, img, writtenLayers)
+		cleanup()
+		if err != nil {
+			return err
+		}
+		entry.RepoTags = si.tags
+		mani = append(mani, entry)
+	}
+	maniBytes, err := json.Marshal(mani)
+	if err != nil {
+		return err
+	}
+	if err := writeTarEntry(tw, "manifest.json", bytes.NewReader(maniBytes), int64(len(maniBytes))); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func writeDockerArchiveImage(tw *tar.Writer, img v1.Image, writtenLayers map[string]bool) (manifestEntry, error) {
+	entry := manifestEntry{}
+	configName, err := img.ConfigName()
+	if err != nil {
+		return entry, err
+	}
+	rawConfig, err := img.RawConfigFile()
+	if err != nil {
+		return entry, err
+	}
+	entry.Config = configName.Hex + ".json"
+	if err := writeTarEntry(tw, entry.Config, bytes.NewReader(rawConfig), int64(len(rawConfig))); err != nil {
+		return entry, err
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return entry, err
+	}
+	for _, layer := range layers {
+		diffID, err := layer.DiffID()
+		if err != nil {
+			return entry, err
+		}
+		layerFile := diffID.Hex + "/layer.tar"
+		entry.Layers = append(entry.Layers, layerFile)
+		if writtenLayers[layerFile] {
+			continue
+		}
+		size, err := partial.UncompressedSize(layer)
+		if err != nil {
+			return entry, err
+		}
+		rc, err := layer.Uncompressed()
+		if err != nil {
+			return entry, err
+		}
+		err = writeTarEntry(tw, layerFile, rc, size)
+		rc.Close()
+		if err != nil {
+			return entry, err
+		}
+		writtenLayers[layerFile] = true
+	}
+	return entry, nil
+}
+
+func writeOCIArchive(w io.Writer, images []savedImage) error {
+	tmpPath, err := ioutil.TempDir(getGockerTempPath(), "save-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpPath)
+	p, err := layout.Write(tmpPath, empty.Index)
+	if err != nil {
+		return err
+	}
+	for _, si := range images {
+		img, cleanup := getStoredImage(si.imageShaHex)
+		if len(si.tags) == 0 {
+			err = p.AppendImage(img)
+		}
+		for _, tag := range si.tags {
+			annotations := map[string]string{ociRefNameAnnotation: tag}
+			if err = p.AppendImage(img, layout.WithAnnotations(annotations)); err != nil {
+				break
+			}
+		}
+		cleanup()
+		if err != nil {
+			return err
+		}
+	}
+	return tarDirectory(tmpPath, w)
+}
+
+func saveImages(output string, format string, srcs []string) {
+	images := getImagesToSave(srcs)
+	file, err := os.Create(output)
+	if err != nil {
+		log.Fatalf("Unable to create %s: %v\n", output, err)
+	}
+	defer file.Close()
+
+	switch format {
+	case "docker-archive":
+		err = writeDockerArchive(file, images)
+	case "oci":
+		err = writeOCIArchive(file, images)
+	default:
+		log.Fatalf("Unknown archive format %s, should be docker-archive or oci\n", format)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(output)
+		log.Fatalf("Unable to save images: %v\n", err)
+	}
+	log.Printf("Saved %d image(s) to %s\n", len(images), output)
+}
+
+/*
+	Archives come from anywhere, so the files their manifest lists have
+	to be files in the archive, rather than symlinks to those of the
+	host, and layers have to be named after their digest, as we name
+	their directories after it.
+*/
+
+var layerNameRegexp = regexp.MustCompile(`^(blobs/sha256/)?[0-9a-f]{12}`)
+
+func validateManifestEntry(srcDir string, entry manifestEntry) error {
+	for _, layer := range entry.Layers {
+		if !layerNameRegexp.MatchString(layer) {
+			return fmt.Errorf("layer %s isn't named after its digest", layer)
+		}
+	}
+	for _, name := range append([]string{entry.Config}, entry.Layers...) {
+		name, err := getSafeEntryName(name)
+		if err != nil {
+			return err
+		}
+		path, err := resolveInRoot(srcDir, name)
+		if err != nil {
+			return err
+		}
+		if path != filepath.Join(srcDir, name) {
+			return fmt.Errorf("%s in archive is a symlink", name)
+		}
+		if info, err := os.Lstat(path); err != nil || !info.Mode().IsRegular() {
+			return fmt.Errorf("%s isn't a file in the archive", name)
+		}
+	}
+	return nil
+}
+
+/*
+	Adds an image found in an unpacked archive to our images. The layers
+	go through extractImageLayers(), same as for the images we pull,
+	unpacked with unpack.
+*/
+
+func registerLoadedImage(srcDir string, pathConfig string, entry manifestEntry,
+	unpack func(r io.Reader, target string) error) {
+	rawConfig, err := ioutil.ReadFile(pathConfig)
+	if err != nil {
+		log.Fatalf("Unable to read image config %s: %v\n", pathConfig, err)
+	}
+	configHash := sha256.Sum256(rawConfig)
+	fullImageHex := hex.EncodeToString(configHash[:])
+	imageShaHex := fullImageHex[:12]
+	entry.Config = fullImageHex + ".json"
+
+	if imageStoredByHash(imageShaHex) {
+		log.Printf("Image %s already exists. Not loading its layers.\n", imageShaHex)
+	} else {
+		if len(entry.Layers) == 0 {
+			log.Fatal("Could not find any layers.")
+		}
+		extractImageLayers(srcDir, imageShaHex, pathConfig, entry, unpack, nil)
+	}
+	for _, repoTag := range entry.RepoTags {
+		imgName, tagName := getImageNameAndTag(repoTag)
+		storeImageMetadata(imgName, tagName, imageShaHex)
+		log.Printf("Loaded image: %s\n", formatImageNameAndTag(imgName, tagName))
+	}
+	if len(entry.RepoTags) == 0 {
+		log.Printf("Loaded image ID: %s\n", imageShaHex)
+	}
+}
+
+func loadDockerArchive(srcDir string) {
+	mani := manifest{}
+	if err := parseManifest(srcDir+"/manifest.json", &mani); err != nil {
+		log.Fatalf("Unable to parse archive manifest: %v\n", err)
+	}
+	for _, entry := range mani {
+		if err := validateManifestEntry(srcDir, entry); err != nil {
+			log.Fatalf("Invalid archive manifest: %v\n", err)
+		}
+		registerLoadedImage(srcDir, srcDir+"/"+entry.Config, entry, untarReader)
+	}
+}
+
+func loadOCIImage(srcDir string, img v1.Image, repoTags []string) {
+	imgManifest, err := img.Manifest()
+	if err != nil {
+		log.Fatalf("Unable to read image manifest: %v\n", err)
+	}
+	entry := manifestEntry{
+		Config:   "blobs/sha256/" + imgManifest.Config.Digest.Hex,
+		RepoTags: repoTags,
+	}
+	for _, layer := range imgManifest.Layers {
+		entry.Layers = append(entry.Layers, "blobs/sha256/"+layer.Digest.Hex)
+	}
+	if err := validateManifestEntry(srcDir, entry); err != nil {
+		log.Fatalf("Invalid OCI image %s: %v\n", imgManifest.Config.Digest, err)
+	}
+	registerLoadedImage(srcDir, srcDir+"/"+entry.Config, entry, untarReader)
+}
+
+func loadOCILayout(srcDir string) {
+	if info, err := os.Lstat(srcDir + "/index.json"); err != nil || !info.Mode().IsRegular() {
+		log.Fatalf("Unable to read OCI image layout: index.json isn't a file\n")
+	}
+	idx, err := layout.ImageIndexFromPath(srcDir)
+	if err != nil {
+		log.Fatalf("Unable to read OCI image layout: %v\n", err)
+	}
+	indexManifest, err := idx.IndexManifest()
+	if err != nil {
+		log.Fatalf("Unable to read OCI image index: %v\n", err)
+	}
+	for _, desc := range indexManifest.Manifests {
+		var repoTags []string
+		if refName, ok := desc.Annotations[ociRefNameAnnotation]; ok {
+			repoTags = append(repoTags, refName)
+		}
+		switch desc.MediaType {
+		case types.OCIManifestSchema1, types.DockerManifestSchema2:
+			img, err := idx.Image(desc.Digest)
+			if err != nil {
+				log.Fatalf("Unable to read image %s: %v\n", desc.Digest, err)
+			}
+			loadOCIImage(srcDir, img, repoTags)
+		case types.OCIImageIndex, types.DockerManifestList:
+			/* Multi-platform images: we load the one for our platform */
+			img, err := getImageForPlatform(idx, desc.Digest, getHostPlatform())
+			if err != nil {
+				log.Fatalf("Unable to read image %s: %v\n", desc.Digest, err)
+			}
+			loadOCIImage(srcDir, img, repoTags)
+		default:
+			log.Printf("Skipping %s of unknown type %s\n", desc.Digest, desc.MediaType)
+		}
+	}
+}
+
+func getImageForPlatform(idx v1.ImageIndex, digest v1.Hash, platform v1.Platform) (v1.Image, error) {
+	child, err := idx.ImageIndex(digest)
+	if err != nil {
+		return nil, err
+	}
+	childManifest, err := child.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range childManifest.Manifests {
+		if desc.Platform != nil && platformsMatch(*desc.Platform, platform) {
+			return child.Image(desc.Digest)
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+func loadImages(input string) {
+	tmpPath, err := ioutil.TempDir(getGockerTempPath(), "load-")
+	if err != nil {
+		log.Fatalf("Unable to create temporary directory: %v\n", err)
+	}
+	if err := untar(input, tmpPath); err != nil {
+		os.RemoveAll(tmpPath)
+		log.Fatalf("Unable to unpack %s: %v\n", input, err)
+	}
+	/* These can't be symlinks to files of the host either */
+	if info, err := os.Lstat(tmpPath + "/oci-layout"); err == nil && info.Mode().IsRegular() {
+		loadOCILayout(tmpPath)
+	} else if info, err := os.Lstat(tmpPath + "/manifest.json"); err == nil && info.Mode().IsRegular() {
+		loadDockerArchive(tmpPath)
+	} else {
+		os.RemoveAll(tmpPath)
+		log.Fatalf("%s is neither a docker-archive nor an OCI layout tarball\n", input)
+	}
+	os.RemoveAll(tmpPath)
+}
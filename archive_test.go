@@ -0,0 +1,171 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testTarEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	body     string
+}
+
+func writeTestTarball(t *testing.T, path string, entries []testTarEntry) {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	tw := tar.NewWriter(file)
+	for _, entry := range entries {
+		header := &tar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typeflag,
+			Linkname: entry.linkname,
+			Mode:     0644,
+			Size:     int64(len(entry.body)),
+		}
+		if entry.typeflag == tar.TypeDir {
+			header.Mode = 0755
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func createTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "gocker-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestUntarStaysInTarget(t *testing.T) {
+	dir := createTestDir(t)
+	defer os.RemoveAll(dir)
+	outside := dir + "/outside"
+	if err := os.Mkdir(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	victim := outside + "/victim"
+	if err := ioutil.WriteFile(victim, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		entries   []testTarEntry
+		wantError bool
+	}{
+		{"dot dot", []testTarEntry{{name: "../outside/escape", typeflag: tar.TypeReg, body: "x"}}, true},
+		{"nested dot dot", []testTarEntry{{name: "a/../../outside/escape", typeflag: tar.TypeReg, body: "x"}}, true},
+		{"absolute", []testTarEntry{{name: outside + "/escape", typeflag: tar.TypeReg, body: "x"}}, true},
+		{"hard link out", []testTarEntry{{name: "h", typeflag: tar.TypeLink, linkname: "../outside/victim"}}, true},
+		{"file through symlinked dir", []testTarEntry{
+			{name: "link", typeflag: tar.TypeSymlink, linkname: outside},
+			{name: "link/escape", typeflag: tar.TypeReg, body: "x"},
+		}, false},
+		{"file over symlink", []testTarEntry{
+			{name: "evil", typeflag: tar.TypeSymlink, linkname: victim},
+			{name: "evil", typeflag: tar.TypeReg, body: "changed"},
+		}, false},
+		{"hard link through symlink", []testTarEntry{
+			{name: "link", typeflag: tar.TypeSymlink, linkname: outside},
+			{name: "link/victim", typeflag: tar.TypeReg, body: "inside"},
+			{name: "h", typeflag: tar.TypeLink, linkname: "link/victim"},
+		}, false},
+	}
+	for _, test := range tests {
+		target := dir + "/target"
+		if err := os.Mkdir(target, 0755); err != nil {
+			t.Fatal(err)
+		}
+		tarball := dir + "/layer.tar"
+		writeTestTarball(t, tarball, test.entries)
+		err := untar(tarball, target)
+		if test.wantError && err == nil {
+			t.Errorf("%s: untar succeeded, want an error", test.name)
+		} else if !test.wantError && err != nil {
+			t.Errorf("%s: untar failed: %v", test.name, err)
+		}
+		entries, _ := ioutil.ReadDir(outside)
+		if data, _ := ioutil.ReadFile(victim); len(entries) != 1 || string(data) != "original" {
+			t.Errorf("%s: untar wrote outside of its target", test.name)
+		}
+		os.RemoveAll(target)
+	}
+}
+
+func TestLoadRejectsMaliciousArchive(t *testing.T) {
+	dir := createTestDir(t)
+	defer os.RemoveAll(dir)
+	secret := dir + "/secret"
+	if err := ioutil.WriteFile(secret, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	layer := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef/layer.tar"
+
+	tests := []struct {
+		name    string
+		entry   manifestEntry
+		entries []testTarEntry
+		valid   bool
+	}{
+		{"valid", manifestEntry{Config: "config.json", Layers: []string{layer}},
+			[]testTarEntry{{name: layer, typeflag: tar.TypeReg, body: "layer"}}, true},
+		{"layer outside", manifestEntry{Config: "config.json", Layers: []string{"../../../etc/passwd"}}, nil, false},
+		{"absolute layer", manifestEntry{Config: "config.json", Layers: []string{"/etc/passwd"}}, nil, false},
+		{"short layer name", manifestEntry{Config: "config.json", Layers: []string{"a.tar"}}, nil, false},
+		{"config outside", manifestEntry{Config: "../secret", Layers: []string{layer}}, nil, false},
+		{"symlinked config", manifestEntry{Config: "config.json", Layers: []string{layer}},
+			[]testTarEntry{{name: "config.json", typeflag: tar.TypeSymlink, linkname: secret}}, false},
+		{"symlinked layer", manifestEntry{Config: "config.json", Layers: []string{layer}},
+			[]testTarEntry{{name: layer, typeflag: tar.TypeSymlink, linkname: secret}}, false},
+	}
+	for _, test := range tests {
+		maniBytes, err := json.Marshal(manifest{test.entry})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries := append([]testTarEntry{
+			{name: "manifest.json", typeflag: tar.TypeReg, body: string(maniBytes)},
+		}, test.entries...)
+		if len(test.entries) == 0 || test.entries[0].name != "config.json" {
+			entries = append(entries, testTarEntry{name: "config.json", typeflag: tar.TypeReg, body: "{}"})
+		}
+		archive := dir + "/archive.tar"
+		writeTestTarball(t, archive, entries)
+		srcDir := dir + "/load"
+		if err := os.Mkdir(srcDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := untar(archive, srcDir); err != nil {
+			t.Fatalf("%s: untar failed: %v", test.name, err)
+		}
+		mani := manifest{}
+		if err := parseManifest(filepath.Join(srcDir, "manifest.json"), &mani); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		err = validateManifestEntry(srcDir, mani[0])
+		if test.valid && err != nil {
+			t.Errorf("%s: manifest refused: %v", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: manifest accepted, want an error", test.name)
+		}
+		os.RemoveAll(srcDir)
+	}
+}
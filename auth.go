@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/credentials"
+	"github.com/docker/cli/cli/config/types"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"golang.org/x/sys/unix"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+/*
+	We keep registry credentials in the same config.json the Docker CLI
+	uses ($DOCKER_CONFIG, or ~/.docker by default), so "docker login" and
+	"gocker login" can be used interchangeably. When the config names
+	credential helpers via "credsStore" or "credHelpers", credentials are
+	handed to those helper binaries instead of being written to the file.
+	go-containerregistry's default keychain reads the same config when we
+	talk to registries, so pulls and pushes pick up whatever is set here.
+*/
+
+func getRemoteOptions(reg name.Registry) []remote.Option {
+	return []remote.Option{
+		remote.WithAuthFromKeychain(authn.DefaultKeychain),
+		remote.WithTransport(getRegistryHTTPTransport(reg.RegistryStr())),
+	}
+}
+
+/*
+	Docker Hub credentials are stored under a legacy URL for historical
+	reasons, everything else under the registry's host[:port].
+*/
+
+func getAuthKeyForServer(server string) (name.Registry, string, error) {
+	if len(server) == 0 {
+		server = name.DefaultRegistry
+	}
+	host := credentials.ConvertToHostname(server)
+	reg, err := name.NewRegistry(host, getNameOptions(host)...)
+	if err != nil {
+		return reg, "", err
+	}
+	if reg.RegistryStr() == name.DefaultRegistry {
+		return reg, authn.DefaultAuthKey, nil
+	}
+	return reg, reg.RegistryStr(), nil
+}
+
+/*
+	Reads a line from in, which wraps stdin, with echo turned off when
+	stdin is a terminal.
+*/
+
+func readPasswordFromTerminal(in *bufio.Reader) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if termios, err := unix.IoctlGetTermios(fd, unix.TCGETS); err == nil {
+		noEcho := *termios
+		noEcho.Lflag &^= unix.ECHO
+		if err := unix.IoctlSetTermios(fd, unix.TCSETS, &noEcho); err != nil {
+			return "", err
+		}
+		defer unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+		defer fmt.Println()
+	}
+	line, err := in.ReadString('\n')
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+/*
+	Works out the username and password to log in with, prompting for
+	what wasn't given. All of it is read through in, as a reader of its
+	own would buffer stdin that is meant for the next prompt. As with
+	"docker login", --password-stdin needs the username given with -u,
+	since stdin then has nothing but the password.
+*/
+
+func readLoginCredentials(in *bufio.Reader, username string, password string,
+	passwordStdin bool) (string, string, error) {
+	if passwordStdin {
+		if len(password) > 0 {
+			return "", "", fmt.Errorf("--password and --password-stdin are mutually exclusive")
+		}
+		if len(username) == 0 {
+			return "", "", fmt.Errorf("must provide --username with --password-stdin")
+		}
+		data, err := ioutil.ReadAll(in)
+		if err != nil {
+			return "", "", fmt.Errorf("unable to read password from stdin: %v", err)
+		}
+		return username, strings.TrimRight(string(data), "\r\n"), nil
+	}
+	if len(username) == 0 {
+		fmt.Print("Username: ")
+		line, err := in.ReadString('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return "", "", fmt.Errorf("unable to read username: %v", err)
+		}
+		username = strings.TrimSpace(line)
+	}
+	if len(password) == 0 {
+		fmt.Print("Password: ")
+		line, err := readPasswordFromTerminal(in)
+		if err != nil {
+			return "", "", fmt.Errorf("unable to read password: %v", err)
+		}
+		password = line
+	}
+	return username, password, nil
+}
+
+func checkRegistryCredentials(reg name.Registry, username string, password string) error {
+	auth := authn.FromConfig(authn.AuthConfig{Username: username, Password: password})
+	tr, err := transport.New(reg, auth, getRegistryHTTPTransport(reg.RegistryStr()),
+		[]string{reg.Scope(transport.PullScope)})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Transport: tr}
+	resp, err := client.Get(fmt.Sprintf("%s://%s/v2/", reg.Scheme(), reg.RegistryStr()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return transport.CheckError(resp, http.StatusOK)
+}
+
+func registryLogin(server string, username string, password string, passwordStdin bool) {
+	reg, authKey, err := getAuthKeyForServer(server)
+	if err != nil {
+		log.Fatalf("Invalid registry %s: %v\n", server, err)
+	}
+
+	username, password, err = readLoginCredentials(bufio.NewReader(os.Stdin), username, password, passwordStdin)
+	if err != nil {
+		log.Fatalf("Login to %s failed: %v\n", reg.RegistryStr(), err)
+	}
+
+	if err := checkRegistryCredentials(reg, username, password); err != nil {
+		log.Fatalf("Login to %s failed: %v\n", reg.RegistryStr(), err)
+	}
+
+	cf, err := config.Load(os.Getenv("DOCKER_CONFIG"))
+	if err != nil {
+		log.Fatalf("Unable to load credentials config: %v\n", err)
+	}
+	authConfig := types.AuthConfig{
+		Username:      username,
+		Password:      password,
+		ServerAddress: authKey,
+	}
+	if err := cf.GetCredentialsStore(authKey).Store(authConfig); err != nil {
+		log.Fatalf("Unable to store credentials: %v\n", err)
+	}
+	log.Printf("Login to %s succeeded.\n", reg.RegistryStr())
+}
+
+func registryLogout(server string) {
+	reg, authKey, err := getAuthKeyForServer(server)
+	if err != nil {
+		log.Fatalf("Invalid registry %s: %v\n", server, err)
+	}
+	cf, err := config.Load(os.Getenv("DOCKER_CONFIG"))
+	if err != nil {
+		log.Fatalf("Unable to load credentials config: %v\n", err)
+	}
+	if _, ok := cf.GetAuthConfigs()[authKey]; !ok && len(cf.CredentialsStore) == 0 &&
+		len(cf.CredentialHelpers[authKey]) == 0 {
+		log.Printf("Not logged in to %s.\n", reg.RegistryStr())
+		return
+	}
+	if err := cf.GetCredentialsStore(authKey).Erase(authKey); err != nil {
+		log.Fatalf("Unable to remove credentials: %v\n", err)
+	}
+	log.Printf("Removed login credentials for %s.\n", reg.RegistryStr())
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testUsername = "gopher"
+const testPassword = "s3cret"
+const testToken = "token-for-gopher"
+
+/*
+	Stands in for a registry that wants credentials, in front of the
+	in-memory one. With token set, it sends clients to its /token
+	endpoint for a bearer token, as Docker Hub does, rather than taking
+	the username and password with every request.
+*/
+
+type authRegistry struct {
+	handler http.Handler
+	token   bool
+	url     string
+}
+
+func (r *authRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	username, password, ok := req.BasicAuth()
+	validBasic := ok && username == testUsername && password == testPassword
+	if req.URL.Path == "/token" {
+		if !validBasic {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"token": %q}`, testToken)
+		return
+	}
+	if r.token {
+		if req.Header.Get("Authorization") != "Bearer "+testToken {
+			w.Header().Set("WWW-Authenticate",
+				fmt.Sprintf(`Bearer realm="%s/token",service="test"`, r.url))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	} else if !validBasic {
+		w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	r.handler.ServeHTTP(w, req)
+}
+
+func startAuthRegistry(t *testing.T, token bool) (*httptest.Server, name.Registry) {
+	authReg := &authRegistry{handler: registry.New(registry.Logger(nullLogger())), token: token}
+	server := httptest.NewServer(authReg)
+	authReg.url = server.URL
+	reg, err := name.NewRegistry(strings.TrimPrefix(server.URL, "http://"), name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, reg
+}
+
+func TestCheckRegistryCredentials(t *testing.T) {
+	for _, token := range []bool{false, true} {
+		server, reg := startAuthRegistry(t, token)
+		if err := checkRegistryCredentials(reg, testUsername, testPassword); err != nil {
+			t.Errorf("token auth %v: valid credentials refused: %v", token, err)
+		}
+		if err := checkRegistryCredentials(reg, testUsername, "wrong"); err == nil {
+			t.Errorf("token auth %v: wrong password accepted", token)
+		}
+		if err := checkRegistryCredentials(reg, "", ""); err == nil {
+			t.Errorf("token auth %v: no credentials accepted", token)
+		}
+		server.Close()
+	}
+}
+
+func TestLoginCredentialsUsedForPull(t *testing.T) {
+	configDir := createTestDir(t)
+	defer os.RemoveAll(configDir)
+	oldConfig := os.Getenv("DOCKER_CONFIG")
+	os.Setenv("DOCKER_CONFIG", configDir)
+	defer os.Setenv("DOCKER_CONFIG", oldConfig)
+
+	for _, token := range []bool{false, true} {
+		server, reg := startAuthRegistry(t, token)
+		ref, err := name.ParseReference(reg.RegistryStr()+"/test/auth:latest", name.Insecure)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := remote.Image(ref, getRemoteOptions(reg)...); err == nil {
+			t.Errorf("token auth %v: pulled without logging in", token)
+		}
+
+		registryLogin(reg.RegistryStr(), testUsername, testPassword, false)
+		pushTestImage(t, reg.RegistryStr(), "test/auth", getRemoteOptions(reg)...)
+		if _, err := remote.Image(ref, getRemoteOptions(reg)...); err != nil {
+			t.Errorf("token auth %v: pull after login failed: %v", token, err)
+		}
+		registryLogout(reg.RegistryStr())
+		server.Close()
+	}
+}
+
+func TestReadLoginCredentials(t *testing.T) {
+	tests := []struct {
+		name          string
+		stdin         string
+		username      string
+		password      string
+		passwordStdin bool
+		wantUsername  string
+		wantPassword  string
+		wantErr       bool
+	}{
+		{"prompts for both", "gopher\ns3cret\n", "", "", false, "gopher", "s3cret", false},
+		{"prompts for password", "s3cret\n", "gopher", "", false, "gopher", "s3cret", false},
+		{"password from stdin", "s3cret\n", "gopher", "", true, "gopher", "s3cret", false},
+		{"password from stdin without newline", "s3cret", "gopher", "", true, "gopher", "s3cret", false},
+		{"password from stdin needs username", "gopher\ns3cret\n", "", "", true, "", "", true},
+		{"password and password from stdin", "s3cret\n", "gopher", "s3cret", true, "", "", true},
+	}
+	for _, test := range tests {
+		in := bufio.NewReader(strings.NewReader(test.stdin))
+		username, password, err := readLoginCredentials(in, test.username, test.password, test.passwordStdin)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if username != test.wantUsername || password != test.wantPassword {
+			t.Errorf("%s: got %q/%q, expected %q/%q", test.name, username, password,
+				test.wantUsername, test.wantPassword)
+		}
+	}
+}
@@ -0,0 +1,774 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"golang.org/x/sys/unix"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	"gocker build" runs the instructions of a Dockerfile one after the
+	other, keeping track of the image being built as a buildStage. A new
+	stage starts at every FROM. The instructions that change the file
+	system, RUN, COPY and ADD, do so in a temporary container whose
+	overlay is mounted on the stage's layers so far. What ends up in the
+	container's upper directory becomes the stage's next layer. The other
+	instructions only change the stage's config.
+*/
+
+type buildLayer struct {
+	name string
+	dir  string
+}
+
+type buildStage struct {
+	name     string
+	cfg      *v1.ConfigFile
+	layers   []buildLayer
+	args     map[string]string
+	platform string
+	cacheKey string
+}
+
+type buildContext struct {
+	contextDir string
+	buildDir   string
+	buildArgs  map[string]string
+	globalArgs map[string]string
+	stages     []*buildStage
+	useCache   bool
+}
+
+func envHasKey(env []string, key string) bool {
+	for _, kv := range env {
+		if strings.HasPrefix(kv, key+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+func (stage *buildStage) getVar(key string) string {
+	for _, kv := range stage.cfg.Config.Env {
+		if strings.HasPrefix(kv, key+"=") {
+			return kv[len(key)+1:]
+		}
+	}
+	return stage.args[key]
+}
+
+/*
+	ENV, WORKDIR and the other instructions that don't run a command can
+	refer to environment variables and ARGs as $VAR or ${VAR}.
+*/
+
+func (stage *buildStage) expand(s string) string {
+	return os.Expand(s, stage.getVar)
+}
+
+/*
+	RUN sees the ARGs as environment variables, but they don't make it
+	into the image's config.
+*/
+
+func (stage *buildStage) getRunEnv() []string {
+	env := append([]string{}, stage.cfg.Config.Env...)
+	var keys []string
+	for key := range stage.args {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !envHasKey(env, key) {
+			env = append(env, key+"="+stage.args[key])
+		}
+	}
+	return env
+}
+
+/*
+	Layers go in overlay lower directories topmost first. A stage that
+	has no layers yet, like one that starts from scratch, gets an empty
+	directory, since overlay needs at least one.
+*/
+
+func (stage *buildStage) getLowerDirs(bc *buildContext) []string {
+	var lowerDirs []string
+	for _, layer := range stage.layers {
+		lowerDirs = append([]string{layer.dir}, lowerDirs...)
+	}
+	if len(lowerDirs) == 0 {
+		emptyDir := bc.buildDir + "/empty"
+		_ = os.MkdirAll(emptyDir, 0755)
+		lowerDirs = append(lowerDirs, emptyDir)
+	}
+	return lowerDirs
+}
+
+func (stage *buildStage) addHistory(createdBy string, emptyLayer bool) {
+	stage.cfg.History = append(stage.cfg.History, v1.History{
+		Created:    v1.Time{Time: time.Now().UTC()},
+		CreatedBy:  createdBy,
+		EmptyLayer: emptyLayer,
+	})
+}
+
+func (stage *buildStage) addLayer(key string, layer buildLayer, diffID string, createdBy string) {
+	stage.cacheKey = key
+	stage.layers = append(stage.layers, layer)
+	stage.cfg.RootFS.DiffIDs = append(stage.cfg.RootFS.DiffIDs, v1.Hash{Algorithm: "sha256", Hex: diffID})
+	stage.addHistory(createdBy, false)
+}
+
+/*
+	A stage that starts FROM an earlier stage picks up where that one
+	left off, except for its ARGs.
+*/
+
+func (stage *buildStage) clone() *buildStage {
+	rawConfig, err := json.Marshal(stage.cfg)
+	if err != nil {
+		log.Fatalf("Unable to marshal image config: %v\n", err)
+	}
+	cfg, err := v1.ParseConfigFile(bytes.NewReader(rawConfig))
+	if err != nil {
+		log.Fatalf("Unable to parse image config: %v\n", err)
+	}
+	return &buildStage{
+		cfg:      cfg,
+		layers:   append([]buildLayer{}, stage.layers...),
+		args:     make(map[string]string),
+		platform: stage.platform,
+		cacheKey: stage.cacheKey,
+	}
+}
+
+func newScratchStage() *buildStage {
+	return &buildStage{
+		cfg: &v1.ConfigFile{
+			Architecture: runtime.GOARCH,
+			OS:           "linux",
+			RootFS:       v1.RootFS{Type: "layers"},
+		},
+		args:     make(map[string]string),
+		cacheKey: getBuildCacheKey("", "FROM scratch"),
+	}
+}
+
+func newImageStage(src string) *buildStage {
+	imageShaHex := downloadImageIfRequired(src, "")
+	mani := manifest{}
+	if err := parseManifest(getManifestPathForImage(imageShaHex), &mani); err != nil {
+		log.Fatalf("Unable to read manifest for image %s: %v\n", imageShaHex, err)
+	}
+	if len(mani) == 0 {
+		log.Fatal("Could not find any layers.")
+	}
+	rawConfig, err := ioutil.ReadFile(getConfigPathForImage(imageShaHex))
+	if err != nil {
+		log.Fatalf("Could not read image config file: %v\n", err)
+	}
+	cfg, err := v1.ParseConfigFile(bytes.NewReader(rawConfig))
+	if err != nil {
+		log.Fatalf("Unable to parse image config: %v\n", err)
+	}
+
+	stage := &buildStage{
+		cfg:      cfg,
+		args:     make(map[string]string),
+		platform: parseImageDetails(imageShaHex).Platform,
+		cacheKey: getBuildCacheKey("", "FROM "+imageShaHex),
+	}
+	imageBasePath := getBasePathForImage(imageShaHex)
+	for _, layer := range mani[0].Layers {
+		stage.layers = append(stage.layers, buildLayer{
+			name: layer,
+			dir:  imageBasePath + "/" + getLayerDirName(layer) + "/fs",
+		})
+	}
+	return stage
+}
+
+func getLayerDiffID(layerDir string) (string, error) {
+	hasher := sha256.New()
+	if err := tarDirectory(layerDir, hasher); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func createBuildContainer(bc *buildContext, stage *buildStage) string {
+	containerID := createContainerID()
+	createContainerDirectories(containerID)
+	mountContainerOverlay(containerID, stage.getLowerDirs(bc))
+	return containerID
+}
+
+/*
+	COPY --from reads from a read-only overlay mount of the earlier
+	stage's layers. Overlay needs at least two lower directories when
+	there is no upper one, so an empty directory goes last.
+*/
+
+func mountBuildStage(bc *buildContext, stage *buildStage) (string, error) {
+	if len(stage.layers) == 0 {
+		return "", fmt.Errorf("build stage has no files to copy")
+	}
+	emptyDir := bc.buildDir + "/empty"
+	_ = os.MkdirAll(emptyDir, 0755)
+	lowerDirs := append(stage.getLowerDirs(bc), emptyDir)
+	mntPath, err := ioutil.TempDir(bc.buildDir, "from-")
+	if err != nil {
+		return "", err
+	}
+	return mntPath, mountOverlay(mntPath, unix.MS_RDONLY, lowerDirs, "")
+}
+
+func unmountBuildStage(mntPath string) {
+	if err := unix.Unmount(mntPath, 0); err != nil {
+		log.Printf("Unable to unmount %s: %v\n", mntPath, err)
+	}
+	os.Remove(mntPath)
+}
+
+/*
+	Unless --no-cache was passed, a step whose key is in the build cache
+	gets its layer from there instead of being run.
+*/
+
+func (bc *buildContext) useCachedLayer(stage *buildStage, key string, createdBy string) bool {
+	if !bc.useCache {
+		return false
+	}
+	layer, diffID, ok := getBuildCacheLayer(key)
+	if !ok {
+		return false
+	}
+	fmt.Println(" ---> Using cache")
+	stage.addLayer(key, layer, diffID, createdBy)
+	return true
+}
+
+func (bc *buildContext) getStage(name string) *buildStage {
+	for _, stage := range bc.stages {
+		if len(stage.name) > 0 && strings.EqualFold(stage.name, name) {
+			return stage
+		}
+	}
+	if i, err := strconv.Atoi(name); err == nil && i >= 0 && i < len(bc.stages) {
+		return bc.stages[i]
+	}
+	return nil
+}
+
+func buildRun(bc *buildContext, stage *buildStage, args string) error {
+	command, err := parseCommandForm(args)
+	if err != nil {
+		return err
+	}
+	key := getBuildCacheKey(stage.cacheKey, "RUN "+args)
+	if bc.useCachedLayer(stage, key, "RUN "+args) {
+		return nil
+	}
+	containerID := createBuildContainer(bc, stage)
+	var childOpts []string
+	for _, kv := range stage.getRunEnv() {
+		childOpts = append(childOpts, "--env="+kv)
+	}
+	if len(stage.cfg.Config.WorkingDir) > 0 {
+		childOpts = append(childOpts, "--workdir="+stage.cfg.Config.WorkingDir)
+	}
+	if len(stage.cfg.Config.User) > 0 {
+		childOpts = append(childOpts, "--user="+stage.cfg.Config.User)
+	}
+	err = runContainer(-1, -1, -1, -1, containerID, "", childOpts, command)
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		os.RemoveAll(getGockerContainersPath() + "/" + containerID)
+		return fmt.Errorf("the command %v returned a non-zero code: %d", command, exitErr.ExitCode())
+	} else if err != nil {
+		os.RemoveAll(getGockerContainersPath() + "/" + containerID)
+		return err
+	}
+	layer, diffID, err := storeBuildCacheLayer(containerID, key)
+	if err != nil {
+		return err
+	}
+	stage.addLayer(key, layer, diffID, "RUN "+args)
+	return nil
+}
+
+/*
+	Resolves path inside the container root fs at root the way it would
+	be resolved after a chroot into root. Symbolic links, absolute ones
+	in particular, can't lead us out of root this way.
+*/
+
+func resolveInRoot(root string, p string) (string, error) {
+	resolved := "/"
+	parts := strings.Split(p, "/")
+	for links := 0; len(parts) > 0; {
+		part := parts[0]
+		parts = parts[1:]
+		if len(part) == 0 || part == "." {
+			continue
+		}
+		if part == ".." {
+			resolved = path.Dir(resolved)
+			continue
+		}
+		next := path.Join(resolved, part)
+		info, err := os.Lstat(root + next)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > 255 {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", p)
+		}
+		link, err := os.Readlink(root + next)
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(link) {
+			resolved = "/"
+		}
+		parts = append(strings.Split(link, "/"), parts...)
+	}
+	return filepath.Join(root, resolved), nil
+}
+
+func copyBuildFile(src string, info os.FileInfo, dst string) error {
+	if existing, err := os.Lstat(dst); err == nil && !existing.IsDir() {
+		if err := os.Remove(dst); err != nil {
+			return err
+		}
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, dst)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(dst, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+/*
+	Copies src from the host to dst inside the container root fs at
+	root. Like "docker build", we copy the contents of directories and
+	not the directories themselves.
+*/
+
+func copyIntoRoot(root string, src string, dst string) error {
+	return filepath.Walk(src, func(hostPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(src, hostPath)
+		if err != nil {
+			return err
+		}
+		containerPath := path.Join(dst, filepath.ToSlash(relPath))
+		if info.IsDir() {
+			target, err := resolveInRoot(root, containerPath)
+			if err != nil {
+				return err
+			}
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		parent, err := resolveInRoot(root, path.Dir(containerPath))
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return err
+		}
+		return copyBuildFile(hostPath, info, filepath.Join(parent, path.Base(containerPath)))
+	})
+}
+
+func isTarArchive(p string) bool {
+	file, err := os.Open(p)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	reader, err := getDecompressedReader(file)
+	if err != nil {
+		return false
+	}
+	_, err = tar.NewReader(reader).Next()
+	return err == nil
+}
+
+/*
+	COPY and ADD take "src... dest" or the same as a JSON array, after
+	any --flag=value options.
+*/
+
+func parseCopyArgs(args string) (map[string]string, []string, error) {
+	flags := make(map[string]string)
+	words := splitWords(args)
+	for len(words) > 0 && strings.HasPrefix(words[0], "--") {
+		kv := strings.SplitN(strings.TrimPrefix(words[0], "--"), "=", 2)
+		if len(kv) != 2 {
+			return nil, nil, fmt.Errorf("expected --flag=value, got %s", words[0])
+		}
+		flags[kv[0]] = kv[1]
+		words = words[1:]
+	}
+	rest := strings.TrimSpace(strings.Join(words, " "))
+	if strings.HasPrefix(rest, "[") {
+		words = nil
+		if err := json.Unmarshal([]byte(rest), &words); err != nil {
+			return nil, nil, fmt.Errorf("invalid JSON array %s: %v", rest, err)
+		}
+	}
+	if len(words) < 2 {
+		return nil, nil, fmt.Errorf("need at least one source and a destination")
+	}
+	return flags, words, nil
+}
+
+/*
+	Finds the files matching srcs in root, which is the build context or,
+	for COPY --from, the root fs of an earlier stage. Sources can't be
+	outside of root.
+*/
+
+func getCopySources(root string, srcs []string, isAdd bool) ([]string, error) {
+	var matches []string
+	for _, src := range srcs {
+		if isAdd && (strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")) {
+			return nil, fmt.Errorf("ADD from URLs is not supported: %s", src)
+		}
+		dir, pattern := path.Split(src)
+		resolvedDir, err := resolveInRoot(root, dir)
+		if err != nil {
+			return nil, err
+		}
+		found, err := filepath.Glob(filepath.Join(resolvedDir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		if len(found) == 0 {
+			return nil, fmt.Errorf("%s: no such file or directory", src)
+		}
+		matches = append(matches, found...)
+	}
+	return matches, nil
+}
+
+func buildCopy(bc *buildContext, stage *buildStage, keyword string, args string) error {
+	flags, words, err := parseCopyArgs(args)
+	if err != nil {
+		return err
+	}
+	from, copyFromStage := flags["from"]
+	delete(flags, "from")
+	if len(flags) > 0 || (copyFromStage && keyword == "ADD") {
+		return fmt.Errorf("unsupported flags in %s %s", keyword, args)
+	}
+	for i := range words {
+		words[i] = stage.expand(words[i])
+	}
+	root := bc.contextDir
+	if copyFromStage {
+		srcStage := bc.getStage(stage.expand(from))
+		if srcStage == nil {
+			return fmt.Errorf("no build stage named %s", from)
+		}
+		if root, err = mountBuildStage(bc, srcStage); err != nil {
+			return err
+		}
+		defer unmountBuildStage(root)
+	}
+	srcs, err := getCopySources(root, words[:len(words)-1], keyword == "ADD")
+	if err != nil {
+		return err
+	}
+	srcsHash, err := hashCopySources(root, srcs)
+	if err != nil {
+		return err
+	}
+	key := getBuildCacheKey(stage.cacheKey, keyword+" "+args, srcsHash)
+	if bc.useCachedLayer(stage, key, keyword+" "+args) {
+		return nil
+	}
+	dst := words[len(words)-1]
+	dstIsDir := strings.HasSuffix(dst, "/") || len(srcs) > 1
+	if !path.IsAbs(dst) {
+		dst = path.Join("/", stage.cfg.Config.WorkingDir, dst)
+	}
+
+	containerID := createBuildContainer(bc, stage)
+	mntPath := getContainerFSHome(containerID) + "/mnt"
+	err = func() error {
+		if target, err := resolveInRoot(mntPath, dst); err != nil {
+			return err
+		} else if info, err := os.Stat(target); err == nil && info.IsDir() {
+			dstIsDir = true
+		}
+		for _, src := range srcs {
+			info, err := os.Lstat(src)
+			if err != nil {
+				return err
+			}
+			switch {
+			case info.IsDir():
+				err = copyIntoRoot(mntPath, src, dst)
+			case keyword == "ADD" && info.Mode().IsRegular() && isTarArchive(src):
+				/* ADD unpacks local tarballs into the destination directory */
+				var target string
+				if target, err = resolveInRoot(mntPath, dst); err == nil {
+					if err = os.MkdirAll(target, 0755); err == nil {
+						err = untarInRoot(src, mntPath, dst)
+					}
+				}
+			case dstIsDir:
+				err = copyIntoRoot(mntPath, src, path.Join(dst, filepath.Base(src)))
+			default:
+				err = copyIntoRoot(mntPath, src, dst)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	unmountContainerFs(containerID)
+	if err != nil {
+		os.RemoveAll(getGockerContainersPath() + "/" + containerID)
+		return err
+	}
+	layer, diffID, err := storeBuildCacheLayer(containerID, key)
+	if err != nil {
+		return err
+	}
+	stage.addLayer(key, layer, diffID, keyword+" "+args)
+	return nil
+}
+
+/*
+	ARG takes a name and an optional default. The value passed with
+	--build-arg wins, then the default and then, for ARGs in a stage,
+	the value of the ARG of the same name before the first FROM.
+*/
+
+func buildArg(bc *buildContext, args map[string]string, arg string, expand func(string) string) string {
+	kv := strings.SplitN(arg, "=", 2)
+	key := kv[0]
+	if value, ok := bc.buildArgs[key]; ok {
+		args[key] = value
+	} else if len(kv) > 1 {
+		args[key] = expand(kv[1])
+	} else if value, ok := bc.globalArgs[key]; ok {
+		args[key] = value
+	} else {
+		args[key] = ""
+	}
+	return key
+}
+
+/*
+	FROM takes an image, "scratch" or an earlier stage, optionally
+	followed by "AS <name>" to name the stage for COPY --from.
+*/
+
+func buildFrom(bc *buildContext, args string) *buildStage {
+	words := strings.Fields(args)
+	if len(words) == 0 {
+		log.Fatal("FROM needs an image")
+	}
+	src := os.Expand(words[0], func(key string) string { return bc.globalArgs[key] })
+	var stage *buildStage
+	if srcStage := bc.getStage(src); srcStage != nil {
+		stage = srcStage.clone()
+	} else if src == "scratch" {
+		stage = newScratchStage()
+	} else {
+		stage = newImageStage(src)
+	}
+	if len(words) >= 3 && strings.EqualFold(words[1], "AS") {
+		stage.name = words[2]
+	}
+	bc.stages = append(bc.stages, stage)
+	return stage
+}
+
+func buildInstruction(bc *buildContext, stage *buildStage, instruction dockerfileInstruction) error {
+	keyword, args := instruction.keyword, instruction.args
+	switch keyword {
+	case "RUN":
+		return buildRun(bc, stage, args)
+	case "COPY", "ADD":
+		return buildCopy(bc, stage, keyword, args)
+	case "ARG":
+		key := buildArg(bc, stage.args, args, stage.expand)
+		/* What RUN does can depend on the value, so the cache key has it */
+		stage.cacheKey = getBuildCacheKey(stage.cacheKey, "ARG "+key+"="+stage.args[key])
+		stage.addHistory(keyword+" "+args, true)
+		return nil
+	case "WORKDIR":
+		workdir := stage.expand(args)
+		if !path.IsAbs(workdir) {
+			workdir = path.Join("/", stage.cfg.Config.WorkingDir, workdir)
+		}
+		stage.cfg.Config.WorkingDir = workdir
+	case "ENV", "LABEL", "EXPOSE", "USER", "VOLUME":
+		if err := applyConfigInstruction(&stage.cfg.Config, keyword+" "+stage.expand(args)); err != nil {
+			return err
+		}
+	case "CMD", "ENTRYPOINT":
+		if err := applyConfigInstruction(&stage.cfg.Config, keyword+" "+args); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported instruction %s", keyword)
+	}
+	stage.cacheKey = getBuildCacheKey(stage.cacheKey, keyword+" "+args)
+	stage.addHistory(keyword+" "+args, true)
+	return nil
+}
+
+/*
+	Stores what the last stage built as a new image. Its layers are
+	linked into the image's directory, like "gocker commit" does.
+*/
+
+func storeBuiltImage(bc *buildContext, stage *buildStage) string {
+	stage.cfg.Created = v1.Time{Time: time.Now().UTC()}
+	rawConfig, err := json.Marshal(stage.cfg)
+	if err != nil {
+		log.Fatalf("Unable to marshal image config: %v\n", err)
+	}
+	pathConfig := bc.buildDir + "/config.json"
+	doOrDieWithMsg(ioutil.WriteFile(pathConfig, rawConfig, 0644), "Unable to write image config")
+	configHash := sha256.Sum256(rawConfig)
+	fullImageHex := hex.EncodeToString(configHash[:])
+	imageShaHex := fullImageHex[:12]
+
+	imageBasePath := getBasePathForImage(imageShaHex)
+	doOrDieWithMsg(os.MkdirAll(imageBasePath, 0755), "Unable to create image directory")
+	entry := manifestEntry{Config: fullImageHex + ".json"}
+	for _, layer := range stage.layers {
+		layerDir := imageBasePath + "/" + getLayerDirName(layer.name) + "/fs"
+		if _, err := os.Stat(layerDir); os.IsNotExist(err) {
+			if err := linkLayerDir(layer.dir, layerDir); err != nil {
+				os.RemoveAll(imageBasePath)
+				log.Fatalf("Unable to link layer %s: %v\n", layer.name, err)
+			}
+		}
+		entry.Layers = append(entry.Layers, layer.name)
+	}
+	storeImageManifest(imageShaHex, pathConfig, entry, nil)
+	if len(stage.platform) > 0 {
+		details := parseImageDetails(imageShaHex)
+		details.Platform = stage.platform
+		storeImageDetails(imageShaHex, details)
+	}
+	return imageShaHex
+}
+
+func buildImage(contextDir string, dockerfile string, tag string, buildArgs []string, noCache bool) {
+	contextDir, err := filepath.Abs(contextDir)
+	if err != nil {
+		log.Fatalf("Unable to find build context %s: %v\n", contextDir, err)
+	}
+	if len(dockerfile) == 0 {
+		dockerfile = contextDir + "/Dockerfile"
+	}
+	instructions, err := parseDockerfile(dockerfile)
+	if err != nil {
+		log.Fatalf("Unable to read %s: %v\n", dockerfile, err)
+	}
+
+	bc := &buildContext{
+		contextDir: contextDir,
+		buildArgs:  make(map[string]string),
+		globalArgs: make(map[string]string),
+		useCache:   !noCache,
+	}
+	for _, buildArg := range buildArgs {
+		kv := strings.SplitN(buildArg, "=", 2)
+		if len(kv) != 2 {
+			log.Fatalf("Build arguments should be KEY=VALUE, got %s\n", buildArg)
+		}
+		bc.buildArgs[kv[0]] = kv[1]
+	}
+	if bc.buildDir, err = ioutil.TempDir(getGockerTempPath(), "build-"); err != nil {
+		log.Fatalf("Unable to create temporary directory: %v\n", err)
+	}
+
+	var stage *buildStage
+	for i, instruction := range instructions {
+		fmt.Printf("Step %d/%d : %s %s\n", i+1, len(instructions), instruction.keyword, instruction.args)
+		if instruction.keyword == "FROM" {
+			stage = buildFrom(bc, instruction.args)
+			continue
+		}
+		if stage == nil {
+			if instruction.keyword != "ARG" {
+				os.RemoveAll(bc.buildDir)
+				log.Fatalf("%s before the first FROM\n", instruction.keyword)
+			}
+			buildArg(bc, bc.globalArgs, instruction.args, func(s string) string {
+				return os.Expand(s, func(key string) string { return bc.globalArgs[key] })
+			})
+			continue
+		}
+		if err := buildInstruction(bc, stage, instruction); err != nil {
+			os.RemoveAll(bc.buildDir)
+			log.Fatalf("Step %d failed: %v\n", i+1, err)
+		}
+	}
+	if stage == nil {
+		os.RemoveAll(bc.buildDir)
+		log.Fatal("No FROM instruction found.")
+	}
+
+	imageShaHex := storeBuiltImage(bc, stage)
+	os.RemoveAll(bc.buildDir)
+	fmt.Printf("Successfully built %s\n", imageShaHex)
+	if len(tag) > 0 {
+		imgName, tagName := getImageNameAndTag(tag)
+		storeImageMetadata(imgName, tagName, imageShaHex)
+		fmt.Printf("Successfully tagged %s\n", formatImageNameAndTag(imgName, tagName))
+	}
+}
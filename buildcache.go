@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	"gocker build" keeps the layers it creates in a cache under
+	/var/lib/gocker/build-cache, one directory per layer:
+
+	build-cache/<key>/fs      the unpacked layer
+	build-cache/<key>/diffid  the layer's diff ID
+
+	Each step of a stage has a key, the hash of the key of the step
+	before it and what the step does. For COPY and ADD, that includes
+	the hashes of the files copied. A step whose key is in the cache
+	isn't run again. Its layer is used from the cache instead.
+	Images link to the layers in the cache, so pruning it only frees the
+	space of layers no image uses.
+*/
+
+func getBuildCacheKey(parentKey string, parts ...string) string {
+	hash := sha256.Sum256([]byte(parentKey + "\n" + strings.Join(parts, "\n")))
+	return hex.EncodeToString(hash[:])
+}
+
+func getBuildCacheLayer(key string) (buildLayer, string, bool) {
+	entryDir := getGockerBuildCachePath() + "/" + key
+	diffID, err := ioutil.ReadFile(entryDir + "/diffid")
+	if err != nil {
+		return buildLayer{}, "", false
+	}
+	if _, err := os.Stat(entryDir + "/fs"); err != nil {
+		return buildLayer{}, "", false
+	}
+	return buildLayer{name: string(diffID) + ".tar", dir: entryDir + "/fs"}, string(diffID), true
+}
+
+/*
+	Moves the upper directory of a finished build container into the
+	cache under key, without what the runtime put there for the
+	command to run, such as /etc/resolv.conf. The diff ID is written
+	last, so that an entry without one is never used.
+*/
+
+func storeBuildCacheLayer(containerID string, key string) (buildLayer, string, error) {
+	defer os.RemoveAll(getGockerContainersPath() + "/" + containerID)
+	upperDir := getContainerFSHome(containerID) + "/upperdir"
+	if err := removeRuntimePaths(containerID, upperDir); err != nil {
+		return buildLayer{}, "", err
+	}
+	diffID, err := getLayerDiffID(upperDir)
+	if err != nil {
+		return buildLayer{}, "", err
+	}
+	entryDir := getGockerBuildCachePath() + "/" + key
+	if err := os.RemoveAll(entryDir); err != nil {
+		return buildLayer{}, "", err
+	}
+	if err := os.MkdirAll(entryDir, 0755); err != nil {
+		return buildLayer{}, "", err
+	}
+	if err := os.Rename(upperDir, entryDir+"/fs"); err != nil {
+		return buildLayer{}, "", err
+	}
+	if err := ioutil.WriteFile(entryDir+"/diffid", []byte(diffID), 0644); err != nil {
+		return buildLayer{}, "", err
+	}
+	return buildLayer{name: diffID + ".tar", dir: entryDir + "/fs"}, diffID, nil
+}
+
+/*
+	Hashes the names, modes and contents of the files under srcs, which
+	are paths inside root.
+*/
+
+func hashCopySources(root string, srcs []string) (string, error) {
+	hasher := sha256.New()
+	for _, src := range srcs {
+		err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			relPath, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(hasher, "%s %o\n", relPath, info.Mode())
+			if info.Mode()&os.ModeSymlink != 0 {
+				link, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(hasher, "%s\n", link)
+			} else if info.Mode().IsRegular() {
+				file, err := os.Open(path)
+				if err != nil {
+					return err
+				}
+				_, err = io.Copy(hasher, file)
+				file.Close()
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+/*
+	Called for "gocker builder prune". Files that images still link to
+	don't free any space, so only files with a single link count.
+*/
+
+func pruneBuildCache() {
+	entries, err := ioutil.ReadDir(getGockerBuildCachePath())
+	if err != nil {
+		log.Fatalf("Unable to read build cache: %v\n", err)
+	}
+	var reclaimed int64
+	for _, entry := range entries {
+		entryDir := getGockerBuildCachePath() + "/" + entry.Name()
+		reclaimed += getReclaimableSize(entryDir)
+		if err := os.RemoveAll(entryDir); err != nil {
+			log.Fatalf("Unable to remove build cache entry %s: %v\n", entry.Name(), err)
+		}
+	}
+	fmt.Printf("Deleted build cache objects: %d\n", len(entries))
+	fmt.Printf("Total reclaimed space: %s\n", humanSize(reclaimed))
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"golang.org/x/sys/unix"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+	Every image directory has its own copy of the layers it is made of.
+	Layers are only ever used as read-only overlay lower directories, so
+	rather than copying the files of a layer we share them by hard
+	linking. Directories can't be hard linked, so we recreate them, along
+	with the xattr that marks them opaque.
+*/
+
+func linkLayerDir(srcDir string, dstDir string) error {
+	return filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		dstPath := filepath.Join(dstDir, relPath)
+		if !info.IsDir() {
+			return os.Link(path, dstPath)
+		}
+		if err := os.MkdirAll(dstPath, info.Mode().Perm()); err != nil {
+			return err
+		}
+		if isOverlayOpaqueDir(path) {
+			return unix.Lsetxattr(dstPath, overlayOpaqueXattr, []byte("y"), 0)
+		}
+		return nil
+	})
+}
+
+/*
+	Links layers, the layers of image srcImageShaHex with diffIDs, into
+	image imageShaHex along with their file trees. Returns the digests of
+	the trees, by diff ID, for storeImageManifest().
+*/
+
+func linkImageLayers(srcImageShaHex string, imageShaHex string, layers []string, diffIDs []v1.Hash) (map[string]string, error) {
+	layerTrees := make(map[string]string)
+	srcBasePath := getBasePathForImage(srcImageShaHex)
+	imageBasePath := getBasePathForImage(imageShaHex)
+	for i, layer := range layers {
+		layerDir := getLayerDirName(layer)
+		if err := linkLayerDir(srcBasePath+"/"+layerDir+"/fs", imageBasePath+"/"+layerDir+"/fs"); err != nil {
+			return nil, fmt.Errorf("layer %s: %v", layerDir, err)
+		}
+		treeDigest, err := copyLayerFileTree(srcImageShaHex, layer, diffIDs[i].String(), imageBasePath+"/"+layerDir)
+		if err != nil {
+			return nil, fmt.Errorf("layer %s: %v", layerDir, err)
+		} else if len(treeDigest) > 0 {
+			layerTrees[diffIDs[i].String()] = treeDigest
+		}
+	}
+	return layerTrees, nil
+}
+
+/*
+	Packs srcDir, without the paths in excluded, into a layer tarball in
+	dstDir, named after its diff ID, the sha256 of the tarball. Returns
+	the diff ID.
+*/
+
+func createLayerTarball(srcDir string, excluded []string, dstDir string) (string, error) {
+	tmpLayer := dstDir + "/layer.tar"
+	file, err := os.Create(tmpLayer)
+	if err != nil {
+		return "", err
+	}
+	hasher := sha256.New()
+	err = tarDirectoryWithout(srcDir, excluded, io.MultiWriter(file, hasher))
+	file.Close()
+	if err != nil {
+		return "", err
+	}
+	diffID := hex.EncodeToString(hasher.Sum(nil))
+	return diffID, os.Rename(tmpLayer, dstDir+"/"+diffID+".tar")
+}
+
+/*
+	Called for "gocker commit". What a container changed is in the upper
+	directory of its overlay mount. That becomes a new layer on top of
+	the layers of the image the container runs. The new image's config
+	is that of the container's image with the new layer and a history
+	entry for it added. What the runtime created for the container to
+	run, such as its /etc/resolv.conf, is left out.
+*/
+
+func commitContainer(containerID string, dst string) {
+	if !isContainerFSMounted(containerID) {
+		log.Fatalf("No such running container: %s\n", containerID)
+	}
+	_, srcImageShaHex, err := getDistribution(containerID)
+	if err != nil || len(srcImageShaHex) == 0 {
+		log.Fatalf("Unable to find the image of container %s\n", containerID)
+	}
+	srcMani := manifest{}
+	if err := parseManifest(getManifestPathForImage(srcImageShaHex), &srcMani); err != nil {
+		log.Fatalf("Unable to read manifest for image %s: %v\n", srcImageShaHex, err)
+	}
+	if len(srcMani) == 0 || len(srcMani[0].Layers) == 0 {
+		log.Fatal("Could not find any layers.")
+	}
+	srcConfig, err := ioutil.ReadFile(getConfigPathForImage(srcImageShaHex))
+	if err != nil {
+		log.Fatalf("Could not read image config file: %v\n", err)
+	}
+	cfg, err := v1.ParseConfigFile(bytes.NewReader(srcConfig))
+	if err != nil {
+		log.Fatalf("Unable to parse image config: %v\n", err)
+	}
+
+	tmpPath, err := ioutil.TempDir(getGockerTempPath(), "commit-")
+	if err != nil {
+		log.Fatalf("Unable to create temporary directory: %v\n", err)
+	}
+	defer os.RemoveAll(tmpPath)
+	log.Printf("Packing changes of container %s...\n", containerID)
+	diffID, err := createLayerTarball(getContainerFSHome(containerID)+"/upperdir",
+		getRuntimePaths(containerID), tmpPath)
+	if err != nil {
+		log.Fatalf("Unable to pack container changes: %v\n", err)
+	}
+	layerFile := diffID + ".tar"
+
+	now := v1.Time{Time: time.Now().UTC()}
+	cfg.Created = now
+	cfg.Container = containerID
+	cfg.RootFS.DiffIDs = append(cfg.RootFS.DiffIDs, v1.Hash{Algorithm: "sha256", Hex: diffID})
+	cfg.History = append(cfg.History, v1.History{Created: now, CreatedBy: "gocker commit " + containerID})
+	rawConfig, err := json.Marshal(cfg)
+	if err != nil {
+		log.Fatalf("Unable to marshal image config: %v\n", err)
+	}
+	pathConfig := tmpPath + "/config.json"
+	doOrDieWithMsg(ioutil.WriteFile(pathConfig, rawConfig, 0644), "Unable to write image config")
+	configHash := sha256.Sum256(rawConfig)
+	fullImageHex := hex.EncodeToString(configHash[:])
+	imageShaHex := fullImageHex[:12]
+
+	imageBasePath := getBasePathForImage(imageShaHex)
+	doOrDieWithMsg(os.Mkdir(imageBasePath, 0755), "Unable to create image directory")
+	layerTrees, err := linkImageLayers(srcImageShaHex, imageShaHex, srcMani[0].Layers, cfg.RootFS.DiffIDs)
+	if err != nil {
+		os.RemoveAll(imageBasePath)
+		log.Fatalf("Unable to link layers: %v\n", err)
+	}
+	newLayerDir := imageBasePath + "/" + getLayerDirName(layerFile)
+	log.Printf("Uncompressing layer to: %s \n", newLayerDir+"/fs")
+	_ = os.MkdirAll(newLayerDir+"/fs", 0755)
+	treeDigest, err := unpackLayer(tmpPath+"/"+layerFile, newLayerDir, "sha256:"+diffID, untarReader)
+	if err != nil {
+		os.RemoveAll(imageBasePath)
+		log.Fatalf("Unable to untar layer file: %s: %v\n", layerFile, err)
+	}
+	layerTrees["sha256:"+diffID] = treeDigest
+	entry := manifestEntry{
+		Config: fullImageHex + ".json",
+		Layers: append(append([]string{}, srcMani[0].Layers...), layerFile),
+	}
+	storeImageManifest(imageShaHex, pathConfig, entry, layerTrees)
+	/* The config has no variant, so we carry over the platform we recorded */
+	if platform := parseImageDetails(srcImageShaHex).Platform; len(platform) > 0 {
+		details := parseImageDetails(imageShaHex)
+		details.Platform = platform
+		storeImageDetails(imageShaHex, details)
+	}
+
+	if len(dst) > 0 {
+		imgName, tagName := getImageNameAndTag(dst)
+		storeImageMetadata(imgName, tagName, imageShaHex)
+		log.Printf("Committed %s as %s\n", imageShaHex, formatImageNameAndTag(imgName, tagName))
+	} else {
+		log.Printf("Committed %s\n", imageShaHex)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func getTarballNames(t *testing.T, path string) map[string]bool {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	names := make(map[string]bool)
+	tarReader := tar.NewReader(file)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names[header.Name] = true
+	}
+	return names
+}
+
+func TestCommittedLayerLeavesOutRuntimePaths(t *testing.T) {
+	dir := createTestDir(t)
+	defer os.RemoveAll(dir)
+
+	/* An upper directory as a container whose image had no /etc/resolv.conf or /proc leaves it */
+	upperDir := dir + "/upperdir"
+	for _, d := range []string{"/etc", "/proc", "/app"} {
+		if err := os.MkdirAll(upperDir+d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"/etc/resolv.conf": "",
+		"/etc/hosts":       "127.0.0.1 localhost\n",
+		"/app/main":        "made by the container\n",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(upperDir+name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	diffID, err := createLayerTarball(upperDir, []string{"/etc/resolv.conf", "/proc"}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := getTarballNames(t, dir+"/"+diffID+".tar")
+	for _, name := range []string{"etc/resolv.conf", "proc/"} {
+		if names[name] {
+			t.Errorf("committed layer has %s, which the runtime created", name)
+		}
+	}
+	for _, name := range []string{"etc/", "etc/hosts", "app/", "app/main"} {
+		if !names[name] {
+			t.Errorf("committed layer is missing %s", name)
+		}
+	}
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	"gocker cp" copies files between the host and a container, where
+	either side is "<container-id>:<path>". Like "docker cp", files are
+	packed into a tarball on one side and unpacked on the other, so "-"
+	as the source reads a tarball from STDIN and as the destination
+	writes one to STDOUT. A source ending in "/." copies what is in the
+	directory rather than the directory itself.
+
+	Paths in a container are looked up the way the container would see
+	them, so a symlink to /etc/passwd there leads to the container's
+	/etc/passwd, not the host's. Files keep their owners and modes.
+*/
+
+type cpPath struct {
+	containerID string
+	path        string
+}
+
+func parseCpPath(arg string) cpPath {
+	/* A colon before any slash marks a container, as /tmp/a:b is a host path */
+	if i := strings.Index(arg, ":"); i > 0 && !strings.Contains(arg[:i], "/") {
+		return cpPath{containerID: arg[:i], path: arg[i+1:]}
+	}
+	return cpPath{path: arg}
+}
+
+/*
+	Like resolveInRoot(), but a symlink at the end of path is what we
+	get rather than what it links to.
+*/
+
+func resolveLinkInRoot(root string, p string) (string, error) {
+	base := path.Base(p)
+	if base == "." || base == ".." || base == "/" {
+		return resolveInRoot(root, p)
+	}
+	parent, err := resolveInRoot(root, path.Dir(p))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, base), nil
+}
+
+/*
+	Returns where the container's root fs is mounted. A container that
+	stopped, but whose files are still around, is mounted again, and
+	the returned function unmounts it.
+*/
+
+func getContainerRoot(containerID string) (string, func()) {
+	if isContainerFSMounted(containerID) {
+		return getContainerFSHome(containerID) + "/mnt", func() {}
+	}
+	if mountDir := getContainerMountPath(containerID); getMountRefs(mountDir) > 0 {
+		return mountDir + "/mnt", func() {}
+	}
+	data, err := ioutil.ReadFile(getGockerContainersPath() + "/" + containerID + "/image")
+	if err != nil {
+		log.Fatalf("No such container: %s\n", containerID)
+	}
+	mountOverlayFileSystem(containerID, strings.TrimSpace(string(data)))
+	return getContainerFSHome(containerID) + "/mnt", func() { unmountContainerFs(containerID) }
+}
+
+/*
+	Volumes and bind mounts are only mounted in the container's mount
+	namespace, if at all, so what the container has under a mount point
+	is in the mount's source, not under root. Returns the root and the
+	path in it that p, a path in the container, is copied from or to,
+	and the mount it is in, if any. Trailing "/." and "/" are kept, as
+	they matter to copyInRoots().
+*/
+
+func getMountedPath(containerID string, root string, p string) (string, string, *containerMount) {
+	resolved, err := resolveLinkInRoot(root, filepath.Clean(p))
+	if err != nil {
+		return root, p, nil
+	}
+	resolved = getRootRelativePath(root, resolved)
+	var found *containerMount
+	mountPoint := ""
+	mounts := getContainerMounts(containerID)
+	for i, mount := range mounts {
+		target, err := resolveInRoot(root, mount.Target)
+		if err != nil || mount.Type == "tmpfs" {
+			continue
+		}
+		target = getRootRelativePath(root, target)
+		if (resolved == target || strings.HasPrefix(resolved, target+"/")) && len(target) > len(mountPoint) {
+			found, mountPoint = &mounts[i], target
+		}
+	}
+	if found == nil {
+		return root, p, nil
+	}
+
+	source := found.Source
+	if found.Type == "volume" {
+		source = getVolumePath(found.Source)
+	}
+	rest := strings.TrimPrefix(resolved, mountPoint)
+	if info, err := os.Stat(source); err == nil && !info.IsDir() {
+		/* A file mounted on its own */
+		source, rest = filepath.Dir(source), "/"+filepath.Base(source)+rest
+	}
+	if len(rest) == 0 {
+		rest = "/"
+	}
+	if strings.HasSuffix(p, "/.") {
+		rest = strings.TrimSuffix(rest, "/") + "/."
+	} else if strings.HasSuffix(p, "/") && !strings.HasSuffix(rest, "/") {
+		rest += "/"
+	}
+	return source, rest, found
+}
+
+/*
+	Sets what the tarball says about the file at path, other than what
+	it has in it. Times of directories are set once their contents are
+	in place, as adding those changes them.
+*/
+
+func setFileAttributes(dstPath string, header *tar.Header) error {
+	if err := os.Lchown(dstPath, header.Uid, header.Gid); err != nil {
+		return err
+	}
+	if header.Typeflag != tar.TypeSymlink {
+		if err := os.Chmod(dstPath, header.FileInfo().Mode()); err != nil {
+			return err
+		}
+	}
+	if header.Typeflag == tar.TypeDir {
+		return nil
+	}
+	return setFileTimes(dstPath, header)
+}
+
+func setFileTimes(dstPath string, header *tar.Header) error {
+	times := []unix.Timespec{unix.NsecToTimespec(header.ModTime.UnixNano()), unix.NsecToTimespec(header.ModTime.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, dstPath, times, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+/*
+	Unpacks the tarball into dstDir, a path inside root, renaming its
+	topmost entry, if srcName, to dstName. Every entry is looked up in
+	root, so that symlinks the destination has, or the tarball brings,
+	are never followed outside of it. Entries replace whatever is in
+	their way, except directories that are added to. dstDir is made if
+	it isn't there.
+*/
+
+func extractTarInRoot(r io.Reader, root string, dstDir string, srcName string, dstName string) error {
+	getEntryPath := func(name string) string {
+		name = strings.TrimPrefix(filepath.Clean("/"+name), "/")
+		if len(srcName) > 0 && (name == srcName || strings.HasPrefix(name, srcName+"/")) {
+			name = dstName + name[len(srcName):]
+		}
+		return filepath.Join(dstDir, name)
+	}
+	type dirTimes struct {
+		dstPath string
+		header  *tar.Header
+	}
+	var dirs []dirTimes
+
+	dirPath, err := resolveInRoot(root, dstDir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dirPath, 0755); err != nil {
+		return err
+	}
+	tarReader := tar.NewReader(r)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		entryPath := getEntryPath(header.Name)
+		parent, err := resolveInRoot(root, filepath.Dir(entryPath))
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return err
+		}
+		dstPath := filepath.Join(parent, filepath.Base(entryPath))
+		existing, err := os.Lstat(dstPath)
+		if err == nil && (header.Typeflag != tar.TypeDir || !existing.IsDir()) {
+			if err := os.RemoveAll(dstPath); err != nil {
+				return err
+			}
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.Mkdir(dstPath, 0755); err != nil && !os.IsExist(err) {
+				return err
+			}
+			dirs = append(dirs, dirTimes{dstPath: dstPath, header: header})
+		case tar.TypeReg:
+			file, err := os.OpenFile(dstPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(file, tarReader)
+			file.Close()
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(header.Linkname, dstPath); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			target, err := resolveLinkInRoot(root, getEntryPath(header.Linkname))
+			if err != nil {
+				return err
+			}
+			if err := os.Link(target, dstPath); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			mode := uint32(unix.S_IFIFO)
+			if header.Typeflag == tar.TypeChar {
+				mode = unix.S_IFCHR
+			} else if header.Typeflag == tar.TypeBlock {
+				mode = unix.S_IFBLK
+			}
+			if err := unix.Mknod(dstPath, mode, int(unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor)))); err != nil {
+				return err
+			}
+		default:
+			log.Printf("Warning: Skipping %s of unsupported type %d\n", header.Name, header.Typeflag)
+			continue
+		}
+		if err := setFileAttributes(dstPath, header); err != nil {
+			return err
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := setFileTimes(dirs[i].dstPath, dirs[i].header); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+	Looking paths up in root and then using them races with whatever
+	runs in a container: between the two, it can swap a directory for a
+	symlink to / and have us write to, or read from, the host. So unless
+	root is /, we pack and unpack in another gocker, chrooted into root,
+	where / is the container's. "gocker cp-helper" is that gocker.
+*/
+
+func runCpHelper(root string, stdin io.Reader, stdout io.Writer, args ...string) error {
+	cmd := exec.Command("/proc/self/exe", append([]string{"cp-helper", root}, args...)...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func packInRoot(root string, srcPath string, srcName string) io.ReadCloser {
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		if root != "/" {
+			pipeWriter.CloseWithError(runCpHelper(root, nil, pipeWriter, "pack", srcPath, srcName))
+			return
+		}
+		tarWriter := tar.NewWriter(pipeWriter)
+		err := writeTarEntries(tarWriter, srcPath, srcName)
+		if err == nil {
+			err = tarWriter.Close()
+		}
+		pipeWriter.CloseWithError(err)
+	}()
+	return pipeReader
+}
+
+func unpackInRoot(r io.Reader, root string, dstDir string, srcName string, dstName string) error {
+	if root != "/" {
+		return runCpHelper(root, r, nil, "unpack", dstDir, srcName, dstName)
+	}
+	return extractTarInRoot(r, root, dstDir, srcName, dstName)
+}
+
+/*
+	Called for "gocker cp-helper", which packInRoot() and unpackInRoot()
+	run, with the tarball on STDOUT or STDIN.
+*/
+
+func cpInChroot(root string, op string, args []string) {
+	doOrDieWithMsg(unix.Chroot(root), "Unable to chroot")
+	doOrDieWithMsg(os.Chdir("/"), "Unable to change directory")
+	var err error
+	switch {
+	case op == "pack" && len(args) == 2:
+		tarWriter := tar.NewWriter(os.Stdout)
+		if err = writeTarEntries(tarWriter, args[0], args[1]); err == nil {
+			err = tarWriter.Close()
+		}
+	case op == "unpack" && len(args) == 3:
+		err = extractTarInRoot(os.Stdin, "/", args[0], args[1], args[2])
+	default:
+		log.Fatalf("Unknown cp-helper operation: %s\n", op)
+	}
+	if err != nil {
+		log.Fatalf("Unable to %s %s: %v\n", op, args[0], err)
+	}
+}
+
+/*
+	Copies src, a path in srcRoot, to dst, a path in dstRoot, as a tarball
+	that "-" reads from STDIN or writes to STDOUT. followLink follows src
+	if it is a symlink, rather than copying the symlink. name, if given,
+	is what src is copied as, for when src is the root of a mount that
+	is named after where it is mounted.
+*/
+
+func copyInRoots(srcRoot string, src string, name string, dstRoot string, dst string, followLink bool) error {
+	var tarStream io.Reader
+	srcName, contentsOnly, srcIsDir := "", false, false
+	if src == "-" {
+		decompressed, err := getDecompressedReader(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("unable to read tarball: %v", err)
+		}
+		tarStream = decompressed
+	} else {
+		/* There is no name for the root directory to copy it as */
+		contentsOnly = strings.HasSuffix(src, "/.") || filepath.Clean(src) == "/" && len(name) == 0
+		resolve := resolveLinkInRoot
+		if followLink {
+			resolve = resolveInRoot
+		}
+		srcPath, err := resolve(srcRoot, src)
+		if err != nil {
+			return err
+		}
+		srcInfo, err := os.Lstat(srcPath)
+		if err != nil {
+			return fmt.Errorf("no such file or directory")
+		}
+		srcIsDir = srcInfo.IsDir()
+		if !contentsOnly && len(name) > 0 {
+			srcName = name
+		} else if !contentsOnly {
+			srcName = filepath.Base(filepath.Clean("/" + src))
+		}
+		/* The helper looks it up again, in srcRoot, which is its / */
+		pipeReader := packInRoot(srcRoot, getRootRelativePath(srcRoot, srcPath), srcName)
+		defer pipeReader.Close()
+		tarStream = pipeReader
+	}
+
+	if dst == "-" {
+		_, err := io.Copy(os.Stdout, tarStream)
+		return err
+	}
+	dstPath, err := resolveInRoot(dstRoot, dst)
+	if err != nil {
+		return err
+	}
+	dstInfo, err := os.Stat(dstPath)
+	dstIsDir := err == nil && dstInfo.IsDir()
+	dstDir := getRootRelativePath(dstRoot, dstPath)
+	dstName := srcName
+
+	switch {
+	case len(srcName) == 0 && os.IsNotExist(err) && !contentsOnly:
+		return fmt.Errorf("no such directory")
+	case len(srcName) == 0 && os.IsNotExist(err):
+		/* The contents of a directory make a new one, which unpacking makes */
+	case len(srcName) == 0 && !dstIsDir:
+		return fmt.Errorf("not a directory")
+	case os.IsNotExist(err) && strings.HasSuffix(dst, "/"):
+		return fmt.Errorf("no such directory")
+	case err == nil && srcIsDir && !dstIsDir:
+		return fmt.Errorf("can't copy a directory onto a file")
+	case !dstIsDir:
+		/* Anything that isn't an existing directory is what we copy to */
+		dstDir, dstName = filepath.Dir(dstDir), filepath.Base(dstDir)
+	}
+	return unpackInRoot(tarStream, dstRoot, dstDir, srcName, dstName)
+}
+
+/*
+	Turns p, a path resolveInRoot() returned, back into one inside root.
+*/
+
+func getRootRelativePath(root string, p string) string {
+	p = strings.TrimPrefix(p, strings.TrimSuffix(root, "/"))
+	if len(p) == 0 {
+		return "/"
+	}
+	return p
+}
+
+/*
+	Called for "gocker cp". One of src and dst has to be in a container.
+*/
+
+func copyFiles(srcArg string, dstArg string, followLink bool) {
+	src, dst := parseCpPath(srcArg), parseCpPath(dstArg)
+	if len(src.containerID) > 0 == (len(dst.containerID) > 0) {
+		log.Fatalf("Copying between containers, or on the host, isn't supported. One of the paths has to be container:path\n")
+	}
+	/* Host paths are relative to where we are, but we resolve them from / */
+	for _, hostPath := range []*cpPath{&src, &dst} {
+		if len(hostPath.containerID) == 0 && hostPath.path != "-" && !filepath.IsAbs(hostPath.path) {
+			wd, err := os.Getwd()
+			doOrDieWithMsg(err, "Unable to get working directory")
+			hostPath.path = wd + "/" + hostPath.path
+		}
+	}
+	srcRoot, dstRoot, name := "/", "/", ""
+	var cleanup func()
+	if len(src.containerID) > 0 {
+		srcRoot, cleanup = getContainerRoot(src.containerID)
+		/* Inside a container, "-" is just a file */
+		var mount *containerMount
+		path := "/" + src.path
+		srcRoot, src.path, mount = getMountedPath(src.containerID, srcRoot, path)
+		if mount != nil && src.path == "/" {
+			name = filepath.Base(filepath.Clean(path))
+		}
+	} else {
+		var mount *containerMount
+		dstRoot, cleanup = getContainerRoot(dst.containerID)
+		dstRoot, dst.path, mount = getMountedPath(dst.containerID, dstRoot, "/"+dst.path)
+		if mount != nil && mount.ReadOnly {
+			cleanup()
+			log.Fatalf("Unable to copy %s to %s: %s is mounted read-only\n", srcArg, dstArg, mount.Target)
+		}
+	}
+	err := copyInRoots(srcRoot, src.path, name, dstRoot, dst.path, followLink)
+	cleanup()
+	if err != nil {
+		log.Fatalf("Unable to copy %s to %s: %v\n", srcArg, dstArg, err)
+	}
+}
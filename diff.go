@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+/*
+	"gocker diff" lists what a container changed in its root fs, which is
+	everything in the upper directory of its overlay mount. Whether a
+	path there was added or changed depends on whether the image has it,
+	so we look at a read-only mount of the image's layers. Overlay marks
+	deleted files with whiteout devices, and directories whose contents
+	were replaced, by a "rm -rf" and a mkdir for instance, as opaque. We
+	list both as deletions of what the image has there.
+
+	As with "docker diff", the kind of each change is A for added, C for
+	changed and D for deleted. The JSON output is that of Docker's API,
+	where Kind is 0 for changed, 1 for added and 2 for deleted.
+*/
+
+type containerChange struct {
+	Path string
+	Kind int
+}
+
+const (
+	changeModified = iota
+	changeAdded
+	changeDeleted
+)
+
+var changeKinds = []string{"C", "A", "D"}
+
+func getContainerChanges(upperDir string, imageDir string) ([]containerChange, error) {
+	var changes []containerChange
+	err := filepath.Walk(upperDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(upperDir, path)
+		if err != nil || relPath == "." {
+			return err
+		}
+		changePath := "/" + relPath
+		imageInfo, imageErr := os.Lstat(filepath.Join(imageDir, relPath))
+		inImage := imageErr == nil
+
+		if isOverlayWhiteout(info) {
+			if inImage {
+				changes = append(changes, containerChange{Path: changePath, Kind: changeDeleted})
+			}
+			return nil
+		}
+		kind := changeAdded
+		if inImage && (!info.IsDir() || imageInfo.IsDir()) {
+			kind = changeModified
+		}
+		changes = append(changes, containerChange{Path: changePath, Kind: kind})
+		if !info.IsDir() || !inImage || !imageInfo.IsDir() || !isOverlayOpaqueDir(path) {
+			return nil
+		}
+		imageEntries, err := ioutil.ReadDir(filepath.Join(imageDir, relPath))
+		if err != nil {
+			return err
+		}
+		for _, entry := range imageEntries {
+			if _, err := os.Lstat(filepath.Join(path, entry.Name())); os.IsNotExist(err) {
+				changes = append(changes, containerChange{Path: filepath.Join(changePath, entry.Name()),
+					Kind: changeDeleted})
+			}
+		}
+		return nil
+	})
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, err
+}
+
+/*
+	Called for "gocker diff". Containers that exited are gone, unless
+	they are mounted with "gocker mount", which keeps their files.
+*/
+
+func printContainerDiff(containerID string, format string) {
+	if format != "text" && format != "json" {
+		log.Fatalf("Unknown format %s, use text or json\n", format)
+	}
+	upperDir := getContainerFSHome(containerID) + "/upperdir"
+	if _, err := os.Stat(upperDir); err != nil {
+		log.Fatalf("No such container: %s\n", containerID)
+	}
+	_, imageShaHex, err := getDistribution(containerID)
+	if err != nil || len(imageShaHex) == 0 {
+		log.Fatalf("Unable to find the image of container %s\n", containerID)
+	}
+	imageDir, cleanup, err := mountImageReadOnly(imageShaHex)
+	if err != nil {
+		log.Fatalf("Unable to mount image %s: %v\n", imageShaHex, err)
+	}
+	changes, err := getContainerChanges(upperDir, imageDir)
+	cleanup()
+	if err != nil {
+		log.Fatalf("Unable to list changes of container %s: %v\n", containerID, err)
+	}
+
+	if format == "json" {
+		if changes == nil {
+			changes = []containerChange{}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		doOrDieWithMsg(encoder.Encode(changes), "Unable to write changes")
+		return
+	}
+	for _, change := range changes {
+		fmt.Printf("%s %s\n", changeKinds[change.Kind], change.Path)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"os"
+	"strings"
+)
+
+/*
+	Splits s into words on white space, keeping "quoted strings" together
+	and dropping the quotes, the way a shell would for simple cases.
+*/
+
+func splitWords(s string) []string {
+	var words []string
+	var word strings.Builder
+	inQuotes, inWord := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s):
+			i++
+			word.WriteByte(s[i])
+			inWord = true
+		case c == '"':
+			inQuotes = !inQuotes
+			inWord = true
+		case (c == ' ' || c == '\t') && !inQuotes:
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+/*
+	CMD, ENTRYPOINT and RUN take either a JSON array (exec form) or a
+	plain string that is run with /bin/sh -c (shell form).
+*/
+
+func parseCommandForm(args string) ([]string, error) {
+	args = strings.TrimSpace(args)
+	if strings.HasPrefix(args, "[") {
+		var command []string
+		if err := json.Unmarshal([]byte(args), &command); err != nil {
+			return nil, fmt.Errorf("invalid JSON array %s: %v", args, err)
+		}
+		return command, nil
+	}
+	return []string{"/bin/sh", "-c", args}, nil
+}
+
+/*
+	ENV and LABEL take either "key=value key2=value2" or "key value".
+*/
+
+func parseKeyValues(args string) (map[string]string, []string, error) {
+	values := make(map[string]string)
+	var keys []string
+	words := splitWords(args)
+	if len(words) == 0 {
+		return nil, nil, fmt.Errorf("missing key and value")
+	}
+	if !strings.Contains(words[0], "=") {
+		if len(words) < 2 {
+			return nil, nil, fmt.Errorf("missing value for %s", words[0])
+		}
+		parts := strings.SplitN(strings.TrimSpace(args), " ", 2)
+		values[words[0]] = strings.Join(splitWords(parts[1]), " ")
+		return values, []string{words[0]}, nil
+	}
+	for _, word := range words {
+		kv := strings.SplitN(word, "=", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 {
+			return nil, nil, fmt.Errorf("expected key=value, got %s", word)
+		}
+		if _, ok := values[kv[0]]; !ok {
+			keys = append(keys, kv[0])
+		}
+		values[kv[0]] = kv[1]
+	}
+	return values, keys, nil
+}
+
+func setEnv(env []string, key string, value string) []string {
+	for i, kv := range env {
+		if strings.HasPrefix(kv, key+"=") {
+			env[i] = key + "=" + value
+			return env
+		}
+	}
+	return append(env, key+"="+value)
+}
+
+/*
+	Applies a Dockerfile instruction that only changes the image config,
+	like those "gocker import --change" takes, to cfg.
+*/
+
+func applyConfigInstruction(cfg *v1.Config, instruction string) error {
+	parts := strings.SplitN(strings.TrimSpace(instruction), " ", 2)
+	keyword := strings.ToUpper(parts[0])
+	args := ""
+	if len(parts) > 1 {
+		args = strings.TrimSpace(parts[1])
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("%s needs arguments", keyword)
+	}
+
+	switch keyword {
+	case "CMD", "ENTRYPOINT":
+		command, err := parseCommandForm(args)
+		if err != nil {
+			return err
+		}
+		if keyword == "CMD" {
+			cfg.Cmd = command
+		} else {
+			cfg.Entrypoint = command
+		}
+	case "ENV":
+		values, keys, err := parseKeyValues(args)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			cfg.Env = setEnv(cfg.Env, key, values[key])
+		}
+	case "LABEL":
+		values, _, err := parseKeyValues(args)
+		if err != nil {
+			return err
+		}
+		if cfg.Labels == nil {
+			cfg.Labels = make(map[string]string)
+		}
+		for key, value := range values {
+			cfg.Labels[key] = value
+		}
+	case "EXPOSE":
+		if cfg.ExposedPorts == nil {
+			cfg.ExposedPorts = make(map[string]struct{})
+		}
+		for _, port := range strings.Fields(args) {
+			if !strings.Contains(port, "/") {
+				port += "/tcp"
+			}
+			cfg.ExposedPorts[port] = struct{}{}
+		}
+	case "VOLUME":
+		volumes := strings.Fields(args)
+		if strings.HasPrefix(args, "[") {
+			if err := json.Unmarshal([]byte(args), &volumes); err != nil {
+				return fmt.Errorf("invalid JSON array %s: %v", args, err)
+			}
+		}
+		if cfg.Volumes == nil {
+			cfg.Volumes = make(map[string]struct{})
+		}
+		for _, volume := range volumes {
+			cfg.Volumes[volume] = struct{}{}
+		}
+	case "WORKDIR":
+		cfg.WorkingDir = args
+	case "USER":
+		cfg.User = args
+	default:
+		return fmt.Errorf("unsupported instruction %s", keyword)
+	}
+	return nil
+}
+
+type dockerfileInstruction struct {
+	keyword string
+	args    string
+}
+
+/*
+	Reads a Dockerfile into its instructions. Comments and empty lines
+	are skipped and lines ending in a backslash continue on the next.
+*/
+
+func parseDockerfile(path string) ([]dockerfileInstruction, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var instructions []dockerfileInstruction
+	var current strings.Builder
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasSuffix(line, "\\") {
+			current.WriteString(strings.TrimSuffix(line, "\\") + " ")
+			continue
+		}
+		current.WriteString(line)
+		text := current.String()
+		instruction := dockerfileInstruction{keyword: strings.ToUpper(text)}
+		if i := strings.IndexAny(text, " \t"); i > 0 {
+			instruction.keyword = strings.ToUpper(text[:i])
+			instruction.args = strings.TrimSpace(text[i:])
+		}
+		instructions = append(instructions, instruction)
+		current.Reset()
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if current.Len() > 0 {
+		return nil, fmt.Errorf("unexpected end of file after %s", current.String())
+	}
+	return instructions, nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+/*
+	Layers are downloaded by us rather than by go-containerregistry so that
+	we can show progress and resume interrupted downloads. While a layer
+	is being downloaded, it lives in the image's temporary directory with
+	a ".partial" suffix. If gocker is interrupted, the next pull of the
+	same image finds the partial file and asks the registry for only the
+	remaining bytes with an HTTP range request.
+*/
+
+type downloadProgress struct {
+	id       string
+	total    int64
+	complete int64
+	started  time.Time
+	resumed  int64
+	lastShow time.Time
+}
+
+func (p *downloadProgress) Write(b []byte) (int, error) {
+	p.complete += int64(len(b))
+	if time.Since(p.lastShow) > 200*time.Millisecond {
+		p.show("Downloading")
+		p.lastShow = time.Now()
+	}
+	return len(b), nil
+}
+
+func (p *downloadProgress) show(status string) {
+	var rate float64
+	elapsed := time.Since(p.started).Seconds()
+	if elapsed > 0 {
+		rate = float64(p.complete-p.resumed) / elapsed
+	}
+	fmt.Fprintf(os.Stderr, "\r%s: %-17s %9s/%-9s %9s/s   ", p.id, status,
+		humanSize(p.complete), humanSize(p.total), humanSize(int64(rate)))
+}
+
+/*
+	Progress goes to STDERR, like the rest of what we have to say, as
+	STDOUT may be a tarball or an SBOM.
+*/
+
+func (p *downloadProgress) finish(status string) {
+	if len(status) > 0 {
+		p.show(status)
+	}
+	fmt.Fprintln(os.Stderr)
+}
+
+func humanSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	i := 0
+	for value >= 1000 && i < len(units)-1 {
+		value /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%dB", size)
+	}
+	return fmt.Sprintf("%.1f%s", value, units[i])
+}
+
+func getRegistryTransport(ref name.Reference) (http.RoundTripper, error) {
+	auth, err := authn.DefaultKeychain.Resolve(ref.Context().Registry)
+	if err != nil {
+		return nil, err
+	}
+	scopes := []string{ref.Scope(transport.PullScope)}
+	return transport.New(ref.Context().Registry, auth,
+		getRegistryHTTPTransport(ref.Context().RegistryStr()), scopes)
+}
+
+func getBlobURL(repo name.Repository, digest v1.Hash) string {
+	return fmt.Sprintf("%s://%s/v2/%s/blobs/%s", repo.Registry.Scheme(),
+		repo.RegistryStr(), repo.RepositoryStr(), digest.String())
+}
+
+func fileDigestMatches(path string, digest v1.Hash) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)) == digest.Hex, nil
+}
+
+/*
+	Layers are unpacked into each image that has them, so a layer that an
+	image we already have was pulled with needn't be downloaded again,
+	and its files can be hard linked from there as linkLayerDir() does.
+	Only layers whose file tree that image recorded for diffID will do,
+	as the tree comes along with them. Returns where the layer is, if
+	anywhere.
+*/
+
+type storedLayer struct {
+	imageShaHex string
+	layer       string
+}
+
+func findStoredLayer(digest v1.Hash, diffID v1.Hash, layerFile string) (storedLayer, bool) {
+	for _, imageShaHex := range getAllImageHashes() {
+		mani := manifest{}
+		if err := parseManifest(getManifestPathForImage(imageShaHex), &mani); err != nil || len(mani) == 0 {
+			continue
+		}
+		treeDigest, ok := parseImageDetails(imageShaHex).LayerTrees[diffID.String()]
+		if !ok {
+			continue
+		}
+		for _, layer := range mani[0].Layers {
+			if layer != layerFile && layer != "blobs/sha256/"+digest.Hex {
+				continue
+			}
+			layerDir := getBasePathForImage(imageShaHex) + "/" + getLayerDirName(layer) + "/fs"
+			if info, err := os.Stat(layerDir); err != nil || !info.IsDir() {
+				continue
+			}
+			if treeBytes, err := ioutil.ReadFile(getLayerTreePath(imageShaHex, layer)); err == nil &&
+				getDataDigest(treeBytes) == treeDigest {
+				return storedLayer{imageShaHex: imageShaHex, layer: layer}, true
+			}
+		}
+	}
+	return storedLayer{}, false
+}
+
+func showStoredLayer(digest v1.Hash, size int64) {
+	progress := &downloadProgress{id: digest.Hex[:12], total: size, complete: size, started: time.Now()}
+	progress.finish("Already exists")
+}
+
+/*
+	Asks for the blob from offset on, or all of it with no offset.
+*/
+
+func requestBlob(client *http.Client, repo name.Repository, digest v1.Hash, offset int64) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, getBlobURL(repo, digest), nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	return client.Do(req)
+}
+
+func rangeStartsAt(resp *http.Response, offset int64) bool {
+	var start int64
+	_, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start)
+	return err == nil && start == offset
+}
+
+/*
+	Downloads the blob with the given digest to dst. If dst already exists
+	a previous pull got it in full, as it only gets its name once its
+	digest is checked. If dst.partial exists, we resume from where the
+	previous attempt stopped, unless it is already as large as the blob,
+	in which case it only needs checking.
+*/
+
+func downloadBlob(client *http.Client, repo name.Repository, digest v1.Hash,
+	size int64, dst string) error {
+	progress := &downloadProgress{id: digest.Hex[:12], total: size, started: time.Now()}
+	if _, err := os.Stat(dst); err == nil {
+		progress.complete = size
+		progress.finish("Already downloaded")
+		return nil
+	}
+
+	partialPath := dst + ".partial"
+	var offset int64
+	if info, err := os.Stat(partialPath); err == nil {
+		offset = info.Size()
+	}
+	if offset >= size && offset > 0 {
+		progress.complete = offset
+		progress.show("Verifying")
+		if matches, err := fileDigestMatches(partialPath, digest); err == nil && matches {
+			progress.finish("Download complete")
+			return os.Rename(partialPath, dst)
+		}
+		/* Whatever we have isn't the blob, so start over */
+		progress.finish("")
+		progress.complete = 0
+		offset = 0
+	}
+
+	resp, err := requestBlob(client, repo, digest, offset)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusPartialContent && !rangeStartsAt(resp, offset) {
+		/* Not the part we asked for, so have all of it instead */
+		resp.Body.Close()
+		offset = 0
+		if resp, err = requestBlob(client, repo, digest, 0); err != nil {
+			return err
+		}
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		/* A range from the start is all of the blob */
+		if offset > 0 {
+			flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+			progress.complete = offset
+			progress.resumed = offset
+			progress.show("Resuming")
+		}
+	case http.StatusOK:
+		/* The registry ignored our range request, so start over */
+	default:
+		return transport.CheckError(resp, http.StatusOK, http.StatusPartialContent)
+	}
+
+	file, err := os.OpenFile(partialPath, flags, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.MultiWriter(file, progress), resp.Body)
+	file.Close()
+	if err != nil {
+		progress.finish("")
+		return err
+	}
+
+	progress.show("Verifying")
+	matches, err := fileDigestMatches(partialPath, digest)
+	if err != nil {
+		progress.finish("")
+		return err
+	}
+	if !matches {
+		progress.finish("")
+		os.Remove(partialPath)
+		return fmt.Errorf("digest mismatch for blob %s", digest)
+	}
+	progress.finish("Download complete")
+	return os.Rename(partialPath, dst)
+}
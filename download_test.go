@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func nullLogger() *log.Logger {
+	return log.New(ioutil.Discard, "", 0)
+}
+
+/*
+	Pushes a random image with one layer to the registry at host and
+	returns it.
+*/
+
+func pushTestImage(t *testing.T, host string, repo string, options ...remote.Option) v1.Image {
+	img, err := random.Image(8192, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference(host + "/" + repo + ":latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img, options...); err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+/*
+	Sits in front of the in-memory registry, which always sends blobs in
+	full, to answer range requests for blobs and to drop the connection
+	after cutAfter bytes of the next blob it sends. With fromStart, it
+	answers range requests with the whole blob, as a range from 0.
+*/
+
+type interruptingRegistry struct {
+	handler   http.Handler
+	cutAfter  int
+	fromStart bool
+	ranges    []string
+}
+
+func (r *interruptingRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet || !strings.Contains(req.URL.Path, "/blobs/") {
+		r.handler.ServeHTTP(w, req)
+		return
+	}
+	r.ranges = append(r.ranges, req.Header.Get("Range"))
+	rec := httptest.NewRecorder()
+	r.handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+		return
+	}
+	body := rec.Body.Bytes()
+	var offset int
+	rangeHeader := req.Header.Get("Range")
+	if len(rangeHeader) > 0 {
+		if fmt.Sscanf(rangeHeader, "bytes=%d-", &offset); r.fromStart {
+			offset = 0
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(body)-1, len(body)))
+	}
+	w.Header().Set("Content-Length", fmt.Sprint(len(body)-offset))
+	if len(rangeHeader) > 0 {
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	if r.cutAfter > 0 {
+		w.Write(body[offset : offset+r.cutAfter])
+		w.(http.Flusher).Flush()
+		r.cutAfter = 0
+		panic(http.ErrAbortHandler)
+	}
+	w.Write(body[offset:])
+}
+
+func startInterruptingRegistry(t *testing.T) (*httptest.Server, *interruptingRegistry, name.Repository, v1.Layer) {
+	reg := &interruptingRegistry{handler: registry.New(registry.Logger(nullLogger()))}
+	server := httptest.NewServer(reg)
+	host := strings.TrimPrefix(server.URL, "http://")
+	img := pushTestImage(t, host, "test/download")
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := name.NewRepository(host+"/test/download", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, reg, repo, layers[0]
+}
+
+func getLayerDigestAndSize(t *testing.T, layer v1.Layer) (v1.Hash, int64) {
+	digest, err := layer.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := layer.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return digest, size
+}
+
+func TestDownloadBlobResumesAfterDroppedConnection(t *testing.T) {
+	server, reg, repo, layer := startInterruptingRegistry(t)
+	defer server.Close()
+	dir := createTestDir(t)
+	defer os.RemoveAll(dir)
+	digest, size := getLayerDigestAndSize(t, layer)
+	dst := dir + "/layer.tar.gz"
+
+	reg.cutAfter = 1000
+	if err := downloadBlob(http.DefaultClient, repo, digest, size, dst); err == nil {
+		t.Fatal("download with a dropped connection succeeded")
+	}
+	if info, err := os.Stat(dst + ".partial"); err != nil || info.Size() != 1000 {
+		t.Fatalf("partial download not kept: %v", err)
+	}
+
+	if err := downloadBlob(http.DefaultClient, repo, digest, size, dst); err != nil {
+		t.Fatalf("resumed download failed: %v", err)
+	}
+	if len(reg.ranges) != 2 || reg.ranges[1] != "bytes=1000-" {
+		t.Fatalf("download wasn't resumed, range requests: %q", reg.ranges)
+	}
+	if matches, err := fileDigestMatches(dst, digest); err != nil || !matches {
+		t.Fatalf("downloaded blob doesn't match its digest: %v", err)
+	}
+	if _, err := os.Stat(dst + ".partial"); !os.IsNotExist(err) {
+		t.Fatal("partial download left behind")
+	}
+}
+
+func TestDownloadBlobChecksRangeItGets(t *testing.T) {
+	server, reg, repo, layer := startInterruptingRegistry(t)
+	defer server.Close()
+	dir := createTestDir(t)
+	defer os.RemoveAll(dir)
+	digest, size := getLayerDigestAndSize(t, layer)
+	dst := dir + "/layer.tar.gz"
+
+	reg.cutAfter = 1000
+	if err := downloadBlob(http.DefaultClient, repo, digest, size, dst); err == nil {
+		t.Fatal("download with a dropped connection succeeded")
+	}
+	reg.fromStart = true
+	if err := downloadBlob(http.DefaultClient, repo, digest, size, dst); err != nil {
+		t.Fatalf("download after the wrong range failed: %v", err)
+	}
+	if len(reg.ranges) != 3 || reg.ranges[1] != "bytes=1000-" || len(reg.ranges[2]) > 0 {
+		t.Fatalf("expected a full download after the wrong range, got requests for %q", reg.ranges)
+	}
+	if matches, err := fileDigestMatches(dst, digest); err != nil || !matches {
+		t.Fatalf("downloaded blob doesn't match its digest: %v", err)
+	}
+}
+
+func TestDownloadBlobChecksCompletePartial(t *testing.T) {
+	server, reg, repo, layer := startInterruptingRegistry(t)
+	defer server.Close()
+	dir := createTestDir(t)
+	defer os.RemoveAll(dir)
+	digest, size := getLayerDigestAndSize(t, layer)
+	compressed, err := layer.Compressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := ioutil.ReadAll(compressed)
+	compressed.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		partial  []byte
+		requests int
+	}{
+		{"complete", blob, 0},
+		{"corrupt", bytes.Repeat([]byte{0}, len(blob)), 1},
+		{"too long", append(append([]byte{}, blob...), 0), 1},
+	}
+	for _, test := range tests {
+		reg.ranges = nil
+		dst := dir + "/" + strings.Replace(test.name, " ", "-", -1) + ".tar.gz"
+		if err := ioutil.WriteFile(dst+".partial", test.partial, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := downloadBlob(http.DefaultClient, repo, digest, size, dst); err != nil {
+			t.Errorf("%s: download failed: %v", test.name, err)
+			continue
+		}
+		if len(reg.ranges) != test.requests {
+			t.Errorf("%s: expected %d blob requests, got %q", test.name, test.requests, reg.ranges)
+		}
+		for _, rangeHeader := range reg.ranges {
+			if len(rangeHeader) > 0 {
+				t.Errorf("%s: asked for range %s of a blob we had in full", test.name, rangeHeader)
+			}
+		}
+		if matches, err := fileDigestMatches(dst, digest); err != nil || !matches {
+			t.Errorf("%s: downloaded blob doesn't match its digest: %v", test.name, err)
+		}
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"os"
 	"os/exec"
 	"strconv"
-	"strings"
 )
 
 func getPidForRunningContainer(containerID string) int {
@@ -49,12 +48,10 @@ func execInContainer(containerId string) {
 	if err != nil {
 		log.Fatalf("Unable to get container configuration")
 	}
-	imageNameAndTag := strings.Split(containerConfig.image, ":")
-	exists, imageShaHex := imageExistByTag(imageNameAndTag[0], imageNameAndTag[1])
-	if !exists {
+	if !imageStoredByHash(containerConfig.imageShaHex) {
 		log.Fatalf("Unable to get image details")
 	}
-	imgConfig := parseContainerConfig(imageShaHex)
+	imgConfig := parseContainerConfig(containerConfig.imageShaHex)
 	containerMntPath := getGockerContainersPath() + "/" + containerId + "/fs/mnt"
 	createCGroups(containerId, false)
 	doOrDieWithMsg(unix.Chroot(containerMntPath), "Unable to chroot")
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+/*
+	A container's root file system is only mounted while it runs, so
+	that is when we can export it. We check that the overlay is still
+	mounted by comparing the device of the mount point with that of the
+	directory containing it.
+*/
+
+func isContainerFSMounted(containerID string) bool {
+	var mntStat, parentStat syscall.Stat_t
+	mntPath := getContainerFSHome(containerID) + "/mnt"
+	if err := syscall.Stat(mntPath, &mntStat); err != nil {
+		return false
+	}
+	if err := syscall.Stat(getContainerFSHome(containerID), &parentStat); err != nil {
+		return false
+	}
+	return mntStat.Dev != parentStat.Dev
+}
+
+func exportContainer(containerID string, output string) {
+	if !isContainerFSMounted(containerID) {
+		log.Fatalf("No such running container: %s\n", containerID)
+	}
+	var w io.Writer = os.Stdout
+	if len(output) > 0 && output != "-" {
+		file, err := os.Create(output)
+		if err != nil {
+			log.Fatalf("Unable to create %s: %v\n", output, err)
+		}
+		defer file.Close()
+		w = file
+	}
+	if err := tarDirectory(getContainerFSHome(containerID)+"/mnt", w); err != nil {
+		log.Fatalf("Unable to export container %s: %v\n", containerID, err)
+	}
+}
+
+func getTarballDiffID(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	reader, err := getDecompressedReader(file)
+	if err != nil {
+		return "", err
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, reader); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+/*
+	Unpacks a tarball that isn't a layer into dir, a path inside root,
+	with nothing in it leading outside of root.
+*/
+
+func untarInRoot(tarball string, root string, dir string) error {
+	file, err := os.Open(tarball)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader, err := getDecompressedReader(file)
+	if err != nil {
+		return err
+	}
+	return extractTarInRoot(reader, root, dir, "", "")
+}
+
+/*
+	Unpacks a root fs tarball, from debootstrap or buildroot for instance,
+	read from r into target. Unlike layers, these have device nodes in
+	/dev and files owned by users other than root, which
+	extractTarInRoot() keeps, and no whiteouts.
+*/
+
+func untarRootFS(r io.Reader, target string) error {
+	return extractTarInRoot(r, target, "/", "", "")
+}
+
+/*
+	Called for "gocker import". The tarball becomes the only layer of a
+	new image. Its config starts out with just a default PATH, which the
+	Dockerfile instructions passed with --change can add to.
+*/
+
+func importImage(input string, dst string, changes []string) {
+	input, err := filepath.Abs(input)
+	if err != nil {
+		log.Fatalf("Unable to find %s: %v\n", input, err)
+	}
+	diffID, err := getTarballDiffID(input)
+	if err != nil {
+		log.Fatalf("Unable to read %s: %v\n", input, err)
+	}
+
+	now := v1.Time{Time: time.Now().UTC()}
+	cfg := v1.ConfigFile{
+		Architecture: runtime.GOARCH,
+		OS:           "linux",
+		Created:      now,
+		RootFS: v1.RootFS{
+			Type:    "layers",
+			DiffIDs: []v1.Hash{{Algorithm: "sha256", Hex: diffID}},
+		},
+		History: []v1.History{{Created: now, CreatedBy: "gocker import " + filepath.Base(input)}},
+		Config: v1.Config{
+			Env: []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"},
+		},
+	}
+	for _, change := range changes {
+		if err := applyConfigInstruction(&cfg.Config, change); err != nil {
+			log.Fatalf("Invalid change %q: %v\n", change, err)
+		}
+	}
+	rawConfig, err := json.Marshal(cfg)
+	if err != nil {
+		log.Fatalf("Unable to marshal image config: %v\n", err)
+	}
+
+	tmpPath, err := ioutil.TempDir(getGockerTempPath(), "import-")
+	if err != nil {
+		log.Fatalf("Unable to create temporary directory: %v\n", err)
+	}
+	defer os.RemoveAll(tmpPath)
+	pathConfig := tmpPath + "/config.json"
+	doOrDieWithMsg(ioutil.WriteFile(pathConfig, rawConfig, 0644), "Unable to write image config")
+	/* The layer's file name decides the name of the directory it unpacks to */
+	layerFile := diffID + ".tar"
+	doOrDieWithMsg(os.Symlink(input, tmpPath+"/"+layerFile), "Unable to link layer tarball")
+
+	entry := manifestEntry{Layers: []string{layerFile}}
+	if len(dst) > 0 {
+		entry.RepoTags = []string{dst}
+	}
+	registerLoadedImage(tmpPath, pathConfig, entry, untarRootFS)
+}
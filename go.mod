@@ -3,6 +3,7 @@ module github.com/shuveb/containers-the-hard-way
 go 1.14
 
 require (
+	github.com/docker/cli v0.0.0-20191017083524-a8ff7f821017
 	github.com/google/go-containerregistry v0.1.1
 	github.com/spf13/pflag v1.0.5
 	github.com/vishvananda/netlink v1.1.0
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+	Layers of images we commit or build are hard linked to those of the
+	images they came from, so the same file can be part of several
+	images while taking up space only once. To account for this, sizes
+	are added up for files we haven't seen yet, going by their device
+	and inode numbers.
+*/
+
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+func getDirSize(dir string, seen map[fileID]bool) int64 {
+	var size int64
+	_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			id := fileID{dev: uint64(stat.Dev), ino: stat.Ino}
+			if seen[id] {
+				return nil
+			}
+			seen[id] = true
+		}
+		size += info.Size()
+		return nil
+	})
+	return size
+}
+
+/*
+	What removing dir would free: files linked to from elsewhere stay.
+*/
+
+func getReclaimableSize(dir string) int64 {
+	var size int64
+	_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() && stat.Nlink == 1 {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+func getImageLayerDirs(imageShaHex string) []string {
+	mani := manifest{}
+	if err := parseManifest(getManifestPathForImage(imageShaHex), &mani); err != nil || len(mani) == 0 {
+		return nil
+	}
+	var layerDirs []string
+	for _, layer := range mani[0].Layers {
+		layerDirs = append(layerDirs, getBasePathForImage(imageShaHex)+"/"+getLayerDirName(layer)+"/fs")
+	}
+	return layerDirs
+}
+
+func getImageSize(imageShaHex string, seen map[fileID]bool) int64 {
+	var size int64
+	for _, layerDir := range getImageLayerDirs(imageShaHex) {
+		size += getDirSize(layerDir, seen)
+	}
+	return size
+}
+
+func parseImageConfigFile(imageShaHex string) *v1.ConfigFile {
+	rawConfig, err := ioutil.ReadFile(getConfigPathForImage(imageShaHex))
+	if err != nil {
+		log.Fatalf("Could not read image config file: %v\n", err)
+	}
+	cfg, err := v1.ParseConfigFile(bytes.NewReader(rawConfig))
+	if err != nil {
+		log.Fatalf("Unable to parse image config: %v\n", err)
+	}
+	return cfg
+}
+
+func humanTimeSince(t time.Time) string {
+	if t.IsZero() {
+		return "N/A"
+	}
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return "Less than a minute ago"
+	case d < time.Hour:
+		return fmt.Sprintf("%d minutes ago", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%d hours ago", int(d.Hours()))
+	case d < 14*24*time.Hour:
+		return fmt.Sprintf("%d days ago", int(d.Hours()/24))
+	case d < 60*24*time.Hour:
+		return fmt.Sprintf("%d weeks ago", int(d.Hours()/24/7))
+	case d < 2*365*24*time.Hour:
+		return fmt.Sprintf("%d months ago", int(d.Hours()/24/30))
+	}
+	return fmt.Sprintf("%d years ago", int(d.Hours()/24/365))
+}
+
+/*
+	Called for "gocker history". Every entry of the config's history
+	that isn't marked as an empty layer created the next of the image's
+	layers, in order. Like "docker history", newest entries come first.
+*/
+
+func printImageHistory(src string) {
+	imageShaHex, exists := resolveImage(src)
+	if !exists {
+		log.Fatalf("No such image: %s\n", src)
+	}
+	cfg := parseImageConfigFile(imageShaHex)
+	layerDirs := getImageLayerDirs(imageShaHex)
+	seen := make(map[fileID]bool)
+
+	type historyRow struct {
+		created   string
+		createdBy string
+		size      string
+	}
+	var rows []historyRow
+	layer := 0
+	for _, h := range cfg.History {
+		row := historyRow{created: humanTimeSince(h.Created.Time), createdBy: h.CreatedBy, size: "0B"}
+		if !h.EmptyLayer {
+			if layer < len(layerDirs) {
+				row.size = humanSize(getDirSize(layerDirs[layer], seen))
+			}
+			layer++
+		}
+		rows = append(rows, row)
+	}
+	/* Images with layers but no history for them, still show the layers */
+	for ; layer < len(layerDirs); layer++ {
+		rows = append(rows, historyRow{created: "N/A", createdBy: "<missing>",
+			size: humanSize(getDirSize(layerDirs[layer], seen))})
+	}
+
+	fmt.Printf("%-24s %-48s %s\n", "CREATED", "CREATED BY", "SIZE")
+	for i := len(rows) - 1; i >= 0; i-- {
+		createdBy := strings.Join(strings.Fields(rows[i].createdBy), " ")
+		if len(createdBy) > 45 {
+			createdBy = createdBy[:45] + "..."
+		}
+		fmt.Printf("%-24s %-48s %s\n", rows[i].created, createdBy, rows[i].size)
+	}
+}
@@ -1,27 +1,38 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"strings"
 )
 
-type manifest []struct {
+type manifestEntry struct {
 	Config string
 	RepoTags []string
 	Layers []string
 }
+type manifest []manifestEntry
 type imageConfigDetails struct {
 	Env []string	`json:"Env"`
 	Cmd []string	`json:"Cmd"`
+	WorkingDir string	`json:"WorkingDir"`
+	User string	`json:"User"`
+	Volumes map[string]struct{}	`json:"Volumes"`
 }
 type imageConfig struct {
 	Config imageConfigDetails `json:"config"`
+	OS string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant string `json:"variant"`
 }
 
 /*
@@ -46,6 +57,25 @@ list of images we have on the system.
 type imageEntries map[string]string
 type imagesDB map[string]imageEntries
 
+/*
+	Besides its entries in the images DB, each image has a metadata.json
+	file in its directory with details that aren't tied to any one name.
+	RepoDigests holds the canonical, digest-pinned references the image
+	was pulled by, e.g. "index.docker.io/library/ubuntu@sha256:...".
+	Platform is the os/arch[/variant] the image was built for.
+	SignedBy has the repositories and keys its signatures were verified
+	for, as getSignatureIdentity() writes them.
+	LayerTrees has the digest of each layer's tree.json, by the layer's
+	diff ID, for "gocker image verify" to trust it.
+*/
+
+type imageDetails struct {
+	RepoDigests []string
+	Platform string
+	SignedBy []string `json:",omitempty"`
+	LayerTrees map[string]string `json:",omitempty"`
+}
+
 func getBasePathForImage(imageShaHex string) string {
 	return getGockerImagesPath() + "/" + imageShaHex
 }
@@ -105,26 +135,80 @@ func imageExistByTag(imgName string, tagName string) (bool, string) {
 	return false, ""
 }
 
-func downloadImage(img v1.Image, imageShaHex string, src string) {
+/*
+	Downloads the image's config and compressed layers into the temporary
+	directory and writes a manifest.json that lists them, in the same
+	format as "docker save" tarballs, so that processLayerTarballs() can
+	treat both the same way. Layers that images we have were pulled with
+	aren't downloaded, and are returned by their file in the manifest
+	with where they are unpacked.
+*/
+func downloadImage(img v1.Image, imageShaHex string, ref name.Reference) map[string]storedLayer {
 	path := getGockerTempPath() + "/" + imageShaHex
 	os.Mkdir(path, 0755)
-	path +="/package.tar"
-	/* Save the image as a tar file */
-	if err := crane.SaveLegacy(img, src, path); err != nil {
-		log.Fatalf("saving tarball %s: %v", path, err)
+
+	tr, err := getRegistryTransport(ref)
+	if err != nil {
+		log.Fatalf("Unable to set up registry transport: %v\n", err)
 	}
-	log.Printf("Successfully downloaded %s\n", src)
-}
+	client := &http.Client{Transport: tr}
 
-func untarFile(imageShaHex string) {
-	pathDir := getGockerTempPath() + "/" + imageShaHex
-	pathTar := pathDir + "/package.tar"
-	if err := untar(pathTar, pathDir); err != nil {
-		log.Fatalf("Error untaring file: %v\n", err)
+	configName, err := img.ConfigName()
+	if err != nil {
+		log.Fatalf("Unable to get image config name: %v\n", err)
+	}
+	rawConfig, err := img.RawConfigFile()
+	if err != nil {
+		log.Fatalf("Unable to get image config: %v\n", err)
 	}
+	configFile := configName.Hex + ".json"
+	doOrDieWithMsg(ioutil.WriteFile(path+"/"+configFile, rawConfig, 0644),
+		"Unable to save image config")
+
+	layers, err := img.Layers()
+	if err != nil {
+		log.Fatalf("Unable to get image layers: %v\n", err)
+	}
+	mani := manifest{{Config: configFile, RepoTags: []string{ref.Name()}}}
+	storedLayers := make(map[string]storedLayer)
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			log.Fatalf("Unable to get layer digest: %v\n", err)
+		}
+		diffID, err := layer.DiffID()
+		if err != nil {
+			log.Fatalf("Unable to get layer diff ID: %v\n", err)
+		}
+		size, err := layer.Size()
+		if err != nil {
+			log.Fatalf("Unable to get layer size: %v\n", err)
+		}
+		layerFile := digest.Hex + ".tar.gz"
+		if stored, ok := findStoredLayer(digest, diffID, layerFile); ok {
+			showStoredLayer(digest, size)
+			storedLayers[layerFile] = stored
+		} else if err := downloadBlob(client, ref.Context(), digest, size, path+"/"+layerFile); err != nil {
+			log.Fatalf("Unable to download layer %s: %v\n", digest, err)
+		}
+		mani[0].Layers = append(mani[0].Layers, layerFile)
+	}
+	maniBytes, err := json.Marshal(mani)
+	if err != nil {
+		log.Fatalf("Unable to marshal manifest: %v\n", err)
+	}
+	doOrDieWithMsg(ioutil.WriteFile(path+"/manifest.json", maniBytes, 0644),
+		"Unable to save image manifest")
+	log.Printf("Successfully downloaded %s\n", ref.Name())
+	return storedLayers
 }
 
-func processLayerTarballs(imageShaHex string, fullImageHex string) {
+/*
+	Unpacks what downloadImage() downloaded. Layers in storedLayers are
+	hard linked from where they are stored instead.
+*/
+
+func processLayerTarballs(imageShaHex string, fullImageHex string, storedLayers map[string]storedLayer) {
 	tmpPathDir := getGockerTempPath() + "/" + imageShaHex
 	pathManifest := tmpPathDir + "/manifest.json"
 	pathConfig := tmpPathDir + "/" + fullImageHex + ".json"
@@ -137,22 +221,118 @@ func processLayerTarballs(imageShaHex string, fullImageHex string) {
 	if len(mani) > 1 {
 		log.Fatal("I don't know how to handle more than one manifest.")
 	}
+	extractImageLayers(tmpPathDir, imageShaHex, pathConfig, mani[0], untarReader, storedLayers)
+}
+
+/*
+	Layers are unpacked into directories named after the first 12
+	characters of their file name in the manifest. Archives written by
+	recent versions of Docker and OCI layouts keep layers as
+	"blobs/sha256/<hash>", in which case we go by the hash.
+*/
+
+func getLayerDirName(layer string) string {
+	name := strings.TrimPrefix(layer, "blobs/sha256/")
+	if len(name) < 12 {
+		return name
+	}
+	return name[:12]
+}
+
+/*
+	Unpacks the layers listed in a manifest entry from srcDir into the
+	image's directory. These become the basis of our container root fs.
+	The manifest entry and config are kept for reference later. This is
+	used both for images we pull and for images loaded from archives.
+	Layers are unpacked with unpack, which is untarReader() but for
+	imports, unless they are in storedLayers, which are linked instead.
+	Each layer must come out to its diff ID in the config.
+*/
 
+func extractImageLayers(srcDir string, imageShaHex string, pathConfig string, entry manifestEntry,
+	unpack func(r io.Reader, target string) error, storedLayers map[string]storedLayer) {
+	diffIDs := getConfigDiffIDs(pathConfig)
+	if len(diffIDs) != len(entry.Layers) {
+		log.Fatalf("Image config has %d diff IDs for %d layers\n", len(diffIDs), len(entry.Layers))
+	}
 	imagesDir := getGockerImagesPath() + "/" + imageShaHex
 	_ = os.Mkdir(imagesDir, 0755)
-	/* untar the layer files. These become the basis of our container root fs */
-	for _, layer := range mani[0].Layers {
-		imageLayerDir := imagesDir + "/" + layer[:12] + "/fs"
-		log.Printf("Uncompressing layer to: %s \n", imageLayerDir)
-		_ = os.MkdirAll(imageLayerDir, 0755)
-		srcLayer := tmpPathDir + "/" + layer
-		if err:= untar(srcLayer, imageLayerDir); err != nil {
-			log.Fatalf("Unable to untar layer file: %s: %v\n", srcLayer, err)
+	layerTrees := make(map[string]string)
+	for i, layer := range entry.Layers {
+		imageLayerDir := imagesDir + "/" + getLayerDirName(layer)
+		var treeDigest string
+		var err error
+		if stored, ok := storedLayers[layer]; ok {
+			log.Printf("Linking layer to: %s \n", imageLayerDir+"/fs")
+			/* Links can't replace what an interrupted pull left */
+			err = os.RemoveAll(imageLayerDir + "/fs")
+			if err == nil {
+				err = linkLayerDir(getBasePathForImage(stored.imageShaHex)+"/"+
+					getLayerDirName(stored.layer)+"/fs", imageLayerDir+"/fs")
+			}
+			if err == nil {
+				treeDigest, err = copyLayerFileTree(stored.imageShaHex, stored.layer, diffIDs[i], imageLayerDir)
+			}
+		} else {
+			log.Printf("Uncompressing layer to: %s \n", imageLayerDir+"/fs")
+			_ = os.MkdirAll(imageLayerDir+"/fs", 0755)
+			treeDigest, err = unpackLayer(srcDir+"/"+layer, imageLayerDir, diffIDs[i], unpack)
 		}
+		if err != nil {
+			log.Fatalf("Unable to unpack layer file: %s: %v\n", layer, err)
+		}
+		layerTrees[diffIDs[i]] = treeDigest
 	}
-	/* Copy the manifest file for reference later */
-	copyFile(pathManifest, getManifestPathForImage(imageShaHex))
-	copyFile(pathConfig, getConfigPathForImage(imageShaHex))
+	storeImageManifest(imageShaHex, pathConfig, entry, layerTrees)
+}
+
+func getConfigDiffIDs(pathConfig string) []string {
+	rawConfig, err := ioutil.ReadFile(pathConfig)
+	if err != nil {
+		log.Fatalf("Could not read image config file: %v\n", err)
+	}
+	cfg, err := v1.ParseConfigFile(bytes.NewReader(rawConfig))
+	if err != nil {
+		log.Fatalf("Unable to parse image config: %v\n", err)
+	}
+	var diffIDs []string
+	for _, diffID := range cfg.RootFS.DiffIDs {
+		diffIDs = append(diffIDs, diffID.String())
+	}
+	return diffIDs
+}
+
+/*
+	Keeps the manifest entry and config of an image whose layers are in
+	its directory. layerTrees has the digests of the tree.json files
+	already written, by diff ID. The layers without one have theirs
+	written from what is on disk, as is the case for those we made.
+*/
+
+func storeImageManifest(imageShaHex string, pathConfig string, entry manifestEntry, layerTrees map[string]string) {
+	diffIDs := getConfigDiffIDs(pathConfig)
+	if len(diffIDs) != len(entry.Layers) {
+		log.Fatalf("Image config has %d diff IDs for %d layers\n", len(diffIDs), len(entry.Layers))
+	}
+	maniBytes, err := json.Marshal(manifest{entry})
+	if err != nil {
+		log.Fatalf("Unable to marshal manifest: %v\n", err)
+	}
+	doOrDieWithMsg(ioutil.WriteFile(getManifestPathForImage(imageShaHex), maniBytes, 0644),
+		"Unable to save image manifest")
+	doOrDieWithMsg(copyFile(pathConfig, getConfigPathForImage(imageShaHex)),
+		"Unable to save image config")
+	details := parseImageDetails(imageShaHex)
+	details.LayerTrees = make(map[string]string)
+	for i, layer := range entry.Layers {
+		treeDigest, ok := layerTrees[diffIDs[i]]
+		if !ok {
+			treeDigest, err = storeLayerFileTree(getBasePathForImage(imageShaHex)+"/"+getLayerDirName(layer), nil)
+			doOrDieWithMsg(err, "Unable to record layer files")
+		}
+		details.LayerTrees[diffIDs[i]] = treeDigest
+	}
+	storeImageDetails(imageShaHex, details)
 }
 
 func parseContainerConfig(imageShaHex string) imageConfig {
@@ -209,84 +389,346 @@ func storeImageMetadata(image string, tag string, imageShaHex string) {
 
 func removeImageMetadata(imageShaHex string) {
 	idb := imagesDB{}
-	ientries := imageEntries{}
 	parseImagesMetadata(&idb)
-	imgName, _ := imageExistsByHash(imageShaHex)
-	if len(imgName) == 0 {
-		log.Fatalf("Could not get image details")
-	}
-	ientries = idb[imgName]
-	for tag, hash := range ientries {
-		if hash == imageShaHex {
-			delete(ientries, tag)
+	for imgName, ientries := range idb {
+		for tag, hash := range ientries {
+			if hash == imageShaHex {
+				delete(ientries, tag)
+			}
+		}
+		if len(ientries) == 0 {
+			delete(idb, imgName)
 		}
 	}
-	if len(ientries) == 0 {
-		delete(idb, imgName)
-	} else {
-		idb[imgName] = ientries
+	marshalImageMetadata(idb)
+}
+
+func removeImageTag(imgName string, tagName string) {
+	idb := imagesDB{}
+	parseImagesMetadata(&idb)
+	if ientries, ok := idb[imgName]; ok {
+		delete(ientries, tagName)
+		if len(ientries) == 0 {
+			delete(idb, imgName)
+		}
 	}
 	marshalImageMetadata(idb)
 }
 
-func deleteImageByHash(imageShaHex string) {
-	// Ensure that no running container is using the image we're setting
-	// out to delete. There is a race condition possible here, but we use
-	// the ostrich algorithm
-	imgName, imgTag := getImageAndTagForHash(imageShaHex)
-	if len(imgName) == 0 {
-		log.Fatalf("No such image")
+func getTagsForHash(imageShaHex string) []string {
+	var tags []string
+	idb := imagesDB{}
+	parseImagesMetadata(&idb)
+	for imgName, ientries := range idb {
+		for tag, hash := range ientries {
+			if hash == imageShaHex {
+				tags = append(tags, formatImageNameAndTag(imgName, tag))
+			}
+		}
+	}
+	return tags
+}
+
+/*
+	Every directory under the images path holds an image. Those that no
+	name in the images DB points to anymore are dangling. Images become
+	dangling when their last tag is moved elsewhere by a pull or by
+	"gocker tag", or is removed while a container still uses the image.
+*/
+
+func imageStoredByHash(imageShaHex string) bool {
+	_, err := os.Stat(getManifestPathForImage(imageShaHex))
+	return len(imageShaHex) > 0 && err == nil
+}
+
+func getAllImageHashes() []string {
+	var hashes []string
+	entries, err := ioutil.ReadDir(getGockerImagesPath())
+	if err != nil {
+		log.Fatalf("Unable to read images directory: %v\n", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && imageStoredByHash(entry.Name()) {
+			hashes = append(hashes, entry.Name())
+		}
 	}
+	return hashes
+}
+
+func getDanglingImages() []string {
+	var dangling []string
+	for _, hash := range getAllImageHashes() {
+		if imgName, _ := imageExistsByHash(hash); len(imgName) == 0 {
+			dangling = append(dangling, hash)
+		}
+	}
+	return dangling
+}
+
+/*
+	Takes either an image ID or an image name with an optional tag or
+	digest, and returns the ID of the image it refers to.
+*/
+
+func resolveImage(src string) (string, bool) {
+	if imageStoredByHash(src) {
+		return src, true
+	}
+	if _, err := name.ParseReference(src); err != nil {
+		return "", false
+	}
+	exists, imageShaHex := imageExistByTag(getImageNameAndTag(src))
+	return imageShaHex, exists
+}
+
+/*
+	Returns the running containers of the image and where it is mounted
+	with "gocker image mount" or "gocker mount".
+*/
+
+func getImageUsers(imageShaHex string) []string {
+	var users []string
 	containers, err := getRunningContainers()
 	if err != nil {
 		log.Fatalf("Unable to get running containers list: %v\n", err)
 	}
 	for _, container := range containers {
-		if container.image == imgName + ":" + imgTag {
-			log.Fatalf("Cannot delete image becuase it is in use by: %s",
-						container.containerId)
+		if container.imageShaHex == imageShaHex {
+			users = append(users, container.containerId)
 		}
 	}
+	return append(users, getImageMounts()[imageShaHex]...)
+}
+
+func deleteImageByHash(imageShaHex string) {
+	// Ensure that no running container is using the image we're setting
+	// out to delete. There is a race condition possible here, but we use
+	// the ostrich algorithm
+	if !imageStoredByHash(imageShaHex) {
+		log.Fatalf("No such image")
+	}
+	if users := getImageUsers(imageShaHex); len(users) > 0 {
+		log.Fatalf("Cannot delete image becuase it is in use by: %s",
+					strings.Join(users, ", "))
+	}
 
 	doOrDieWithMsg(os.RemoveAll(getGockerImagesPath() + "/" + imageShaHex),
 		"Unable to remove image directory")
 	removeImageMetadata(imageShaHex)
+	log.Printf("Deleted: %s\n", imageShaHex)
+}
+
+/*
+	Called for "gocker rmi". Given an image ID, the image is deleted
+	along with all its tags, which we only do for images with more than
+	one tag when forced. Given a name, only that tag is removed, and the
+	image goes once its last tag is gone. Forcing deletes the image the
+	name points to, whatever other tags it has.
+*/
+
+func removeImage(src string, force bool) {
+	if imageStoredByHash(src) {
+		if tags := getTagsForHash(src); len(tags) > 1 && !force {
+			log.Fatalf("Image %s is tagged as %s. Remove the tags by name or use --force.\n",
+				src, strings.Join(tags, ", "))
+		}
+		deleteImageByHash(src)
+		return
+	}
+
+	imgName, tagName := getImageNameAndTag(src)
+	exists, imageShaHex := imageExistByTag(imgName, tagName)
+	if !exists {
+		log.Fatalf("No such image: %s\n", formatImageNameAndTag(imgName, tagName))
+	}
+	if force {
+		deleteImageByHash(imageShaHex)
+		return
+	}
+	removeImageTag(imgName, tagName)
+	log.Printf("Untagged: %s\n", formatImageNameAndTag(imgName, tagName))
+	if len(getTagsForHash(imageShaHex)) > 0 {
+		return
+	}
+	if users := getImageUsers(imageShaHex); len(users) > 0 {
+		log.Printf("Keeping image %s as it is in use by: %s\n",
+			imageShaHex, strings.Join(users, ", "))
+		return
+	}
+	deleteImageByHash(imageShaHex)
+}
+
+func tagImage(src string, dst string) {
+	imageShaHex, exists := resolveImage(src)
+	if !exists {
+		log.Fatalf("No such image: %s\n", src)
+	}
+	dstTag, err := name.NewTag(dst)
+	if err != nil {
+		log.Fatalf("Invalid tag %s: %v\n", dst, err)
+	}
+	storeImageMetadata(getFamiliarName(dstTag.Context()), dstTag.TagStr(), imageShaHex)
 }
 
 func printAvailableImages() {
 	idb := imagesDB{}
 	parseImagesMetadata(&idb)
-	fmt.Printf("IMAGE\t             TAG\t   ID\n")
+
+	/*
+		SIZE is everything an image is made of, even if it shares some of
+		it with other images. The total at the end counts shared files once.
+	*/
+	sizes := make(map[string]int64)
+	allSeen := make(map[fileID]bool)
+	var totalSize, sumOfSizes int64
+	imageColumns := func(hash string) string {
+		size, ok := sizes[hash]
+		if !ok {
+			size = getImageSize(hash, make(map[fileID]bool))
+			sizes[hash] = size
+			sumOfSizes += size
+			totalSize += getImageSize(hash, allSeen)
+		}
+		created := humanTimeSince(parseImageConfigFile(hash).Created.Time)
+		return fmt.Sprintf("%s %s\t%s\t%s", hash, getPlatformForImage(hash), created, humanSize(size))
+	}
+
+	fmt.Printf("IMAGE\t             TAG\t   ID\t        PLATFORM\tCREATED\t\tSIZE\n")
 	for image, details := range idb {
 		fmt.Println(image)
 		for tag, hash := range details {
-			fmt.Printf("\t%16s %s\n", tag, hash)
+			if strings.HasPrefix(tag, "sha256:") {
+				/* Images pulled by digest have no tag to show */
+				tag = "@" + tag[:19]
+			}
+			fmt.Printf("\t%16s %s\n", tag, imageColumns(hash))
 		}
 	}
+	if dangling := getDanglingImages(); len(dangling) > 0 {
+		fmt.Println("<none>")
+		for _, hash := range dangling {
+			fmt.Printf("\t%16s %s\n", "<none>", imageColumns(hash))
+		}
+	}
+	fmt.Printf("Total size: %s (%s shared between images)\n", humanSize(totalSize),
+		humanSize(sumOfSizes-totalSize))
+}
+
+/*
+	Docker Hub images are stored under the short names people know
+	them by (e.g. "ubuntu"), while images from other registries keep
+	the registry host as part of their name (e.g. "localhost:5000/app").
+*/
+
+func getFamiliarName(repo name.Repository) string {
+	if repo.RegistryStr() == name.DefaultRegistry {
+		return strings.TrimPrefix(repo.RepositoryStr(), "library/")
+	}
+	return repo.Name()
+}
+
+func parseImageReference(src string) name.Reference {
+	ref, err := name.ParseReference(src)
+	if err == nil && isInsecureRegistry(ref.Context().RegistryStr()) {
+		ref, err = name.ParseReference(src, name.Insecure)
+	}
+	if err != nil {
+		log.Fatalf("Invalid image reference %s: %v\n", src, err)
+	}
+	return ref
 }
 
+/*
+	Returns the image name and tag we use as keys in the images DB.
+	For digest-pinned references, the digest ("sha256:...") takes the
+	place of the tag.
+*/
+
 func getImageNameAndTag(src string) (string, string) {
-	s := strings.Split(src, ":")
-	var img, tag string
-	if len(s) > 1 {
-		img, tag = s[0], s[1]
-	} else {
-		img = s[0]
-		tag = "latest"
+	ref := parseImageReference(src)
+	return getFamiliarName(ref.Context()), ref.Identifier()
+}
+
+func formatImageNameAndTag(imgName string, tagName string) string {
+	if strings.HasPrefix(tagName, "sha256:") {
+		return imgName + "@" + tagName
 	}
-	return img, tag
+	return imgName + ":" + tagName
 }
 
-func downloadImageIfRequired(src string) string {
-	imgName, tagName := getImageNameAndTag(src)
-	if downloadRequired, imageShaHex := imageExistByTag(imgName, tagName); !downloadRequired {
+func getMetadataPathForImage(imageShaHex string) string {
+	return getBasePathForImage(imageShaHex) + "/metadata.json"
+}
+
+func parseImageDetails(imageShaHex string) imageDetails {
+	details := imageDetails{}
+	data, err := ioutil.ReadFile(getMetadataPathForImage(imageShaHex))
+	if os.IsNotExist(err) {
+		/* Images pulled by older versions of gocker have no details */
+		return details
+	} else if err != nil {
+		log.Fatalf("Could not read image details: %v\n", err)
+	}
+	if err := json.Unmarshal(data, &details); err != nil {
+		log.Fatalf("Unable to parse image details: %v\n", err)
+	}
+	return details
+}
+
+func storeImageDetails(imageShaHex string, details imageDetails) {
+	fileBytes, err := json.Marshal(details)
+	if err != nil {
+		log.Fatalf("Unable to marshall image details: %v\n", err)
+	}
+	if err := ioutil.WriteFile(getMetadataPathForImage(imageShaHex), fileBytes, 0644); err != nil {
+		log.Fatalf("Unable to save image details: %v\n", err)
+	}
+}
+
+func recordImageDetails(imageShaHex string, ref name.Reference, img v1.Image) {
+	digest, err := img.Digest()
+	if err != nil {
+		log.Fatalf("Unable to get image digest: %v\n", err)
+	}
+	repoDigest := ref.Context().Digest(digest.String()).Name()
+	details := parseImageDetails(imageShaHex)
+	if !stringInSlice(repoDigest, details.RepoDigests) {
+		details.RepoDigests = append(details.RepoDigests, repoDigest)
+	}
+	imgConfig := parseContainerConfig(imageShaHex)
+	details.Platform = formatPlatform(v1.Platform{OS: imgConfig.OS,
+		Architecture: imgConfig.Architecture, Variant: imgConfig.Variant})
+	storeImageDetails(imageShaHex, details)
+}
+
+func downloadImageIfRequired(src string, platformStr string) string {
+	ref := parseImageReference(src)
+	imgName, tagName := getFamiliarName(ref.Context()), ref.Identifier()
+	platform, err := parsePlatform(platformStr)
+	if err != nil {
+		log.Fatalf("Invalid platform: %v\n", err)
+	}
+	exists, imageShaHex := imageExistByTag(imgName, tagName)
+	if exists && len(platformStr) > 0 && !platformMatches(imageShaHex, platform) {
+		log.Printf("Local %s is for %s, not %s.\n",
+			formatImageNameAndTag(imgName, tagName), getPlatformForImage(imageShaHex), platformStr)
+		exists = false
+	}
+	if exists && !isImageSignedByKeys(imageShaHex, ref.Context(), getRequiredKeys(ref.Context())) {
+		log.Printf("Local %s wasn't verified to be signed, checking the registry.\n",
+			formatImageNameAndTag(imgName, tagName))
+		exists = false
+	}
+	if !exists {
 		/* Setup the image we want to pull */
-		log.Printf("Downloading metadata for %s:%s, please wait...", imgName, tagName)
-		img, err := crane.Pull(strings.Join([]string{imgName, tagName}, ":"))
+		log.Printf("Downloading metadata for %s (%s), please wait...", ref.Name(), formatPlatform(platform))
+		img, srcRef, desc, err := fetchRemoteImage(ref, platform)
 		if err != nil {
 			log.Fatal(err)
 		}
 
+		signedBy := verifyImageSignatures(ref, srcRef, desc, img)
+
 		manifest, _ := img.Manifest()
 		imageShaHex = manifest.Config.Digest.Hex[:12]
 		log.Printf("imageHash: %v\n", imageShaHex)
@@ -294,16 +736,26 @@ func downloadImageIfRequired(src string) string {
 		/* Identify cases where ubuntu:latest could be the same as ubuntu:20.04*/
 		altImgName, altImgTag := imageExistsByHash(imageShaHex)
 		if len(altImgName) > 0 && len(altImgTag) > 0 {
-			log.Printf("The image you requested %s:%s is the same as %s:%s\n",
-				imgName, tagName, altImgName, altImgTag)
+			log.Printf("The image you requested %s is the same as %s\n",
+				formatImageNameAndTag(imgName, tagName), formatImageNameAndTag(altImgName, altImgTag))
+			storeImageMetadata(imgName, tagName, imageShaHex)
+			recordImageDetails(imageShaHex, ref, img)
+			recordImageSignature(imageShaHex, signedBy)
+			return imageShaHex
+		} else if imageStoredByHash(imageShaHex) {
+			log.Printf("The image you requested %s is the untagged image %s\n",
+				formatImageNameAndTag(imgName, tagName), imageShaHex)
 			storeImageMetadata(imgName, tagName, imageShaHex)
+			recordImageDetails(imageShaHex, ref, img)
+			recordImageSignature(imageShaHex, signedBy)
 			return imageShaHex
 		} else {
 			log.Println("Image doesn't exist. Downloading...")
-			downloadImage(img, imageShaHex, src)
-			untarFile(imageShaHex)
-			processLayerTarballs(imageShaHex, manifest.Config.Digest.Hex)
+			storedLayers := downloadImage(img, imageShaHex, srcRef)
+			processLayerTarballs(imageShaHex, manifest.Config.Digest.Hex, storedLayers)
 			storeImageMetadata(imgName, tagName, imageShaHex)
+			recordImageDetails(imageShaHex, ref, img)
+			recordImageSignature(imageShaHex, signedBy)
 			deleteTempImageFiles(imageShaHex)
 			return imageShaHex
 		}
@@ -313,3 +765,28 @@ func downloadImageIfRequired(src string) string {
 	}
 }
 
+/*
+	Called for "gocker pull". With allTags, src names a repository and
+	we pull every tag the registry lists for it.
+*/
+
+func pullImage(src string, allTags bool, platform string) {
+	if !allTags {
+		downloadImageIfRequired(src, platform)
+		return
+	}
+	repo, err := name.NewRepository(src)
+	if err == nil && isInsecureRegistry(repo.RegistryStr()) {
+		repo, err = name.NewRepository(src, name.Insecure)
+	}
+	if err != nil {
+		log.Fatalf("With --all-tags, please pass a repository without a tag or digest: %v\n", err)
+	}
+	tags, err := remote.List(repo, getRemoteOptions(repo.Registry)...)
+	if err != nil {
+		log.Fatalf("Unable to list tags for %s: %v\n", repo.Name(), err)
+	}
+	for _, tag := range tags {
+		downloadImageIfRequired(repo.Tag(tag).Name(), platform)
+	}
+}
@@ -12,15 +12,42 @@ import (
 func usage() {
 	fmt.Println("Welcome to Gocker!")
 	fmt.Println("Supported commands:")
-	fmt.Println("gocker run [--mem] [--swap] [--pids] [--cpus] <image> <command>")
+	fmt.Println("gocker run [--mem] [--swap] [--pids] [--cpus] [--platform] [-v src:dst[:ro]]... [--mount type=,src=,dst=]... <image> <command>")
 	fmt.Println("gocker exec <container-id> <command>")
+	fmt.Println("gocker mount <container-id>")
+	fmt.Println("gocker umount [--force] <container-id>")
+	fmt.Println("gocker diff [--format text|json] <container-id>")
+	fmt.Println("gocker cp [-L] <container-id:path|path|-> <container-id:path|path|->")
+	fmt.Println("gocker pull [--all-tags] [--platform] <image>")
+	fmt.Println("gocker push <image>")
+	fmt.Println("gocker registry serve [--addr :5000]")
+	fmt.Println("gocker registry proxy [--addr :5000] [--upstream docker.io] [--ttl 1h]")
+	fmt.Println("gocker save -o <file> [--format docker-archive|oci] <image>...")
+	fmt.Println("gocker load -i <file>")
+	fmt.Println("gocker export [-o file] <container-id>")
+	fmt.Println("gocker import [--change instruction]... <file> [image]")
+	fmt.Println("gocker commit <container-id> [image]")
+	fmt.Println("gocker build [-t image] [-f Dockerfile] [--build-arg KEY=VALUE]... [--no-cache] <context>")
+	fmt.Println("gocker builder prune")
+	fmt.Println("gocker login [-u user] [-p password | --password-stdin] [registry]")
+	fmt.Println("gocker logout [registry]")
 	fmt.Println("gocker images")
-	fmt.Println("gocker rmi <image-id>")
+	fmt.Println("gocker history <image-id|image>")
+	fmt.Println("gocker sbom [--format table|spdx-json|cyclonedx-json] [-o file] <image|container-id>")
+	fmt.Println("gocker scan [--db path]... [--fail-on low|medium|high|critical] <image|container-id>")
+	fmt.Println("gocker image prune [--all] [--filter until=<time>]")
+	fmt.Println("gocker image verify [--quarantine|--repull] [image]")
+	fmt.Println("gocker image squash [--from N] [-t image] <image>")
+	fmt.Println("gocker image mount <image>")
+	fmt.Println("gocker image umount [--force] <image>")
+	fmt.Println("gocker system df")
+	fmt.Println("gocker rmi [--force] <image-id|image>")
+	fmt.Println("gocker tag <image-id|image> <image>")
 	fmt.Println("gocker ps")
 }
 
 func main() {
-	options := []string{"run", "child-mode", "setup-netns", "setup-veth", "ps", "exec", "images", "rmi"}
+	options := []string{"run", "child-mode", "setup-netns", "setup-veth", "ps", "exec", "images", "rmi", "pull", "login", "logout", "push", "tag", "save", "load", "export", "import", "commit", "build", "builder", "history", "image", "system", "registry", "sbom", "scan", "mount", "umount", "diff", "cp", "cp-helper"}
 
 	if len(os.Args) < 2 || !stringInSlice(os.Args[1], options) {
 		usage()
@@ -49,12 +76,30 @@ func main() {
 		swap := fs.Int("swap", -1, "Max swap to allow in MB")
 		pids := fs.Int("pids", -1, "Number of max processes to allow")
 		cpus := fs.Float64("cpus", -1, "Number of CPU cores to restrict to")
+		platform := fs.String("platform", "", "Platform of the image to pull, as os/arch[/variant]")
+		volumes := fs.StringArrayP("volume", "v", nil, "Volume to mount, as [host-path|name:]path[:ro]")
+		mountSpecs := fs.StringArray("mount", nil, "Mount, as type=bind|volume|tmpfs,src=,dst=[,readonly]")
 		if err := fs.Parse(os.Args[2:]); err != nil {
 			fmt.Println("Error parsing: ", err)
 		}
 		if len(fs.Args()) < 2 {
 			log.Fatalf("Please pass image name and command to run")
 		}
+		var mounts []containerMount
+		for _, volume := range *volumes {
+			mount, err := parseVolumeFlag(volume)
+			if err != nil {
+				log.Fatalf("Invalid volume: %v\n", err)
+			}
+			mounts = append(mounts, mount)
+		}
+		for _, spec := range *mountSpecs {
+			mount, err := parseMountFlag(spec)
+			if err != nil {
+				log.Fatalf("Invalid mount: %v\n", err)
+			}
+			mounts = append(mounts, mount)
+		}
 		/* Create and setup the gocker0 network bridge we need */
 		if isUp, _ := isGockerBridgeUp(); !isUp {
 			log.Println("Bringing up the gocker0 bridge...")
@@ -62,7 +107,7 @@ func main() {
 				log.Fatalf("Unable to create gocker0 bridge: %v", err)
 			}
 		}
-		initContainer(*mem, *swap, *pids, *cpus, fs.Args()[0], fs.Args()[1:])
+		initContainer(*mem, *swap, *pids, *cpus, *platform, mounts, fs.Args()[0], fs.Args()[1:])
 	case "child-mode":
 		fs := flag.FlagSet{}
 		fs.ParseErrorsWhitelist.UnknownFlags = true
@@ -72,13 +117,17 @@ func main() {
 		pids := fs.Int("pids", -1, "Number of max processes to allow")
 		cpus := fs.Float64("cpus", -1, "Number of CPU cores to restrict to")
 		image := fs.String("img", "", "Container image")
+		env := fs.StringArray("env", nil, "Environment variable to set, as KEY=VALUE")
+		workdir := fs.String("workdir", "", "Working directory of the command")
+		user := fs.String("user", "", "User to run the command as")
 		if err := fs.Parse(os.Args[2:]); err != nil {
 			fmt.Println("Error parsing: ", err)
 		}
 		if len(fs.Args()) < 2 {
 			log.Fatalf("Please pass image name and command to run")
 		}
-		execContainerCommand(*mem, *swap, *pids, *cpus, fs.Args()[0], *image, fs.Args()[1:])
+		execContainerCommand(*mem, *swap, *pids, *cpus, fs.Args()[0], *image,
+			*env, *workdir, *user, fs.Args()[1:])
 	case "setup-netns":
 		setupNewNetworkNamespace(os.Args[2])
 	case "setup-veth":
@@ -88,14 +137,325 @@ func main() {
 		printRunningContainers()
 	case "exec":
 		execInContainer(os.Args[2])
+	case "pull":
+		fs := flag.FlagSet{}
+		fs.ParseErrorsWhitelist.UnknownFlags = true
+
+		allTags := fs.BoolP("all-tags", "a", false, "Download all tagged images in the repository")
+		platform := fs.String("platform", "", "Platform of the image to pull, as os/arch[/variant]")
+		if err := fs.Parse(os.Args[2:]); err != nil {
+			fmt.Println("Error parsing: ", err)
+		}
+		if len(fs.Args()) < 1 {
+			log.Fatalf("Please pass the image to pull")
+		}
+		pullImage(fs.Args()[0], *allTags, *platform)
+	case "push":
+		if len(os.Args) < 3 {
+			usage()
+			os.Exit(1)
+		}
+		pushImage(os.Args[2])
+	case "save":
+		fs := flag.FlagSet{}
+		fs.ParseErrorsWhitelist.UnknownFlags = true
+
+		output := fs.StringP("output", "o", "", "Tarball to write the images to")
+		format := fs.String("format", "docker-archive", "Format to save in: docker-archive or oci")
+		if err := fs.Parse(os.Args[2:]); err != nil {
+			fmt.Println("Error parsing: ", err)
+		}
+		if len(*output) == 0 || len(fs.Args()) < 1 {
+			log.Fatalf("Please pass an output file and the images to save")
+		}
+		saveImages(*output, *format, fs.Args())
+	case "load":
+		fs := flag.FlagSet{}
+		fs.ParseErrorsWhitelist.UnknownFlags = true
+
+		input := fs.StringP("input", "i", "", "Tarball to load images from")
+		if err := fs.Parse(os.Args[2:]); err != nil {
+			fmt.Println("Error parsing: ", err)
+		}
+		if len(*input) == 0 {
+			log.Fatalf("Please pass the file to load images from")
+		}
+		loadImages(*input)
+	case "export":
+		fs := flag.FlagSet{}
+		fs.ParseErrorsWhitelist.UnknownFlags = true
+
+		output := fs.StringP("output", "o", "", "File to write the tarball to instead of stdout")
+		if err := fs.Parse(os.Args[2:]); err != nil {
+			fmt.Println("Error parsing: ", err)
+		}
+		if len(fs.Args()) < 1 {
+			usage()
+			os.Exit(1)
+		}
+		exportContainer(fs.Args()[0], *output)
+	case "import":
+		fs := flag.FlagSet{}
+		fs.ParseErrorsWhitelist.UnknownFlags = true
+
+		changes := fs.StringArrayP("change", "c", nil, "Dockerfile instruction to apply to the image config")
+		if err := fs.Parse(os.Args[2:]); err != nil {
+			fmt.Println("Error parsing: ", err)
+		}
+		if len(fs.Args()) < 1 {
+			usage()
+			os.Exit(1)
+		}
+		importImage(fs.Arg(0), fs.Arg(1), *changes)
+	case "commit":
+		if len(os.Args) < 3 {
+			usage()
+			os.Exit(1)
+		}
+		image := ""
+		if len(os.Args) > 3 {
+			image = os.Args[3]
+		}
+		commitContainer(os.Args[2], image)
+	case "build":
+		fs := flag.FlagSet{}
+		fs.ParseErrorsWhitelist.UnknownFlags = true
+
+		tag := fs.StringP("tag", "t", "", "Name and tag of the image to build")
+		dockerfile := fs.StringP("file", "f", "", "Path of the Dockerfile, <context>/Dockerfile by default")
+		buildArgs := fs.StringArray("build-arg", nil, "Value of an ARG, as KEY=VALUE")
+		noCache := fs.Bool("no-cache", false, "Run every step instead of using the build cache")
+		if err := fs.Parse(os.Args[2:]); err != nil {
+			fmt.Println("Error parsing: ", err)
+		}
+		if len(fs.Args()) < 1 {
+			usage()
+			os.Exit(1)
+		}
+		/* RUN instructions run in containers, which need the gocker0 bridge */
+		if isUp, _ := isGockerBridgeUp(); !isUp {
+			log.Println("Bringing up the gocker0 bridge...")
+			if err := setupGockerBridge(); err != nil {
+				log.Fatalf("Unable to create gocker0 bridge: %v", err)
+			}
+		}
+		buildImage(fs.Args()[0], *dockerfile, *tag, *buildArgs, *noCache)
+	case "builder":
+		if len(os.Args) < 3 || os.Args[2] != "prune" {
+			usage()
+			os.Exit(1)
+		}
+		pruneBuildCache()
+	case "login":
+		fs := flag.FlagSet{}
+		fs.ParseErrorsWhitelist.UnknownFlags = true
+
+		username := fs.StringP("username", "u", "", "Username")
+		password := fs.StringP("password", "p", "", "Password")
+		passwordStdin := fs.Bool("password-stdin", false, "Take the password from stdin")
+		if err := fs.Parse(os.Args[2:]); err != nil {
+			fmt.Println("Error parsing: ", err)
+		}
+		registryLogin(fs.Arg(0), *username, *password, *passwordStdin)
+	case "logout":
+		server := ""
+		if len(os.Args) > 2 {
+			server = os.Args[2]
+		}
+		registryLogout(server)
 	case "images":
 		printAvailableImages()
-	case "rmi":
+	case "image":
 		if len(os.Args) < 3 {
 			usage()
 			os.Exit(1)
 		}
-		deleteImageByHash(os.Args[2])
+		fs := flag.FlagSet{}
+		fs.ParseErrorsWhitelist.UnknownFlags = true
+
+		switch os.Args[2] {
+		case "prune":
+			all := fs.BoolP("all", "a", false, "Remove all images no container uses, not just dangling ones")
+			filters := fs.StringArray("filter", nil, "Only remove images matching the filter, like until=24h")
+			if err := fs.Parse(os.Args[3:]); err != nil {
+				fmt.Println("Error parsing: ", err)
+			}
+			pruneImages(*all, *filters)
+		case "verify":
+			quarantine := fs.Bool("quarantine", false, "Move images that fail verification to the quarantine directory")
+			repull := fs.Bool("repull", false, "Pull images that fail verification again")
+			if err := fs.Parse(os.Args[3:]); err != nil {
+				fmt.Println("Error parsing: ", err)
+			}
+			if !verifyImages(fs.Arg(0), *quarantine, *repull) {
+				os.Exit(1)
+			}
+		case "squash":
+			from := fs.Int("from", 0, "First layer to squash, counting from 0 at the bottom")
+			tag := fs.StringP("tag", "t", "", "Name and tag for the squashed image")
+			if err := fs.Parse(os.Args[3:]); err != nil {
+				fmt.Println("Error parsing: ", err)
+			}
+			if len(fs.Args()) < 1 {
+				log.Fatalf("Please pass an image to squash\n")
+			}
+			squashImage(fs.Arg(0), *from, *tag)
+		case "mount":
+			if err := fs.Parse(os.Args[3:]); err != nil {
+				fmt.Println("Error parsing: ", err)
+			}
+			if len(fs.Args()) < 1 {
+				log.Fatalf("Please pass an image to mount\n")
+			}
+			mountImage(fs.Arg(0))
+		case "umount":
+			force := fs.BoolP("force", "f", false, "Unmount even if mounted more than once")
+			if err := fs.Parse(os.Args[3:]); err != nil {
+				fmt.Println("Error parsing: ", err)
+			}
+			if len(fs.Args()) < 1 {
+				log.Fatalf("Please pass an image to unmount\n")
+			}
+			unmountImage(fs.Arg(0), *force)
+		default:
+			usage()
+			os.Exit(1)
+		}
+	case "registry":
+		if len(os.Args) < 3 {
+			usage()
+			os.Exit(1)
+		}
+		fs := flag.FlagSet{}
+		fs.ParseErrorsWhitelist.UnknownFlags = true
+
+		addr := fs.String("addr", ":5000", "Address to serve the registry on")
+		switch os.Args[2] {
+		case "serve":
+			if err := fs.Parse(os.Args[3:]); err != nil {
+				fmt.Println("Error parsing: ", err)
+			}
+			serveRegistry(*addr)
+		case "proxy":
+			upstream := fs.String("upstream", "docker.io", "Registry to cache images from")
+			ttl := fs.Duration("ttl", time.Hour, "How long to serve a tag before checking it with upstream again")
+			if err := fs.Parse(os.Args[3:]); err != nil {
+				fmt.Println("Error parsing: ", err)
+			}
+			serveRegistryProxy(*addr, *upstream, *ttl)
+		default:
+			usage()
+			os.Exit(1)
+		}
+	case "system":
+		if len(os.Args) < 3 || os.Args[2] != "df" {
+			usage()
+			os.Exit(1)
+		}
+		printDiskUsage()
+	case "sbom":
+		fs := flag.FlagSet{}
+		fs.ParseErrorsWhitelist.UnknownFlags = true
+
+		format := fs.String("format", "table", "Output format: table, spdx-json or cyclonedx-json")
+		output := fs.StringP("output", "o", "", "Write to a file instead of STDOUT")
+		if err := fs.Parse(os.Args[2:]); err != nil {
+			fmt.Println("Error parsing: ", err)
+		}
+		if len(fs.Args()) < 1 {
+			log.Fatalf("Please pass an image or container ID\n")
+		}
+		printSBOM(fs.Args()[0], *format, *output)
+	case "scan":
+		fs := flag.FlagSet{}
+		fs.ParseErrorsWhitelist.UnknownFlags = true
+
+		dbPaths := fs.StringArray("db", nil, "Advisory database file or directory, may be repeated")
+		failOn := fs.String("fail-on", "", "Exit with status 1 if anything this severe or worse is found")
+		if err := fs.Parse(os.Args[2:]); err != nil {
+			fmt.Println("Error parsing: ", err)
+		}
+		if len(fs.Args()) < 1 {
+			log.Fatalf("Please pass an image or container ID\n")
+		}
+		if !scanImage(fs.Args()[0], *dbPaths, *failOn) {
+			os.Exit(1)
+		}
+	case "mount":
+		if len(os.Args) < 3 {
+			usage()
+			os.Exit(1)
+		}
+		mountContainer(os.Args[2])
+	case "umount":
+		fs := flag.FlagSet{}
+		fs.ParseErrorsWhitelist.UnknownFlags = true
+
+		force := fs.BoolP("force", "f", false, "Unmount even if mounted more than once")
+		if err := fs.Parse(os.Args[2:]); err != nil {
+			fmt.Println("Error parsing: ", err)
+		}
+		if len(fs.Args()) < 1 {
+			usage()
+			os.Exit(1)
+		}
+		unmountContainer(fs.Arg(0), *force)
+	case "diff":
+		fs := flag.FlagSet{}
+		fs.ParseErrorsWhitelist.UnknownFlags = true
+
+		format := fs.String("format", "text", "Output format: text or json")
+		if err := fs.Parse(os.Args[2:]); err != nil {
+			fmt.Println("Error parsing: ", err)
+		}
+		if len(fs.Args()) < 1 {
+			usage()
+			os.Exit(1)
+		}
+		printContainerDiff(fs.Arg(0), *format)
+	case "cp":
+		fs := flag.FlagSet{}
+		fs.ParseErrorsWhitelist.UnknownFlags = true
+
+		followLink := fs.BoolP("follow-link", "L", false, "Follow the symlink the source is")
+		if err := fs.Parse(os.Args[2:]); err != nil {
+			fmt.Println("Error parsing: ", err)
+		}
+		if len(fs.Args()) < 2 {
+			usage()
+			os.Exit(1)
+		}
+		copyFiles(fs.Arg(0), fs.Arg(1), *followLink)
+	case "cp-helper":
+		if len(os.Args) < 4 {
+			os.Exit(1)
+		}
+		cpInChroot(os.Args[2], os.Args[3], os.Args[4:])
+	case "history":
+		if len(os.Args) < 3 {
+			usage()
+			os.Exit(1)
+		}
+		printImageHistory(os.Args[2])
+	case "rmi":
+		fs := flag.FlagSet{}
+		fs.ParseErrorsWhitelist.UnknownFlags = true
+
+		force := fs.BoolP("force", "f", false, "Remove the image even if it has other tags")
+		if err := fs.Parse(os.Args[2:]); err != nil {
+			fmt.Println("Error parsing: ", err)
+		}
+		if len(fs.Args()) < 1 {
+			usage()
+			os.Exit(1)
+		}
+		removeImage(fs.Args()[0], *force)
+	case "tag":
+		if len(os.Args) < 4 {
+			usage()
+			os.Exit(1)
+		}
+		tagImage(os.Args[2], os.Args[3])
 	default:
 		usage()
 	}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+	"gocker image mount" and "gocker mount" make the files of an image,
+	or those a running container sees, available on the host, so that
+	tools can be run against them:
+
+	/var/run/gocker/mounts/images/<image-id>/mnt    read-only overlay of the image's layers
+	/var/run/gocker/mounts/containers/<id>/mnt      bind mount of the container's root fs
+
+	A mount counts how many times it was asked for in "refs" next to it,
+	and only goes once it was unmounted as many times. Until then, the
+	image it is of can't be removed, and a container that exits keeps
+	its directory, whose upper directory the mount still uses.
+
+	Any number of gocker processes may mount and unmount at once, so
+	whatever reads and then changes refs holds a lock on the mounts
+	directory while it does.
+*/
+
+var containerIDRegexp = regexp.MustCompile(`^[0-9a-f]{12}$`)
+
+/*
+	Container IDs end up in paths we remove, so only those that
+	createContainerID() could have made are taken.
+*/
+
+func checkContainerID(containerID string) {
+	if !containerIDRegexp.MatchString(containerID) {
+		log.Fatalf("Invalid container ID: %s\n", containerID)
+	}
+}
+
+/*
+	Takes the lock on the mounts directory, which is released by calling
+	the returned function, or when we exit.
+*/
+
+func lockMounts() func() {
+	doOrDieWithMsg(os.MkdirAll(getGockerMountsPath(), 0755), "Unable to create mounts directory")
+	dir, err := os.Open(getGockerMountsPath())
+	doOrDieWithMsg(err, "Unable to open mounts directory")
+	if err := unix.Flock(int(dir.Fd()), unix.LOCK_EX); err != nil {
+		log.Fatalf("Unable to lock mounts directory: %v\n", err)
+	}
+	return func() {
+		dir.Close()
+	}
+}
+
+func getImageMountPath(imageShaHex string) string {
+	return getGockerMountsPath() + "/images/" + imageShaHex
+}
+
+func getContainerMountPath(containerID string) string {
+	return getGockerMountsPath() + "/containers/" + containerID
+}
+
+func getMountRefs(mountDir string) int {
+	data, err := ioutil.ReadFile(mountDir + "/refs")
+	if err != nil {
+		return 0
+	}
+	refs, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return refs
+}
+
+func setMountRefs(mountDir string, refs int) error {
+	return ioutil.WriteFile(mountDir+"/refs", []byte(strconv.Itoa(refs)), 0644)
+}
+
+/*
+	Maps the images that are mounted, on their own or under a container
+	that is, to where.
+*/
+
+func getImageMounts() map[string][]string {
+	mounts := make(map[string][]string)
+	images, _ := ioutil.ReadDir(getGockerMountsPath() + "/images")
+	for _, entry := range images {
+		if mountDir := getImageMountPath(entry.Name()); getMountRefs(mountDir) > 0 {
+			mounts[entry.Name()] = append(mounts[entry.Name()], mountDir+"/mnt")
+		}
+	}
+	containers, _ := ioutil.ReadDir(getGockerMountsPath() + "/containers")
+	for _, entry := range containers {
+		mountDir := getContainerMountPath(entry.Name())
+		data, err := ioutil.ReadFile(mountDir + "/image")
+		if err != nil || getMountRefs(mountDir) == 0 {
+			continue
+		}
+		imageShaHex := strings.TrimSpace(string(data))
+		mounts[imageShaHex] = append(mounts[imageShaHex], mountDir+"/mnt")
+	}
+	return mounts
+}
+
+/*
+	Once unmounted, the mount point is an empty directory again. We
+	remove what we know is in mountDir one by one rather than all of it,
+	so that nothing that is still mounted is ever removed.
+*/
+
+func removeMountDir(mountDir string) error {
+	for _, name := range []string{"mnt", "empty", "image", "refs"} {
+		if err := os.Remove(mountDir + "/" + name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Remove(mountDir)
+}
+
+/*
+	Drops a reference to the mount in mountDir, unmounting it if that
+	was the last one or if forced. Returns whether it was unmounted.
+*/
+
+func releaseMount(mountDir string, force bool) (bool, error) {
+	refs := getMountRefs(mountDir)
+	if refs == 0 {
+		return false, fmt.Errorf("not mounted")
+	}
+	if refs > 1 && !force {
+		return false, setMountRefs(mountDir, refs-1)
+	}
+	if err := unix.Unmount(mountDir+"/mnt", 0); err != nil && err != unix.EINVAL {
+		return false, err
+	}
+	return true, removeMountDir(mountDir)
+}
+
+/*
+	Called for "gocker image mount". Prints where the image is mounted.
+*/
+
+func mountImage(src string) {
+	imageShaHex, exists := resolveImage(src)
+	if !exists {
+		log.Fatalf("No such image: %s\n", src)
+	}
+	mountDir := getImageMountPath(imageShaHex)
+	unlock := lockMounts()
+	defer unlock()
+	refs := getMountRefs(mountDir)
+	if refs == 0 {
+		doOrDieWithMsg(os.MkdirAll(mountDir, 0755), "Unable to create mount directory")
+		if err := mountImageLayers(imageShaHex, mountDir); err != nil {
+			_ = removeMountDir(mountDir)
+			log.Fatalf("Unable to mount image %s: %v\n", imageShaHex, err)
+		}
+	}
+	doOrDieWithMsg(setMountRefs(mountDir, refs+1), "Unable to record mount")
+	fmt.Println(mountDir + "/mnt")
+}
+
+/*
+	Called for "gocker image umount".
+*/
+
+func unmountImage(src string, force bool) {
+	imageShaHex, exists := resolveImage(src)
+	if !exists {
+		log.Fatalf("No such image: %s\n", src)
+	}
+	unlock := lockMounts()
+	defer unlock()
+	unmounted, err := releaseMount(getImageMountPath(imageShaHex), force)
+	if err != nil {
+		log.Fatalf("Unable to unmount image %s: %v\n", imageShaHex, err)
+	}
+	if unmounted {
+		log.Printf("Unmounted image %s\n", imageShaHex)
+	}
+}
+
+/*
+	Called for "gocker mount". The container's root fs is only mounted
+	while it runs, and we bind mount it so that it stays for as long as
+	we need it. Prints where it is mounted.
+*/
+
+func mountContainer(containerID string) {
+	checkContainerID(containerID)
+	mountDir := getContainerMountPath(containerID)
+	unlock := lockMounts()
+	defer unlock()
+	refs := getMountRefs(mountDir)
+	if refs == 0 {
+		if !isContainerFSMounted(containerID) {
+			log.Fatalf("No such running container: %s\n", containerID)
+		}
+		_, imageShaHex, err := getDistribution(containerID)
+		if err != nil {
+			log.Fatalf("Unable to find the image of container %s: %v\n", containerID, err)
+		}
+		doOrDieWithMsg(os.MkdirAll(mountDir+"/mnt", 0755), "Unable to create mount directory")
+		/* Containers of "gocker build" run no image */
+		if len(imageShaHex) > 0 {
+			doOrDieWithMsg(ioutil.WriteFile(mountDir+"/image", []byte(imageShaHex), 0644),
+				"Unable to record the container's image")
+		}
+		if err := unix.Mount(getContainerFSHome(containerID)+"/mnt", mountDir+"/mnt", "", unix.MS_BIND, ""); err != nil {
+			_ = removeMountDir(mountDir)
+			log.Fatalf("Unable to mount container %s: %v\n", containerID, err)
+		}
+	}
+	doOrDieWithMsg(setMountRefs(mountDir, refs+1), "Unable to record mount")
+	fmt.Println(mountDir + "/mnt")
+}
+
+/*
+	Called for "gocker umount". A container that exited while mounted
+	left its directory for us to remove.
+*/
+
+func unmountContainer(containerID string, force bool) {
+	checkContainerID(containerID)
+	unlock := lockMounts()
+	defer unlock()
+	unmounted, err := releaseMount(getContainerMountPath(containerID), force)
+	if err != nil {
+		log.Fatalf("Unable to unmount container %s: %v\n", containerID, err)
+	}
+	if !unmounted {
+		return
+	}
+	if !isContainerFSMounted(containerID) {
+		removeAnonymousVolumes(containerID)
+		os.RemoveAll(getGockerContainersPath() + "/" + containerID)
+	}
+	log.Printf("Unmounted container %s\n", containerID)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"io/ioutil"
+	"log"
+	"runtime"
+	"strings"
+)
+
+/*
+	Registries serve multi-architecture images as a manifest list with
+	one image per platform. Unless told otherwise with --platform, we
+	pick the image built for the host we're running on.
+*/
+
+func getHostPlatform() v1.Platform {
+	return v1.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH, Variant: getHostVariant()}
+}
+
+/*
+	Only 32-bit ARM images come in variants a host may not run, v6 and
+	v7. The kernel tells us which the CPU is in /proc/cpuinfo.
+*/
+
+func getHostVariant() string {
+	if runtime.GOARCH != "arm" {
+		return ""
+	}
+	data, err := ioutil.ReadFile("/proc/cpuinfo")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) == 2 && strings.TrimSpace(fields[0]) == "CPU architecture" {
+			if version := strings.TrimSpace(fields[1]); version == "6" || version == "7" {
+				return "v" + version
+			}
+		}
+	}
+	return ""
+}
+
+func parsePlatform(platform string) (v1.Platform, error) {
+	if len(platform) == 0 {
+		return getHostPlatform(), nil
+	}
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return v1.Platform{}, fmt.Errorf("platform must be of the form os/arch[/variant]: %s", platform)
+	}
+	p := v1.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+func formatPlatform(p v1.Platform) string {
+	if len(p.OS) == 0 && len(p.Architecture) == 0 {
+		return ""
+	}
+	platform := p.OS + "/" + p.Architecture
+	if len(p.Variant) > 0 {
+		platform += "/" + p.Variant
+	}
+	return platform
+}
+
+/*
+	Images pulled before we recorded platforms in the image details
+	still have the information in their config.
+*/
+
+func getPlatformForImage(imageShaHex string) string {
+	details := parseImageDetails(imageShaHex)
+	if len(details.Platform) > 0 {
+		return details.Platform
+	}
+	imgConfig := parseContainerConfig(imageShaHex)
+	return formatPlatform(v1.Platform{OS: imgConfig.OS,
+		Architecture: imgConfig.Architecture, Variant: imgConfig.Variant})
+}
+
+/*
+	Variants are only compared when both platforms have one, as images
+	often leave theirs out.
+*/
+
+func platformsMatch(a v1.Platform, b v1.Platform) bool {
+	if a.OS != b.OS || a.Architecture != b.Architecture {
+		return false
+	}
+	return len(a.Variant) == 0 || len(b.Variant) == 0 || a.Variant == b.Variant
+}
+
+func platformMatches(imageShaHex string, p v1.Platform) bool {
+	imgPlatform, err := parsePlatform(getPlatformForImage(imageShaHex))
+	if err != nil {
+		return false
+	}
+	return platformsMatch(imgPlatform, p)
+}
+
+func ensureImageRunsOnHost(imageShaHex string) {
+	imgConfig := parseContainerConfig(imageShaHex)
+	host := getHostPlatform()
+	if len(imgConfig.Architecture) == 0 {
+		return
+	}
+	if imgConfig.Architecture != host.Architecture ||
+		len(imgConfig.Variant) > 0 && len(host.Variant) > 0 && imgConfig.Variant != host.Variant {
+		log.Fatalf("Image %s is built for %s, but this host is %s. Refusing to run it.\n",
+			imageShaHex, getPlatformForImage(imageShaHex), formatPlatform(host))
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPlatformsMatch(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		match bool
+	}{
+		{"linux/amd64", "linux/amd64", true},
+		{"linux/amd64", "linux/arm64", false},
+		{"linux/arm/v7", "linux/arm/v7", true},
+		{"linux/arm/v6", "linux/arm/v7", false},
+		{"linux/arm", "linux/arm/v7", true},
+		{"linux/arm/v6", "linux/arm", true},
+		{"windows/amd64", "linux/amd64", false},
+	}
+	for _, test := range tests {
+		a, err := parsePlatform(test.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := parsePlatform(test.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if platformsMatch(a, b) != test.match || platformsMatch(b, a) != test.match {
+			t.Errorf("%s and %s: expected match to be %v", test.a, test.b, test.match)
+		}
+	}
+}
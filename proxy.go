@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+	"gocker registry proxy" is a pull-through cache for an upstream
+	registry. What it fetches from upstream is kept on disk under
+	/var/lib/gocker/proxy-cache/<upstream>/:
+
+	blobs/<repo>/<hex>               blobs and manifests, by digest
+	manifests/<repo>/<reference>     what a tag or digest points to
+
+	Blobs are kept apart for each repository, even when they are the
+	same, as what upstream lets us fetch from one repository, a private
+	one say, mustn't be served to whoever asks for another.
+
+	Blobs and manifests asked for by digest never change, so once cached,
+	they are served without asking upstream again. What a tag points to
+	does change, so those are checked with upstream again once older than
+	the TTL. If upstream can't be reached, what we have is served anyway.
+
+	To have pulls go through the proxy, add it to "registry-proxies" in
+	/etc/gocker/daemon.json, under the registry it is a proxy for.
+*/
+
+type proxyManifestRecord struct {
+	Digest    v1.Hash
+	MediaType types.MediaType
+	Fetched   time.Time
+}
+
+type registryProxy struct {
+	upstream name.Registry
+	cacheDir string
+	ttl      time.Duration
+}
+
+func (p *registryProxy) getRepository(imgName string) (name.Repository, error) {
+	for _, part := range strings.Split(imgName, "/") {
+		if part == "." || part == ".." {
+			return name.Repository{}, fmt.Errorf("invalid repository name %s", imgName)
+		}
+	}
+	return name.NewRepository(p.upstream.RegistryStr()+"/"+imgName, getNameOptions(p.upstream.RegistryStr())...)
+}
+
+func (p *registryProxy) getBlobPath(repo name.Repository, digest v1.Hash) string {
+	return p.cacheDir + "/blobs/" + repo.RepositoryStr() + "/" + digest.Hex
+}
+
+func (p *registryProxy) getManifestRecordPath(repo name.Repository, reference string) string {
+	return p.cacheDir + "/manifests/" + repo.RepositoryStr() + "/" + reference
+}
+
+/*
+	Files are written under a temporary name and renamed into place, so
+	that a pull never sees half of one.
+*/
+
+func writeFileAtomically(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(data)
+	tmpFile.Close()
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+	}
+	return err
+}
+
+func isUpstreamNotFound(err error) bool {
+	terr, ok := err.(*transport.Error)
+	return ok && terr.StatusCode == http.StatusNotFound
+}
+
+func writeUpstreamError(w http.ResponseWriter, err error, code string) {
+	if isUpstreamNotFound(err) {
+		writeRegistryError(w, http.StatusNotFound, code, err.Error())
+	} else {
+		writeRegistryError(w, http.StatusBadGateway, "UNKNOWN", err.Error())
+	}
+}
+
+func (p *registryProxy) fetchManifest(repo name.Repository, reference string) (proxyManifestRecord, error) {
+	var ref name.Reference = repo.Tag(reference)
+	if strings.HasPrefix(reference, "sha256:") {
+		ref = repo.Digest(reference)
+	}
+	desc, err := remote.Get(ref, getRemoteOptions(p.upstream)...)
+	if err != nil {
+		return proxyManifestRecord{}, err
+	}
+	if err := writeFileAtomically(p.getBlobPath(repo, desc.Digest), desc.Manifest); err != nil {
+		return proxyManifestRecord{}, err
+	}
+	record := proxyManifestRecord{Digest: desc.Digest, MediaType: desc.MediaType, Fetched: time.Now()}
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return proxyManifestRecord{}, err
+	}
+	return record, writeFileAtomically(p.getManifestRecordPath(repo, reference), recordBytes)
+}
+
+func (p *registryProxy) getManifest(repo name.Repository, reference string) (proxyManifestRecord, error) {
+	record := proxyManifestRecord{}
+	data, err := ioutil.ReadFile(p.getManifestRecordPath(repo, reference))
+	cached := err == nil && json.Unmarshal(data, &record) == nil
+	if cached {
+		_, err = os.Stat(p.getBlobPath(repo, record.Digest))
+		cached = err == nil
+	}
+	if cached && (strings.HasPrefix(reference, "sha256:") || time.Since(record.Fetched) < p.ttl) {
+		return record, nil
+	}
+	fetched, err := p.fetchManifest(repo, reference)
+	if err != nil && cached && !isUpstreamNotFound(err) {
+		log.Printf("Unable to revalidate %s:%s, serving the cached manifest: %v\n", repo.Name(), reference, err)
+		return record, nil
+	}
+	if err == nil && cached && fetched.Digest != record.Digest {
+		log.Printf("%s:%s changed upstream to %s\n", repo.Name(), reference, fetched.Digest)
+	}
+	return fetched, err
+}
+
+func (p *registryProxy) serveCatalog(w http.ResponseWriter) {
+	repositories := []string{}
+	manifestsDir := p.cacheDir + "/manifests"
+	_ = filepath.Walk(manifestsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".tmp-") {
+			return nil
+		}
+		repo, _ := filepath.Rel(manifestsDir, filepath.Dir(path))
+		if !stringInSlice(repo, repositories) {
+			repositories = append(repositories, repo)
+		}
+		return nil
+	})
+	sort.Strings(repositories)
+	writeRegistryJSON(w, map[string][]string{"repositories": repositories})
+}
+
+func (p *registryProxy) serveTags(w http.ResponseWriter, imgName string) {
+	repo, err := p.getRepository(imgName)
+	if err != nil {
+		writeRegistryError(w, http.StatusBadRequest, "NAME_INVALID", err.Error())
+		return
+	}
+	tags, err := remote.List(repo, getRemoteOptions(p.upstream)...)
+	if err != nil {
+		writeUpstreamError(w, err, "NAME_UNKNOWN")
+		return
+	}
+	writeRegistryJSON(w, map[string]interface{}{"name": imgName, "tags": tags})
+}
+
+func (p *registryProxy) serveManifest(w http.ResponseWriter, r *http.Request, imgName string, reference string) {
+	repo, err := p.getRepository(imgName)
+	if err == nil && !strings.HasPrefix(reference, "sha256:") {
+		_, err = name.NewTag(repo.Name()+":"+reference, getNameOptions(p.upstream.RegistryStr())...)
+	} else if err == nil {
+		_, err = v1.NewHash(reference)
+	}
+	if err != nil {
+		writeRegistryError(w, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+		return
+	}
+	record, err := p.getManifest(repo, reference)
+	if err != nil {
+		writeUpstreamError(w, err, "MANIFEST_UNKNOWN")
+		return
+	}
+	manifest, err := ioutil.ReadFile(p.getBlobPath(repo, record.Digest))
+	if err != nil {
+		writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", string(record.MediaType))
+	w.Header().Set("Content-Length", fmt.Sprint(len(manifest)))
+	w.Header().Set("Docker-Content-Digest", record.Digest.String())
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(manifest)
+	}
+}
+
+/*
+	A blob we don't have yet is passed on to the client as it comes in
+	from upstream, and only kept if all of it matched its digest.
+*/
+
+func (p *registryProxy) fetchBlob(w http.ResponseWriter, r *http.Request, repo name.Repository, digest v1.Hash) {
+	layer, err := remote.Layer(repo.Digest(digest.String()), getRemoteOptions(p.upstream)...)
+	if err != nil {
+		writeUpstreamError(w, err, "BLOB_UNKNOWN")
+		return
+	}
+	if r.Method != http.MethodGet {
+		size, err := layer.Size()
+		if err != nil {
+			writeUpstreamError(w, err, "BLOB_UNKNOWN")
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(size))
+		w.Header().Set("Docker-Content-Digest", digest.String())
+		return
+	}
+	rc, err := layer.Compressed()
+	if err != nil {
+		writeUpstreamError(w, err, "BLOB_UNKNOWN")
+		return
+	}
+	defer rc.Close()
+
+	blobPath := p.getBlobPath(repo, digest)
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(blobPath), ".tmp-")
+	if err != nil {
+		writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", digest.String())
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, tmpFile, hasher), rc); err != nil {
+		log.Printf("Unable to fetch blob %s: %v\n", digest, err)
+		return
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != digest.Hex {
+		log.Printf("Blob %s from upstream didn't match its digest, not caching it\n", digest)
+		return
+	}
+	if err := os.Rename(tmpFile.Name(), blobPath); err != nil {
+		log.Printf("Unable to cache blob %s: %v\n", digest, err)
+	}
+}
+
+func (p *registryProxy) serveBlob(w http.ResponseWriter, r *http.Request, imgName string, digestStr string) {
+	repo, err := p.getRepository(imgName)
+	if err != nil {
+		writeRegistryError(w, http.StatusBadRequest, "NAME_INVALID", err.Error())
+		return
+	}
+	digest, err := v1.NewHash(digestStr)
+	if err != nil {
+		writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return
+	}
+	file, err := os.Open(p.getBlobPath(repo, digest))
+	if err != nil {
+		p.fetchBlob(w, r, repo, digest)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", fmt.Sprint(info.Size()))
+	w.Header().Set("Docker-Content-Digest", digest.String())
+	if r.Method == http.MethodGet {
+		_, _ = io.Copy(w, file)
+	}
+}
+
+func (p *registryProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serveRegistryAPI(p, w, r)
+}
+
+/*
+	Called for "gocker registry proxy". Runs until interrupted.
+*/
+
+func serveRegistryProxy(addr string, upstream string, ttl time.Duration) {
+	reg, err := name.NewRegistry(upstream, getNameOptions(upstream)...)
+	if err != nil {
+		log.Fatalf("Invalid upstream registry %s: %v\n", upstream, err)
+	}
+	proxy := &registryProxy{
+		upstream: reg,
+		cacheDir: getGockerProxyCachePath() + "/" + reg.RegistryStr(),
+		ttl:      ttl,
+	}
+	doOrDieWithMsg(os.MkdirAll(proxy.cacheDir, 0755), "Unable to create proxy cache directory")
+	log.Printf("Proxying %s on %s\n", reg.RegistryStr(), addr)
+	log.Fatalf("Unable to serve registry proxy: %v\n", http.ListenAndServe(addr, proxy))
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+	Sits in front of the in-memory registry, which keeps blobs for all
+	repositories together, to refuse blobs to repositories they weren't
+	pushed to, as real registries do, and to corrupt those of the
+	repositories in corrupt.
+*/
+
+type upstreamRegistry struct {
+	handler http.Handler
+	blobs   map[string][]string
+	corrupt map[string]bool
+	down    bool
+}
+
+func (u *upstreamRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if u.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	i := strings.LastIndex(r.URL.Path, "/blobs/")
+	if i < 0 || r.Method == http.MethodPost || r.Method == http.MethodPatch || r.Method == http.MethodPut ||
+		strings.Contains(r.URL.Path, "/blobs/uploads") {
+		u.handler.ServeHTTP(w, r)
+		return
+	}
+	repo, digest := r.URL.Path[len("/v2/"):i], r.URL.Path[i+len("/blobs/"):]
+	if !stringInSlice(digest, u.blobs[repo]) {
+		writeRegistryError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to registry")
+		return
+	}
+	if !u.corrupt[repo] || r.Method != http.MethodGet {
+		u.handler.ServeHTTP(w, r)
+		return
+	}
+	rec := httptest.NewRecorder()
+	u.handler.ServeHTTP(rec, r)
+	body := rec.Body.Bytes()
+	if len(body) > 0 {
+		body[0] ^= 0xff
+	}
+	w.WriteHeader(rec.Code)
+	w.Write(body)
+}
+
+/*
+	Pushes an image to the upstream registry and notes which blobs the
+	repository has.
+*/
+
+func (u *upstreamRegistry) push(t *testing.T, host string, repo string) v1.Image {
+	img := pushTestImage(t, host, repo)
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.blobs[repo] = append(u.blobs[repo], digest.String())
+	}
+	configName, err := img.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.blobs[repo] = append(u.blobs[repo], configName.String())
+	return img
+}
+
+func startTestProxy(t *testing.T) (*upstreamRegistry, string, *registryProxy, string, func()) {
+	upstream := &upstreamRegistry{
+		handler: registry.New(registry.Logger(nullLogger())),
+		blobs:   make(map[string][]string),
+		corrupt: make(map[string]bool),
+	}
+	upstreamServer := httptest.NewServer(upstream)
+	upstreamHost := strings.TrimPrefix(upstreamServer.URL, "http://")
+	reg, err := name.NewRegistry(upstreamHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheDir := createTestDir(t)
+	proxy := &registryProxy{upstream: reg, cacheDir: cacheDir, ttl: time.Hour}
+	proxyServer := httptest.NewServer(proxy)
+	cleanup := func() {
+		proxyServer.Close()
+		upstreamServer.Close()
+		os.RemoveAll(cacheDir)
+	}
+	return upstream, upstreamHost, proxy, strings.TrimPrefix(proxyServer.URL, "http://"), cleanup
+}
+
+func getProxiedDigest(t *testing.T, ref string) (v1.Hash, error) {
+	desc, err := remote.Get(parseTestReference(t, ref))
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	return desc.Digest, nil
+}
+
+func TestProxyRevalidatesTagsAfterTTL(t *testing.T) {
+	upstream, upstreamHost, proxy, proxyHost, cleanup := startTestProxy(t)
+	defer cleanup()
+
+	first := getTestImageDigest(t, upstream.push(t, upstreamHost, "test/ttl"))
+	if digest, err := getProxiedDigest(t, proxyHost+"/test/ttl:latest"); err != nil || digest != first {
+		t.Fatalf("got %v, %v through the proxy, expected %s", digest, err, first)
+	}
+	if _, err := getProxiedDigest(t, proxyHost+"/test/ttl@"+first.String()); err != nil {
+		t.Fatalf("manifest not served by digest: %v", err)
+	}
+
+	second := getTestImageDigest(t, upstream.push(t, upstreamHost, "test/ttl"))
+	if digest, err := getProxiedDigest(t, proxyHost+"/test/ttl:latest"); err != nil || digest != first {
+		t.Errorf("tag revalidated before the TTL: got %v, %v, expected %s", digest, err, first)
+	}
+
+	proxy.ttl = 0
+	if digest, err := getProxiedDigest(t, proxyHost+"/test/ttl:latest"); err != nil || digest != second {
+		t.Errorf("tag not revalidated after the TTL: got %v, %v, expected %s", digest, err, second)
+	}
+
+	/* With upstream gone, what we have is still served */
+	upstream.down = true
+	if digest, err := getProxiedDigest(t, proxyHost+"/test/ttl:latest"); err != nil || digest != second {
+		t.Errorf("cached tag not served with upstream down: got %v, %v, expected %s", digest, err, second)
+	}
+	if _, err := getProxiedDigest(t, proxyHost+"/test/ttl@"+first.String()); err != nil {
+		t.Errorf("cached digest not served with upstream down: %v", err)
+	}
+}
+
+func fetchProxiedBlob(t *testing.T, proxyHost string, repo string, digest v1.Hash) (int, []byte) {
+	resp, err := http.Get("http://" + proxyHost + "/v2/" + repo + "/blobs/" + digest.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, body
+}
+
+func TestProxyDoesNotCacheMismatchedBlobs(t *testing.T) {
+	upstream, upstreamHost, proxy, proxyHost, cleanup := startTestProxy(t)
+	defer cleanup()
+	img := upstream.push(t, upstreamHost, "test/corrupt")
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := layers[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := proxy.getRepository("test/corrupt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream.corrupt["test/corrupt"] = true
+	_, body := fetchProxiedBlob(t, proxyHost, "test/corrupt", digest)
+	if sum := sha256.Sum256(body); hex.EncodeToString(sum[:]) == digest.Hex {
+		t.Fatal("corrupted blob came through intact")
+	}
+	if _, err := os.Stat(proxy.getBlobPath(repo, digest)); !os.IsNotExist(err) {
+		t.Fatal("blob that didn't match its digest was cached")
+	}
+
+	upstream.corrupt["test/corrupt"] = false
+	status, body := fetchProxiedBlob(t, proxyHost, "test/corrupt", digest)
+	if sum := sha256.Sum256(body); status != http.StatusOK || hex.EncodeToString(sum[:]) != digest.Hex {
+		t.Fatalf("blob not fetched again once upstream was fixed: %d", status)
+	}
+	cached, err := ioutil.ReadFile(proxy.getBlobPath(repo, digest))
+	if err != nil || !bytes.Equal(cached, body) {
+		t.Fatalf("blob that matched its digest wasn't cached: %v", err)
+	}
+}
+
+func TestProxyServesBlobsOnlyUnderTheirRepository(t *testing.T) {
+	upstream, upstreamHost, _, proxyHost, cleanup := startTestProxy(t)
+	defer cleanup()
+	img := upstream.push(t, upstreamHost, "private/app")
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := layers[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status, _ := fetchProxiedBlob(t, proxyHost, "private/app", digest); status != http.StatusOK {
+		t.Fatalf("blob not served under its repository: %d", status)
+	}
+	if status, _ := fetchProxiedBlob(t, proxyHost, "public/other", digest); status != http.StatusNotFound {
+		t.Fatalf("cached blob served under another repository: %d", status)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+	A pull or build that crashed leaves its files behind in the temp
+	directory, or an image directory without a manifest. We can't tell
+	those apart from the files of one that is still running, other than
+	by how long it has been since anything in there changed.
+*/
+
+const staleTempAge = time.Hour
+
+func getImagesInUse() map[string]bool {
+	containers, err := getRunningContainers()
+	if err != nil {
+		log.Fatalf("Unable to get running containers list: %v\n", err)
+	}
+	inUse := make(map[string]bool)
+	for _, container := range containers {
+		inUse[container.imageShaHex] = true
+	}
+	for imageShaHex := range getImageMounts() {
+		inUse[imageShaHex] = true
+	}
+	return inUse
+}
+
+/*
+	Returns whether nothing under dir changed in the last staleTempAge.
+	Directories with something mounted under them, like the stages
+	"gocker build" copies from, are never stale.
+*/
+
+func isStale(dir string) bool {
+	var dirStat syscall.Stat_t
+	if err := syscall.Lstat(dir, &dirStat); err != nil {
+		return false
+	}
+	cutoff := time.Now().Add(-staleTempAge)
+	stale := true
+	_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && uint64(stat.Dev) != uint64(dirStat.Dev) {
+			stale = false
+		}
+		if info.ModTime().After(cutoff) {
+			stale = false
+		}
+		if !stale {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return stale
+}
+
+func removeStaleTempFiles() int64 {
+	var reclaimed int64
+	entries, err := ioutil.ReadDir(getGockerTempPath())
+	if err != nil {
+		log.Fatalf("Unable to read temp directory: %v\n", err)
+	}
+	for _, entry := range entries {
+		tmpPath := getGockerTempPath() + "/" + entry.Name()
+		if !isStale(tmpPath) {
+			continue
+		}
+		reclaimed += getReclaimableSize(tmpPath)
+		if err := os.RemoveAll(tmpPath); err != nil {
+			log.Printf("Unable to remove %s: %v\n", tmpPath, err)
+			continue
+		}
+		log.Printf("Deleted temporary files: %s\n", entry.Name())
+	}
+
+	entries, err = ioutil.ReadDir(getGockerImagesPath())
+	if err != nil {
+		log.Fatalf("Unable to read images directory: %v\n", err)
+	}
+	for _, entry := range entries {
+		imageDir := getGockerImagesPath() + "/" + entry.Name()
+		if !entry.IsDir() || imageStoredByHash(entry.Name()) || !isStale(imageDir) {
+			continue
+		}
+		reclaimed += getReclaimableSize(imageDir)
+		if err := os.RemoveAll(imageDir); err != nil {
+			log.Printf("Unable to remove %s: %v\n", imageDir, err)
+			continue
+		}
+		log.Printf("Deleted incomplete image: %s\n", entry.Name())
+	}
+	return reclaimed
+}
+
+/*
+	"until" takes a duration like 24h, meaning images created more than
+	that long ago, an RFC 3339 timestamp or Unix seconds.
+*/
+
+func parseUntilFilter(until string) time.Time {
+	if d, err := time.ParseDuration(until); err == nil {
+		return time.Now().Add(-d)
+	}
+	if t, err := time.Parse(time.RFC3339, until); err == nil {
+		return t
+	}
+	if secs, err := strconv.ParseInt(until, 10, 64); err == nil {
+		return time.Unix(secs, 0)
+	}
+	log.Fatalf("Invalid value for until: %s\n", until)
+	return time.Time{}
+}
+
+/*
+	Called for "gocker image prune". Removes dangling images or, with
+	all, every image no container runs. Containers are removed when they
+	exit, so the running ones are the only ones that use images.
+*/
+
+func pruneImages(all bool, filters []string) {
+	var cutoff time.Time
+	for _, filter := range filters {
+		kv := strings.SplitN(filter, "=", 2)
+		if len(kv) != 2 || kv[0] != "until" {
+			log.Fatalf("Unsupported filter %s, only until=<time> is supported\n", filter)
+		}
+		cutoff = parseUntilFilter(kv[1])
+	}
+
+	candidates := getDanglingImages()
+	if all {
+		candidates = getAllImageHashes()
+	}
+	inUse := getImagesInUse()
+	var reclaimed int64
+	for _, imageShaHex := range candidates {
+		if inUse[imageShaHex] {
+			continue
+		}
+		if !cutoff.IsZero() && !parseImageConfigFile(imageShaHex).Created.Time.Before(cutoff) {
+			continue
+		}
+		for _, tag := range getTagsForHash(imageShaHex) {
+			log.Printf("Untagged: %s\n", tag)
+		}
+		reclaimed += getReclaimableSize(getBasePathForImage(imageShaHex))
+		deleteImageByHash(imageShaHex)
+	}
+	reclaimed += removeStaleTempFiles()
+	fmt.Printf("Total reclaimed space: %s\n", humanSize(reclaimed))
+}
+
+func getPercentage(part int64, total int64) int64 {
+	if total == 0 {
+		return 0
+	}
+	return part * 100 / total
+}
+
+/*
+	Called for "gocker system df". Shared files are counted once, and
+	an image's files count as reclaimable only if no image in use has
+	them too.
+*/
+
+func printDiskUsage() {
+	inUse := getImagesInUse()
+	imageHashes := getAllImageHashes()
+	seen := make(map[fileID]bool)
+	var imagesSize, imagesReclaimable int64
+	activeImages := 0
+	for _, imageShaHex := range imageHashes {
+		if inUse[imageShaHex] {
+			imagesSize += getImageSize(imageShaHex, seen)
+			activeImages++
+		}
+	}
+	for _, imageShaHex := range imageHashes {
+		if !inUse[imageShaHex] {
+			size := getImageSize(imageShaHex, seen)
+			imagesSize += size
+			imagesReclaimable += size
+		}
+	}
+
+	var containersSize int64
+	containerEntries, _ := ioutil.ReadDir(getGockerContainersPath())
+	for _, entry := range containerEntries {
+		containersSize += getDirSize(getContainerFSHome(entry.Name())+"/upperdir", make(map[fileID]bool))
+	}
+
+	var volumesSize, volumesReclaimable int64
+	volumesInUse := getVolumesInUse()
+	activeVolumes := 0
+	volumeEntries, _ := ioutil.ReadDir(getGockerVolumesPath())
+	for _, entry := range volumeEntries {
+		size := getDirSize(getVolumePath(entry.Name()), make(map[fileID]bool))
+		volumesSize += size
+		if volumesInUse[entry.Name()] {
+			activeVolumes++
+		} else {
+			volumesReclaimable += size
+		}
+	}
+
+	var cacheSize, cacheReclaimable int64
+	cacheEntries, _ := ioutil.ReadDir(getGockerBuildCachePath())
+	cacheSeen := make(map[fileID]bool)
+	for _, entry := range cacheEntries {
+		entryDir := getGockerBuildCachePath() + "/" + entry.Name()
+		cacheSize += getDirSize(entryDir, cacheSeen)
+		cacheReclaimable += getReclaimableSize(entryDir)
+	}
+
+	format := "%-16s%-10s%-10s%-12s%s\n"
+	fmt.Printf(format, "TYPE", "TOTAL", "ACTIVE", "SIZE", "RECLAIMABLE")
+	fmt.Printf(format, "Images", strconv.Itoa(len(imageHashes)), strconv.Itoa(activeImages),
+		humanSize(imagesSize), fmt.Sprintf("%s (%d%%)", humanSize(imagesReclaimable),
+			getPercentage(imagesReclaimable, imagesSize)))
+	fmt.Printf(format, "Containers", strconv.Itoa(len(containerEntries)), strconv.Itoa(len(containerEntries)),
+		humanSize(containersSize), "0B (0%)")
+	fmt.Printf(format, "Local Volumes", strconv.Itoa(len(volumeEntries)), strconv.Itoa(activeVolumes),
+		humanSize(volumesSize), fmt.Sprintf("%s (%d%%)", humanSize(volumesReclaimable),
+			getPercentage(volumesReclaimable, volumesSize)))
+	fmt.Printf(format, "Build Cache", strconv.Itoa(len(cacheEntries)), "0",
+		humanSize(cacheSize), fmt.Sprintf("%s (%d%%)", humanSize(cacheReclaimable),
+			getPercentage(cacheReclaimable, cacheSize)))
+}
@@ -13,24 +13,40 @@ import (
 type runningContainerInfo struct {
 	containerId string
 	image string
+	imageShaHex string
 	command string
 	pid int
 }
 
+func getImageNameForHash(imageID string) string {
+	image, tag := getImageAndTagForHash(imageID)
+	if len(image) == 0 {
+		return imageID
+	}
+	return formatImageNameAndTag(image, tag)
+}
+
 /*
 	This isn't a great implementation and can possibly be simplified
 	using regex. But for now, here we are. This function gets the
 	current mount points, figures out which image is mounted for a
 	given container ID, looks it up in our images database which we
-	maintain and returns the image and tag information.
+	maintain and returns the image and tag information along with the
+	image ID. Containers of dangling images get the image ID as name.
+	Containers record the image they run, which is used instead if they
+	do, as images with many layers are mounted by relative paths.
 */
 
-func getDistribution(containerID string) (string, error) {
+func getDistribution(containerID string) (string, string, error) {
+	if data, err := ioutil.ReadFile(getGockerContainersPath() + "/" + containerID + "/image"); err == nil {
+		imageID := strings.TrimSpace(string(data))
+		return getImageNameForHash(imageID), imageID, nil
+	}
 	var lines []string
 	file, err := os.Open("/proc/mounts")
 	if err != nil {
 		fmt.Println("Unable to read /proc/mounts")
-		return "", err
+		return "", "", err
 	}
 	defer file.Close()
 	scanner := bufio.NewScanner(file)
@@ -49,17 +65,20 @@ func getDistribution(containerID string) (string, error) {
 						if strings.Contains(option, "lowerdir=") {
 							imagesPath := getGockerImagesPath()
 							leaderString := "lowerdir=" + imagesPath + "/"
+							/* Containers of "gocker build" don't run an image */
+							if !strings.HasPrefix(option, leaderString) {
+								return "", "", nil
+							}
 							trailerString := option[len(leaderString):]
 							imageID := trailerString[:12]
-							image, tag := getImageAndTagForHash(imageID)
-							return fmt.Sprintf("%s:%s", image, tag), nil
+							return getImageNameForHash(imageID), imageID, nil
 						}
 					}
 				}
 			}
 		}
 	}
-	return "", nil
+	return "", "", nil
 }
 
 func getRunningContainerInfoForId(containerID string) (runningContainerInfo, error) {
@@ -96,10 +115,11 @@ func getRunningContainerInfoForId(containerID string) (runningContainerInfo, err
 			fmt.Println("Unable to read command link.")
 			return container, err
 		}
-		image, _ := getDistribution(containerID)
+		image, imageShaHex, _ := getDistribution(containerID)
 		container = runningContainerInfo{
 			containerId: containerID,
 			image:       image,
+			imageShaHex: imageShaHex,
 			command:     cmd[len(realContainerMntPath):],
 			pid:         pid,
 		}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+/*
+	We don't keep the layer tarballs we pulled, only what they unpacked
+	to under /var/lib/gocker/images/<hash>/<layer>/fs. To hand an image to
+	someone else, we tar up each of those directories again. The new
+	tarballs won't be byte-for-byte the same as the ones we pulled, so the
+	config's diff IDs are updated to match them, while the rest of the
+	config, history included, is kept as it was.
+	The returned cleanup function removes the temporary layer tarballs
+	and must only be called once the image has been consumed.
+*/
+
+func getStoredImage(imageShaHex string) (v1.Image, func()) {
+	img, cleanup, err := packStoredImage(imageShaHex)
+	if err != nil {
+		log.Fatalf("Unable to pack image %s: %v\n", imageShaHex, err)
+	}
+	return img, cleanup
+}
+
+/*
+	Like getStoredImage(), but for callers that can't just exit when an
+	image can't be packed, like "gocker registry serve".
+*/
+
+func packStoredImage(imageShaHex string) (v1.Image, func(), error) {
+	mani := manifest{}
+	if err := parseManifest(getManifestPathForImage(imageShaHex), &mani); err != nil {
+		return nil, nil, fmt.Errorf("unable to read manifest: %v", err)
+	}
+	if len(mani) == 0 || len(mani[0].Layers) == 0 {
+		return nil, nil, fmt.Errorf("could not find any layers")
+	}
+	rawConfig, err := ioutil.ReadFile(getConfigPathForImage(imageShaHex))
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read image config file: %v", err)
+	}
+	cfg, err := v1.ParseConfigFile(bytes.NewReader(rawConfig))
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse image config: %v", err)
+	}
+
+	tmpPath, err := ioutil.TempDir(getGockerTempPath(), imageShaHex+"-layers-")
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create temporary directory: %v", err)
+	}
+	cleanup := func() {
+		os.RemoveAll(tmpPath)
+	}
+
+	var layers []v1.Layer
+	imageBasePath := getBasePathForImage(imageShaHex)
+	for _, layer := range mani[0].Layers {
+		layerDir := getLayerDirName(layer)
+		layerTar := tmpPath + "/" + layerDir + ".tar"
+		log.Printf("Packing layer %s...\n", layerDir)
+		file, err := os.Create(layerTar)
+		if err != nil {
+			cleanup()
+			return nil, nil, fmt.Errorf("unable to create layer tarball: %v", err)
+		}
+		err = tarDirectory(imageBasePath+"/"+layerDir+"/fs", file)
+		file.Close()
+		if err != nil {
+			cleanup()
+			return nil, nil, fmt.Errorf("unable to pack layer %s: %v", layerDir, err)
+		}
+		l, err := tarball.LayerFromFile(layerTar)
+		if err != nil {
+			cleanup()
+			return nil, nil, fmt.Errorf("unable to read layer tarball: %v", err)
+		}
+		layers = append(layers, l)
+	}
+
+	img, err := mutate.AppendLayers(empty.Image, layers...)
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("unable to assemble image: %v", err)
+	}
+	newCfg, err := img.ConfigFile()
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("unable to assemble image config: %v", err)
+	}
+	cfg.RootFS = newCfg.RootFS
+	if img, err = mutate.ConfigFile(img, cfg); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("unable to assemble image config: %v", err)
+	}
+	return img, cleanup, nil
+}
+
+func pushImage(dst string) {
+	ref := parseImageReference(dst)
+	imgName, tagName := getFamiliarName(ref.Context()), ref.Identifier()
+	exists, imageShaHex := imageExistByTag(imgName, tagName)
+	if !exists {
+		log.Fatalf("No such image: %s\n", formatImageNameAndTag(imgName, tagName))
+	}
+
+	img, cleanup := getStoredImage(imageShaHex)
+	defer cleanup()
+	log.Printf("Pushing %s...\n", ref.Name())
+	/* remote.Write() only uploads the blobs the registry doesn't already have */
+	if err := remote.Write(ref, img, getRemoteOptions(ref.Context().Registry)...); err != nil {
+		cleanup()
+		log.Fatalf("Unable to push %s: %v\n", ref.Name(), err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		cleanup()
+		log.Fatalf("Unable to get image digest: %v\n", err)
+	}
+	log.Printf("Pushed %s@%s\n", ref.Context().Name(), digest)
+}
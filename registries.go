@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+/*
+	Registry settings live in /etc/gocker/daemon.json, which uses the
+	same keys as Docker's daemon.json:
+	{
+		"insecure-registries": ["lab-registry:5000"],
+		"registry-mirrors": ["https://mirror.lab.example.com"],
+		"registry-proxies": {"quay.io": "http://localhost:5000"}
+	}
+	Insecure registries may be spoken to over plain HTTP or over TLS
+	without certificate verification. Mirrors are tried in order for
+	Docker Hub images before falling back to Docker Hub itself.
+	"registry-proxies" isn't one of Docker's. It names a mirror, usually
+	a "gocker registry proxy", for any registry, and is tried before
+	registry-mirrors.
+
+	As with Docker, a registry's CA bundle and client certificate go in
+	/etc/gocker/certs.d/<host[:port]>/ as ca.crt, client.cert and
+	client.key.
+*/
+
+type registriesConfig struct {
+	InsecureRegistries []string `json:"insecure-registries"`
+	RegistryMirrors    []string `json:"registry-mirrors"`
+	RegistryProxies    map[string]string `json:"registry-proxies"`
+}
+
+func parseRegistriesConfig() registriesConfig {
+	regConfig := registriesConfig{}
+	data, err := ioutil.ReadFile(getGockerConfigPath() + "/daemon.json")
+	if os.IsNotExist(err) {
+		return regConfig
+	} else if err != nil {
+		log.Fatalf("Could not read gocker configuration: %v\n", err)
+	}
+	if err := json.Unmarshal(data, &regConfig); err != nil {
+		log.Fatalf("Unable to parse gocker configuration: %v\n", err)
+	}
+	return regConfig
+}
+
+func isInsecureRegistry(registry string) bool {
+	return stringInSlice(registry, parseRegistriesConfig().InsecureRegistries)
+}
+
+func getNameOptions(registry string) []name.Option {
+	if isInsecureRegistry(registry) {
+		return []name.Option{name.Insecure}
+	}
+	return nil
+}
+
+func getRegistryHTTPTransport(registry string) http.RoundTripper {
+	tlsConfig := &tls.Config{InsecureSkipVerify: isInsecureRegistry(registry)}
+	certsDir := getGockerCertsPath() + "/" + registry
+
+	caData, err := ioutil.ReadFile(certsDir + "/ca.crt")
+	if err == nil {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(caData) {
+			log.Fatalf("No certificates found in %s/ca.crt\n", certsDir)
+		}
+		tlsConfig.RootCAs = pool
+	} else if !os.IsNotExist(err) {
+		log.Fatalf("Unable to read CA bundle for %s: %v\n", registry, err)
+	}
+
+	if _, err := os.Stat(certsDir + "/client.cert"); err == nil {
+		cert, err := tls.LoadX509KeyPair(certsDir+"/client.cert", certsDir+"/client.key")
+		if err != nil {
+			log.Fatalf("Unable to load client certificate for %s: %v\n", registry, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = tlsConfig
+	return tr
+}
+
+func getMirrorReference(mirror string, ref name.Reference) (name.Reference, error) {
+	host := strings.TrimPrefix(strings.TrimPrefix(mirror, "https://"), "http://")
+	host = strings.TrimSuffix(host, "/")
+	opts := getNameOptions(host)
+	if strings.HasPrefix(mirror, "http://") {
+		opts = []name.Option{name.Insecure}
+	}
+	separator := ":"
+	if _, ok := ref.(name.Digest); ok {
+		separator = "@"
+	}
+	return name.ParseReference(host+"/"+ref.Context().RepositoryStr()+separator+ref.Identifier(), opts...)
+}
+
+func getRegistryMirrors(registry string) []string {
+	regConfig := parseRegistriesConfig()
+	var mirrors []string
+	for proxied, proxy := range regConfig.RegistryProxies {
+		if reg, err := name.NewRegistry(proxied); err == nil && reg.RegistryStr() == registry {
+			mirrors = append(mirrors, proxy)
+		}
+	}
+	if registry == name.DefaultRegistry {
+		mirrors = append(mirrors, regConfig.RegistryMirrors...)
+	}
+	return mirrors
+}
+
+/*
+	Fetches the image's manifest and returns the image along with the
+	reference it was found under, which is a mirror's if one had it, and
+	the descriptor the reference resolved to. For a multi-platform image
+	that is the index the image was picked from.
+*/
+
+func fetchRemoteImage(ref name.Reference, platform v1.Platform) (v1.Image, name.Reference, *remote.Descriptor, error) {
+	for _, mirror := range getRegistryMirrors(ref.Context().RegistryStr()) {
+		mirrorRef, err := getMirrorReference(mirror, ref)
+		if err != nil {
+			log.Printf("Skipping invalid registry mirror %s: %v\n", mirror, err)
+			continue
+		}
+		img, desc, err := getRemoteImage(mirrorRef, platform)
+		if err != nil {
+			log.Printf("Unable to get %s from mirror %s: %v\n", ref.Name(), mirror, err)
+			continue
+		}
+		log.Printf("Using registry mirror %s\n", mirror)
+		return img, mirrorRef, desc, nil
+	}
+	img, desc, err := getRemoteImage(ref, platform)
+	return img, ref, desc, err
+}
+
+func getRemoteImage(ref name.Reference, platform v1.Platform) (v1.Image, *remote.Descriptor, error) {
+	desc, err := remote.Get(ref,
+		append(getRemoteOptions(ref.Context().Registry), remote.WithPlatform(platform))...)
+	if err != nil {
+		return nil, nil, err
+	}
+	img, err := desc.Image()
+	return img, desc, err
+}
@@ -3,10 +3,12 @@ package main
 import (
 	"golang.org/x/sys/unix"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
@@ -45,12 +47,93 @@ func mountOverlayFileSystem(containerID string, imageShaHex string) {
 
 	imageBasePath := getBasePathForImage(imageShaHex)
 	for _, layer := range mani[0].Layers {
-		srcLayers = append([]string{imageBasePath + "/" + layer[:12] + "/fs"}, srcLayers...)
+		srcLayers = append([]string{imageBasePath + "/" + getLayerDirName(layer) + "/fs"}, srcLayers...)
 		//srcLayers = append(srcLayers, imageBasePath + "/" + layer[:12] + "/fs")
 	}
+	mountContainerOverlay(containerID, srcLayers)
+	/* ps can't tell the image from lower directories mounted by relative paths */
+	doOrDieWithMsg(ioutil.WriteFile(getGockerContainersPath()+"/"+containerID+"/image", []byte(imageShaHex), 0644),
+		"Unable to record the container's image")
+}
+
+/*
+	Mount options have to fit in a page, which the full paths of the
+	layers of an image with many of them don't. Overlay also takes lower
+	directories relative to the current directory, so we then mount from
+	the directory the layers have in common. If that's still too long,
+	we mount from a temporary directory of symlinks with short names to
+	the layers. Overlay resolves those when mounting, so they can go
+	right after.
+*/
+
+const maxMountOptionsLength = 4095
+
+func getCommonParentDir(dirs []string) string {
+	parent := filepath.Dir(dirs[0])
+	for _, dir := range dirs {
+		for parent != "/" && !strings.HasPrefix(dir, parent+"/") {
+			parent = filepath.Dir(parent)
+		}
+	}
+	return parent
+}
+
+func mountOverlay(target string, flags uintptr, lowerDirs []string, options string) error {
+	getMountOptions := func(dirs []string) string {
+		mntOptions := "lowerdir=" + strings.Join(dirs, ":")
+		if len(options) > 0 {
+			mntOptions += "," + options
+		}
+		return mntOptions
+	}
+	mntOptions := getMountOptions(lowerDirs)
+	if len(mntOptions) <= maxMountOptionsLength {
+		return unix.Mount("none", target, "overlay", flags, mntOptions)
+	}
+
+	mntDir := getCommonParentDir(lowerDirs)
+	relDirs := make([]string, len(lowerDirs))
+	for i, dir := range lowerDirs {
+		relDirs[i] = strings.TrimPrefix(strings.TrimPrefix(dir, mntDir), "/")
+	}
+	if mntOptions = getMountOptions(relDirs); len(mntOptions) > maxMountOptionsLength {
+		linksDir, err := ioutil.TempDir(getGockerTempPath(), "layers-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(linksDir)
+		for i, dir := range lowerDirs {
+			relDirs[i] = strconv.Itoa(i)
+			if err := os.Symlink(dir, linksDir+"/"+relDirs[i]); err != nil {
+				return err
+			}
+		}
+		mntDir, mntOptions = linksDir, getMountOptions(relDirs)
+		if len(mntOptions) > maxMountOptionsLength {
+			return fmt.Errorf("too many layers to mount: %d", len(lowerDirs))
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(mntDir); err != nil {
+		return err
+	}
+	defer os.Chdir(wd)
+	return unix.Mount("none", target, "overlay", flags, mntOptions)
+}
+
+/*
+	Mounts the container's root fs with lowerDirs, topmost first, below
+	its own upper directory, where all its changes go.
+*/
+
+func mountContainerOverlay(containerID string, lowerDirs []string) {
 	contFSHome := getContainerFSHome(containerID)
-	mntOptions := "lowerdir=" + strings.Join(srcLayers, ":") + ",upperdir=" + contFSHome + "/upperdir,workdir=" + contFSHome + "/workdir"
-	if err := unix.Mount("none", contFSHome+"/mnt", "overlay", 0, mntOptions); err != nil {
+	options := "upperdir=" + contFSHome + "/upperdir,workdir=" + contFSHome + "/workdir"
+	if err := mountOverlay(contFSHome+"/mnt", 0, lowerDirs, options); err != nil {
 		log.Fatalf("Mount failed: %v\n", err)
 	}
 }
@@ -69,7 +152,84 @@ func unmountContainerFs(containerID string) {
 	}
 }
 
-func copyNameserverConfig(containerID string) error {
+func getRuntimePathsPath(containerID string) string {
+	return getGockerContainersPath() + "/" + containerID + "/runtime-paths"
+}
+
+/*
+	Creates p, a path in the container's root fs at mntPath, if it isn't
+	there, for us to mount on. What we create isn't what the container's
+	command did, so it is recorded, as the topmost directory created if
+	p's parents were missing too, in "runtime-paths" in the container's
+	directory, for "gocker commit" and "gocker build" to leave it out of
+	layers. Returns where p is on the host.
+*/
+
+func createRuntimePath(containerID string, mntPath string, p string, isDir bool) (string, error) {
+	target, err := resolveInRoot(mntPath, p)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Lstat(target); !os.IsNotExist(err) {
+		return target, nil
+	}
+	created := getRootRelativePath(mntPath, target)
+	for dir := filepath.Dir(created); dir != "/"; dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(mntPath + dir); err == nil {
+			break
+		}
+		created = dir
+	}
+	if isDir {
+		err = os.MkdirAll(target, 0755)
+	} else if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+		err = ioutil.WriteFile(target, nil, 0644)
+	}
+	if err != nil {
+		return "", err
+	}
+	file, err := os.OpenFile(getRuntimePathsPath(containerID), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	_, err = fmt.Fprintln(file, created)
+	return target, err
+}
+
+func getRuntimePaths(containerID string) []string {
+	var paths []string
+	data, _ := ioutil.ReadFile(getRuntimePathsPath(containerID))
+	for _, p := range strings.Split(string(data), "\n") {
+		if len(p) > 0 {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+/*
+	Removes what we created in the container's root fs from upperDir,
+	once the container is done with it.
+*/
+
+func removeRuntimePaths(containerID string, upperDir string) error {
+	for _, p := range getRuntimePaths(containerID) {
+		if err := os.RemoveAll(upperDir + p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+	The container gets the host's resolver config from a copy in its
+	directory, bind mounted on its /etc/resolv.conf, rather than written
+	over what the image has, which would end up in layers that "gocker
+	commit" and "gocker build" make.
+*/
+
+func mountNameserverConfig(containerID string, mntPath string) error {
 	resolvFilePaths := []string{
 		"/var/run/systemd/resolve/resolv.conf",
 		"/etc/gockerresolv.conf",
@@ -78,52 +238,100 @@ func copyNameserverConfig(containerID string) error {
 	for _, resolvFilePath := range resolvFilePaths {
 		if _, err := os.Stat(resolvFilePath); os.IsNotExist(err) {
 			continue
-		} else {
-			return copyFile(resolvFilePath,
-				getContainerFSHome(containerID)+"/mnt/etc/resolv.conf")
 		}
+		src := getGockerContainersPath() + "/" + containerID + "/resolv.conf"
+		if err := copyFile(resolvFilePath, src); err != nil {
+			return err
+		}
+		target, err := createRuntimePath(containerID, mntPath, "/etc/resolv.conf", false)
+		if err != nil {
+			return err
+		}
+		return unix.Mount(src, target, "", unix.MS_BIND, "")
 	}
 	return nil
 }
 
 /*
-	Called if this program is executed with "child-mode" as the first argument
+	Called if this program is executed with "child-mode" as the first argument.
+	The environment, working directory and user come from the image's
+	config. env is added to the environment, while workdir and user, if
+	set, take the place of the image's. Containers run by "gocker build"
+	have no image and pass all three.
 */
 func execContainerCommand(mem int, swap int, pids int, cpus float64,
-	containerID string, imageShaHex string, args []string) {
+	containerID string, imageShaHex string, env []string, workdir string, user string,
+	args []string) {
 	mntPath := getContainerFSHome(containerID) + "/mnt"
 	cmd := exec.Command(args[0], args[1:]...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
-	imgConfig := parseContainerConfig(imageShaHex)
+	if len(imageShaHex) > 0 {
+		imgConfig := parseContainerConfig(imageShaHex)
+		env = append(imgConfig.Config.Env, env...)
+		if len(workdir) == 0 {
+			workdir = imgConfig.Config.WorkingDir
+		}
+		if len(user) == 0 {
+			user = imgConfig.Config.User
+		}
+	}
 	doOrDieWithMsg(unix.Sethostname([]byte(containerID)), "Unable to set hostname")
 	doOrDieWithMsg(joinContainerNetworkNamespace(containerID), "Unable to join container network namespace")
 	createCGroups(containerID, true)
 	configureCGroups(containerID, mem, swap, pids, cpus)
-	doOrDieWithMsg(copyNameserverConfig(containerID), "Unable to copy resolve.conf")
+	doOrDieWithMsg(makeMountsPrivate(), "Unable to make mounts private")
+	doOrDieWithMsg(mountNameserverConfig(containerID, mntPath), "Unable to mount resolv.conf")
+	/* Volumes may be mounted in /tmp or /dev, which have to be there first */
+	for _, dir := range []string{"/tmp", "/dev"} {
+		target, err := createRuntimePath(containerID, mntPath, dir, true)
+		doOrDieWithMsg(err, "Unable to create "+dir)
+		doOrDieWithMsg(unix.Mount("tmpfs", target, "tmpfs", 0, ""), "Unable to mount tmpfs on "+dir)
+	}
+	mounts := mountContainerVolumes(containerID, mntPath)
+	/* Once in the chroot, we can't record what we create */
+	for _, dir := range []string{"/proc", "/sys"} {
+		_, err := createRuntimePath(containerID, mntPath, dir, true)
+		doOrDieWithMsg(err, "Unable to create "+dir)
+	}
 	doOrDieWithMsg(unix.Chroot(mntPath), "Unable to chroot")
 	doOrDieWithMsg(os.Chdir("/"), "Unable to change directory")
-	createDirsIfDontExist([]string{"/proc", "/sys"})
 	doOrDieWithMsg(unix.Mount("proc", "/proc", "proc", 0, ""), "Unable to mount proc")
-	doOrDieWithMsg(unix.Mount("tmpfs", "/tmp", "tmpfs", 0, ""), "Unable to mount tmpfs")
-	doOrDieWithMsg(unix.Mount("tmpfs", "/dev", "tmpfs", 0, ""), "Unable to mount tmpfs on /dev")
 	createDirsIfDontExist([]string{"/dev/pts"})
 	doOrDieWithMsg(unix.Mount("devpts", "/dev/pts", "devpts", 0, ""), "Unable to mount devpts")
 	doOrDieWithMsg(unix.Mount("sysfs", "/sys", "sysfs", 0, ""), "Unable to mount sysfs")
 	setupLocalInterface()
-	cmd.Env = imgConfig.Config.Env
-	cmd.Run()
+	if len(workdir) > 0 {
+		doOrDieWithMsg(os.MkdirAll(workdir, 0755), "Unable to create working directory")
+		doOrDieWithMsg(os.Chdir(workdir), "Unable to change to working directory")
+	}
+	if len(user) > 0 {
+		credential, err := getContainerUserCredential(user)
+		if err != nil {
+			log.Fatalf("Unable to find user %s: %v\n", user, err)
+		}
+		cmd.SysProcAttr = &unix.SysProcAttr{Credential: credential}
+	}
+	cmd.Env = env
+	err := cmd.Run()
+	unmountContainerVolumes(mounts)
 	doOrDie(unix.Unmount("/dev/pts", 0))
 	doOrDie(unix.Unmount("/dev", 0))
 	doOrDie(unix.Unmount("/sys", 0))
 	doOrDie(unix.Unmount("/proc", 0))
 	doOrDie(unix.Unmount("/tmp", 0))
+	/* Let whoever started the container know how the command exited */
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		os.Exit(exitErr.ExitCode())
+	} else if err != nil {
+		log.Fatalf("Unable to run %s: %v\n", args[0], err)
+	}
 }
 
 func prepareAndExecuteContainer(mem int, swap int, pids int, cpus float64,
-	containerID string, imageShaHex string, cmdArgs []string) {
+	containerID string, imageShaHex string, childOpts []string, cmdArgs []string) error {
 
 	/* Setup the network namespace  */
 	cmd := &exec.Cmd{
@@ -173,7 +381,9 @@ func prepareAndExecuteContainer(mem int, swap int, pids int, cpus float64,
 		opts = append(opts, "--cpus="+strconv.FormatFloat(cpus, 'f', 1, 64))
 	}
 	opts = append(opts, "--img="+imageShaHex)
-	args := append([]string{containerID}, cmdArgs...)
+	opts = append(opts, childOpts...)
+	/* Stops flag parsing, so the command's own flags reach it untouched */
+	args := append([]string{"--", containerID}, cmdArgs...)
 	args = append(opts, args...)
 	args = append([]string{"child-mode"}, args...)
 	cmd = exec.Command("/proc/self/exe", args...)
@@ -186,23 +396,50 @@ func prepareAndExecuteContainer(mem int, swap int, pids int, cpus float64,
 			unix.CLONE_NEWUTS |
 			unix.CLONE_NEWIPC,
 	}
-	doOrDie(cmd.Run())
+	return cmd.Run()
 }
 
-func initContainer(mem int, swap int, pids int, cpus float64, src string, args []string) {
-	containerID := createContainerID()
-	log.Printf("New container ID: %s\n", containerID)
-	imageShaHex := downloadImageIfRequired(src)
-	log.Printf("Image to overlay mount: %s\n", imageShaHex)
-	createContainerDirectories(containerID)
-	mountOverlayFileSystem(containerID, imageShaHex)
+/*
+	Runs cmdArgs in a container whose root fs is already mounted and
+	cleans up everything but the container's directory once it exits.
+	Returns the error from running it, if any.
+*/
+
+func runContainer(mem int, swap int, pids int, cpus float64,
+	containerID string, imageShaHex string, childOpts []string, cmdArgs []string) error {
 	if err := setupVirtualEthOnHost(containerID); err != nil {
 		log.Fatalf("Unable to setup Veth0 on host: %v", err)
 	}
-	prepareAndExecuteContainer(mem, swap, pids, cpus, containerID, imageShaHex, args)
-	log.Printf("Container done.\n")
+	err := prepareAndExecuteContainer(mem, swap, pids, cpus, containerID, imageShaHex, childOpts, cmdArgs)
 	unmountNetworkNamespace(containerID)
 	unmountContainerFs(containerID)
 	removeCGroups(containerID)
-	os.RemoveAll(getGockerContainersPath() + "/" + containerID)
+	return err
+}
+
+func initContainer(mem int, swap int, pids int, cpus float64, platform string,
+	mounts []containerMount, src string, args []string) {
+	containerID := createContainerID()
+	log.Printf("New container ID: %s\n", containerID)
+	imageShaHex := downloadImageIfRequired(src, platform)
+	ensureImageRunsOnHost(imageShaHex)
+	mounts = resolveContainerMounts(imageShaHex, mounts)
+	log.Printf("Image to overlay mount: %s\n", imageShaHex)
+	createContainerDirectories(containerID)
+	mountOverlayFileSystem(containerID, imageShaHex)
+	setupContainerMounts(containerID, mounts)
+	err := runContainer(mem, swap, pids, cpus, containerID, imageShaHex, nil, args)
+	log.Printf("Container done.\n")
+	/* A container mounted with "gocker mount" keeps its files until unmounted */
+	unlock := lockMounts()
+	if getMountRefs(getContainerMountPath(containerID)) == 0 {
+		removeAnonymousVolumes(containerID)
+		os.RemoveAll(getGockerContainersPath() + "/" + containerID)
+	}
+	unlock()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		os.Exit(exitErr.ExitCode())
+	} else if err != nil {
+		log.Fatalf("Unable to run container: %v\n", err)
+	}
 }
@@ -0,0 +1,643 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+	"gocker sbom" lists the software in an image, or a running container,
+	by reading the package databases in its file system:
+	- apk:  /lib/apk/db/installed
+	- dpkg: /var/lib/dpkg/status, and /var/lib/dpkg/status.d/ as used by
+	  distroless images
+	- rpm:  /var/lib/rpm or /usr/lib/sysimage/rpm. These are Berkeley DB,
+	  SQLite or NDB files, which we leave to the host's rpm to read.
+	and the metadata language package managers install packages with:
+	- npm:  node_modules/<package>/package.json
+	- pypi: <package>.dist-info/METADATA and <package>.egg-info/PKG-INFO
+	- gem:  specifications/<package>-<version>.gemspec
+*/
+
+type sbomPackage struct {
+	name     string
+	source   string
+	version  string
+	arch     string
+	license  string
+	pkgType  string
+	location string
+}
+
+type osRelease map[string]string
+
+/*
+	Files of the image are looked up with resolveInRoot(), as its
+	symlinks, like /etc/os-release -> /usr/lib/os-release, point into
+	the image and not at the host's files. A path that can't be resolved,
+	with a symlink loop say, comes back empty, which nothing opens.
+*/
+
+func getPathInRoot(root string, path string) string {
+	resolved, err := resolveInRoot(root, path)
+	if err != nil {
+		return ""
+	}
+	return resolved
+}
+
+func parseOSRelease(root string) osRelease {
+	release := make(osRelease)
+	for _, path := range []string{"/etc/os-release", "/usr/lib/os-release"} {
+		data, err := ioutil.ReadFile(getPathInRoot(root, path))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+			if len(kv) == 2 {
+				release[kv[0]] = strings.Trim(kv[1], `"'`)
+			}
+		}
+		break
+	}
+	return release
+}
+
+/*
+	dpkg's status file and Python's package metadata are made of
+	"Key: value" paragraphs separated by blank lines, where lines that
+	start with a space continue the previous value.
+*/
+
+func parseControlParagraphs(r io.Reader) []map[string]string {
+	var paragraphs []map[string]string
+	paragraph := make(map[string]string)
+	lastKey := ""
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(strings.TrimSpace(line)) == 0 {
+			if len(paragraph) > 0 {
+				paragraphs = append(paragraphs, paragraph)
+				paragraph = make(map[string]string)
+			}
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(lastKey) > 0 {
+			paragraph[lastKey] += "\n" + strings.TrimSpace(line)
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) == 2 {
+			lastKey = kv[0]
+			paragraph[lastKey] = strings.TrimSpace(kv[1])
+		}
+	}
+	if len(paragraph) > 0 {
+		paragraphs = append(paragraphs, paragraph)
+	}
+	return paragraphs
+}
+
+func getApkPackages(root string) []sbomPackage {
+	const dbPath = "/lib/apk/db/installed"
+	data, err := ioutil.ReadFile(getPathInRoot(root, dbPath))
+	if err != nil {
+		return nil
+	}
+	var packages []sbomPackage
+	pkg := sbomPackage{pkgType: "apk", location: dbPath}
+	for _, line := range strings.Split(string(data)+"\n", "\n") {
+		if len(line) == 0 {
+			if len(pkg.name) > 0 {
+				packages = append(packages, pkg)
+			}
+			pkg = sbomPackage{pkgType: "apk", location: dbPath}
+			continue
+		}
+		if len(line) < 2 || line[1] != ':' {
+			continue
+		}
+		switch line[0] {
+		case 'P':
+			pkg.name = line[2:]
+		case 'V':
+			pkg.version = line[2:]
+		case 'A':
+			pkg.arch = line[2:]
+		case 'o':
+			pkg.source = line[2:]
+		case 'L':
+			pkg.license = line[2:]
+		}
+	}
+	return packages
+}
+
+func getDpkgPackages(root string) []sbomPackage {
+	dbPaths := []string{"/var/lib/dpkg/status"}
+	entries, _ := ioutil.ReadDir(getPathInRoot(root, "/var/lib/dpkg/status.d"))
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".md5sums") {
+			dbPaths = append(dbPaths, "/var/lib/dpkg/status.d/"+entry.Name())
+		}
+	}
+	var packages []sbomPackage
+	for _, dbPath := range dbPaths {
+		file, err := os.Open(getPathInRoot(root, dbPath))
+		if err != nil {
+			continue
+		}
+		for _, p := range parseControlParagraphs(file) {
+			/* Removed packages whose config files are still around are listed too */
+			if status, ok := p["Status"]; ok && !strings.HasSuffix(status, " installed") {
+				continue
+			}
+			/* Source is the source package's name, with its version if it differs */
+			source := ""
+			if fields := strings.Fields(p["Source"]); len(fields) > 0 {
+				source = fields[0]
+			}
+			packages = append(packages, sbomPackage{name: p["Package"], source: source, version: p["Version"],
+				arch: p["Architecture"], pkgType: "deb", location: dbPath})
+		}
+		file.Close()
+	}
+	return packages
+}
+
+func getRpmPackages(root string) []sbomPackage {
+	var dbPath string
+	for _, path := range []string{"/usr/lib/sysimage/rpm", "/var/lib/rpm"} {
+		for _, db := range []string{"rpmdb.sqlite", "Packages", "Packages.db"} {
+			if _, err := os.Stat(getPathInRoot(root, path+"/"+db)); err == nil && len(dbPath) == 0 {
+				dbPath = path
+			}
+		}
+	}
+	if len(dbPath) == 0 {
+		return nil
+	}
+	rpmPath, err := exec.LookPath("rpm")
+	if err != nil {
+		log.Printf("Found an rpm database in %s, but rpm isn't installed to read it\n", dbPath)
+		return nil
+	}
+	out, err := exec.Command(rpmPath, "--root", root, "--dbpath", dbPath, "-qa", "--queryformat",
+		`%{NAME}\t%|EPOCH?{%{EPOCH}:}:{}|%{VERSION}-%{RELEASE}\t%{ARCH}\t%{LICENSE}\t%{SOURCERPM}\n`).Output()
+	if err != nil {
+		log.Printf("Unable to read rpm database in %s: %v\n", dbPath, err)
+		return nil
+	}
+	var packages []sbomPackage
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 5 || fields[0] == "gpg-pubkey" {
+			continue
+		}
+		/* The source rpm is named <name>-<version>-<release>.src.rpm */
+		source := fields[4]
+		for i := 0; i < 2 && strings.Contains(source, "-"); i++ {
+			source = source[:strings.LastIndex(source, "-")]
+		}
+		packages = append(packages, sbomPackage{name: fields[0], source: source, version: fields[1],
+			arch: fields[2], license: fields[3], pkgType: "rpm", location: dbPath})
+	}
+	return packages
+}
+
+func parseNpmPackage(path string, location string) (sbomPackage, bool) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return sbomPackage{}, false
+	}
+	var manifest struct {
+		Name    string          `json:"name"`
+		Version string          `json:"version"`
+		License json.RawMessage `json:"license"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil || len(manifest.Name) == 0 {
+		return sbomPackage{}, false
+	}
+	pkg := sbomPackage{name: manifest.Name, version: manifest.Version, pkgType: "npm", location: location}
+	/* Old packages have {"type": "MIT", "url": ...} as their license */
+	var license struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(manifest.License, &pkg.license) != nil && json.Unmarshal(manifest.License, &license) == nil {
+		pkg.license = license.Type
+	}
+	return pkg, true
+}
+
+func parsePythonPackage(path string, location string) (sbomPackage, bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		return sbomPackage{}, false
+	}
+	defer file.Close()
+	paragraphs := parseControlParagraphs(io.LimitReader(file, 1024*1024))
+	if len(paragraphs) == 0 || len(paragraphs[0]["Name"]) == 0 {
+		return sbomPackage{}, false
+	}
+	p := paragraphs[0]
+	license := p["License-Expression"]
+	if len(license) == 0 && !strings.Contains(p["License"], "\n") {
+		license = p["License"]
+	}
+	return sbomPackage{name: p["Name"], version: p["Version"], license: license,
+		pkgType: "pypi", location: location}, true
+}
+
+var gemspecName = regexp.MustCompile(`^(.+?)-([0-9][^-]*)(-.+)?\.gemspec$`)
+
+/*
+	Walks the file system for the metadata of language packages. Other
+	file systems mounted inside a container, like /proc, are skipped.
+*/
+
+func getLanguagePackages(root string) []sbomPackage {
+	var rootStat syscall.Stat_t
+	if err := syscall.Stat(root, &rootStat); err != nil {
+		return nil
+	}
+	var packages []sbomPackage
+	_ = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Dev != rootStat.Dev {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		location := "/" + strings.TrimPrefix(path, root+"/")
+		dir := filepath.Dir(path)
+		/* Metadata files may be symlinks too */
+		path = getPathInRoot(root, location)
+		var pkg sbomPackage
+		var ok bool
+		switch {
+		case info.Name() == "package.json" && (filepath.Base(filepath.Dir(dir)) == "node_modules" ||
+			filepath.Base(filepath.Dir(filepath.Dir(dir))) == "node_modules" && strings.HasPrefix(filepath.Base(filepath.Dir(dir)), "@")):
+			pkg, ok = parseNpmPackage(path, location)
+		case info.Name() == "METADATA" && strings.HasSuffix(dir, ".dist-info"),
+			info.Name() == "PKG-INFO" && strings.HasSuffix(dir, ".egg-info"):
+			pkg, ok = parsePythonPackage(path, location)
+		case strings.HasSuffix(info.Name(), ".egg-info") && info.Mode().IsRegular():
+			pkg, ok = parsePythonPackage(path, location)
+		case filepath.Base(dir) == "specifications" && strings.HasSuffix(info.Name(), ".gemspec"):
+			if m := gemspecName.FindStringSubmatch(info.Name()); m != nil {
+				pkg, ok = sbomPackage{name: m[1], version: m[2], pkgType: "gem", location: location}, true
+			}
+		}
+		if ok {
+			packages = append(packages, pkg)
+		}
+		return nil
+	})
+	return packages
+}
+
+func getPackageURL(pkg sbomPackage, release osRelease) string {
+	purl := "pkg:" + pkg.pkgType + "/"
+	switch pkg.pkgType {
+	case "apk", "deb", "rpm":
+		purl += url.PathEscape(release["ID"]) + "/" + url.PathEscape(pkg.name)
+	case "npm":
+		if strings.HasPrefix(pkg.name, "@") {
+			purl += "%40" + pkg.name[1:]
+		} else {
+			purl += url.PathEscape(pkg.name)
+		}
+	case "pypi":
+		purl += url.PathEscape(strings.ReplaceAll(strings.ToLower(pkg.name), "_", "-"))
+	default:
+		purl += url.PathEscape(pkg.name)
+	}
+	if len(pkg.version) > 0 {
+		purl += "@" + url.PathEscape(pkg.version)
+	}
+	var qualifiers []string
+	if len(pkg.arch) > 0 {
+		qualifiers = append(qualifiers, "arch="+url.QueryEscape(pkg.arch))
+	}
+	if (pkg.pkgType == "apk" || pkg.pkgType == "deb" || pkg.pkgType == "rpm") && len(release["VERSION_ID"]) > 0 {
+		qualifiers = append(qualifiers, "distro="+url.QueryEscape(release["ID"]+"-"+release["VERSION_ID"]))
+	}
+	if len(qualifiers) > 0 {
+		purl += "?" + strings.Join(qualifiers, "&")
+	}
+	return purl
+}
+
+func newUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Unable to generate UUID: %v\n", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b)
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+/*
+	SPDX wants license expressions made of SPDX license identifiers.
+	Package databases often have free text instead, which we leave out.
+*/
+
+var spdxLicenseID = regexp.MustCompile(`^[A-Za-z0-9.\-]+\+?$`)
+
+func getSPDXLicense(license string) string {
+	tokens := strings.Fields(strings.NewReplacer("(", " ", ")", " ").Replace(license))
+	if len(tokens)%2 == 0 {
+		return "NOASSERTION"
+	}
+	for i, token := range tokens {
+		isOperator := token == "AND" || token == "OR" || token == "WITH"
+		if i%2 == 1 && !isOperator || i%2 == 0 && (isOperator || !spdxLicenseID.MatchString(token)) {
+			return "NOASSERTION"
+		}
+	}
+	return license
+}
+
+func writeSPDX(w io.Writer, subject string, release osRelease, packages []sbomPackage) error {
+	type spdxExternalRef struct {
+		ReferenceCategory string `json:"referenceCategory"`
+		ReferenceType     string `json:"referenceType"`
+		ReferenceLocator  string `json:"referenceLocator"`
+	}
+	type spdxPackage struct {
+		Name             string            `json:"name"`
+		SPDXID           string            `json:"SPDXID"`
+		VersionInfo      string            `json:"versionInfo,omitempty"`
+		DownloadLocation string            `json:"downloadLocation"`
+		FilesAnalyzed    bool              `json:"filesAnalyzed"`
+		LicenseConcluded string            `json:"licenseConcluded"`
+		LicenseDeclared  string            `json:"licenseDeclared"`
+		CopyrightText    string            `json:"copyrightText"`
+		SourceInfo       string            `json:"sourceInfo,omitempty"`
+		ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+	}
+	type spdxRelationship struct {
+		SpdxElementID      string `json:"spdxElementId"`
+		RelationshipType   string `json:"relationshipType"`
+		RelatedSpdxElement string `json:"relatedSpdxElement"`
+	}
+	doc := struct {
+		SPDXVersion       string `json:"spdxVersion"`
+		DataLicense       string `json:"dataLicense"`
+		SPDXID            string `json:"SPDXID"`
+		Name              string `json:"name"`
+		DocumentNamespace string `json:"documentNamespace"`
+		CreationInfo      struct {
+			Created  string   `json:"created"`
+			Creators []string `json:"creators"`
+		} `json:"creationInfo"`
+		Packages      []spdxPackage      `json:"packages"`
+		Relationships []spdxRelationship `json:"relationships"`
+	}{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              subject,
+		DocumentNamespace: "https://github.com/shuveb/containers-the-hard-way/spdx/" + newUUID(),
+	}
+	doc.CreationInfo.Created = time.Now().UTC().Format(time.RFC3339)
+	doc.CreationInfo.Creators = []string{"Tool: gocker"}
+
+	doc.Packages = append(doc.Packages, spdxPackage{Name: subject, SPDXID: "SPDXRef-Root",
+		DownloadLocation: "NOASSERTION", LicenseConcluded: "NOASSERTION", LicenseDeclared: "NOASSERTION",
+		CopyrightText: "NOASSERTION"})
+	doc.Relationships = append(doc.Relationships, spdxRelationship{"SPDXRef-DOCUMENT", "DESCRIBES", "SPDXRef-Root"})
+	for i, pkg := range packages {
+		id := fmt.Sprintf("SPDXRef-Package-%d", i+1)
+		doc.Packages = append(doc.Packages, spdxPackage{
+			Name:             pkg.name,
+			SPDXID:           id,
+			VersionInfo:      pkg.version,
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  getSPDXLicense(pkg.license),
+			CopyrightText:    "NOASSERTION",
+			SourceInfo:       "acquired package info from " + pkg.location,
+			ExternalRefs: []spdxExternalRef{{ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType: "purl", ReferenceLocator: getPackageURL(pkg, release)}},
+		})
+		doc.Relationships = append(doc.Relationships, spdxRelationship{"SPDXRef-Root", "CONTAINS", id})
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(doc)
+}
+
+func writeCycloneDX(w io.Writer, subject string, release osRelease, packages []sbomPackage) error {
+	type cdxLicense struct {
+		License struct {
+			Name string `json:"name"`
+		} `json:"license"`
+	}
+	type cdxProperty struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	type cdxComponent struct {
+		BOMRef     string        `json:"bom-ref,omitempty"`
+		Type       string        `json:"type"`
+		Name       string        `json:"name"`
+		Version    string        `json:"version,omitempty"`
+		PURL       string        `json:"purl,omitempty"`
+		Licenses   []cdxLicense  `json:"licenses,omitempty"`
+		Properties []cdxProperty `json:"properties,omitempty"`
+	}
+	bom := struct {
+		BOMFormat    string `json:"bomFormat"`
+		SpecVersion  string `json:"specVersion"`
+		SerialNumber string `json:"serialNumber"`
+		Version      int    `json:"version"`
+		Metadata     struct {
+			Timestamp string `json:"timestamp"`
+			Tools     []struct {
+				Name string `json:"name"`
+			} `json:"tools"`
+			Component cdxComponent `json:"component"`
+		} `json:"metadata"`
+		Components []cdxComponent `json:"components"`
+	}{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.4",
+		SerialNumber: "urn:uuid:" + newUUID(),
+		Version:      1,
+		Components:   []cdxComponent{},
+	}
+	bom.Metadata.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	bom.Metadata.Tools = append(bom.Metadata.Tools, struct {
+		Name string `json:"name"`
+	}{Name: "gocker"})
+	bom.Metadata.Component = cdxComponent{Type: "container", Name: subject}
+
+	if len(release["ID"]) > 0 {
+		bom.Components = append(bom.Components, cdxComponent{Type: "operating-system",
+			Name: release["ID"], Version: release["VERSION_ID"]})
+	}
+	for _, pkg := range packages {
+		purl := getPackageURL(pkg, release)
+		component := cdxComponent{BOMRef: purl, Type: "library", Name: pkg.name, Version: pkg.version, PURL: purl,
+			Properties: []cdxProperty{{Name: "gocker:location", Value: pkg.location}}}
+		if len(pkg.license) > 0 {
+			var license cdxLicense
+			license.License.Name = pkg.license
+			component.Licenses = []cdxLicense{license}
+		}
+		bom.Components = append(bom.Components, component)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(bom)
+}
+
+/*
+	Mounts the image's layers read-only at dir/mnt. Overlay needs at least
+	two lower directories when there is no upper one, so an empty
+	directory, dir/empty, goes last.
+*/
+
+func mountImageLayers(imageShaHex string, dir string) error {
+	var lowerDirs []string
+	for _, layerDir := range getImageLayerDirs(imageShaHex) {
+		lowerDirs = append([]string{layerDir}, lowerDirs...)
+	}
+	if len(lowerDirs) == 0 {
+		return fmt.Errorf("could not find any layers")
+	}
+	emptyDir := dir + "/empty"
+	if err := createDirsIfDontExist([]string{emptyDir, dir + "/mnt"}); err != nil {
+		return err
+	}
+	return mountOverlay(dir+"/mnt", unix.MS_RDONLY, append(lowerDirs, emptyDir), "")
+}
+
+/*
+	Mounts the image in the temp directory, and returns where, along with
+	a function to unmount it again.
+*/
+
+func mountImageReadOnly(imageShaHex string) (string, func(), error) {
+	tmpPath, err := ioutil.TempDir(getGockerTempPath(), imageShaHex+"-mnt-")
+	if err != nil {
+		return "", nil, err
+	}
+	if err := mountImageLayers(imageShaHex, tmpPath); err != nil {
+		os.RemoveAll(tmpPath)
+		return "", nil, err
+	}
+	mntPath := tmpPath + "/mnt"
+	cleanup := func() {
+		if err := unix.Unmount(mntPath, 0); err != nil {
+			log.Printf("Unable to unmount %s: %v\n", mntPath, err)
+			return
+		}
+		os.RemoveAll(tmpPath)
+	}
+	return mntPath, cleanup, nil
+}
+
+/*
+	Mounts src, a running container's ID or an image, and returns where,
+	along with a name for it and a function to unmount it again.
+*/
+
+func mountPackageSource(src string) (string, string, func()) {
+	if isContainerFSMounted(src) {
+		return getContainerFSHome(src) + "/mnt", src, func() {}
+	}
+	imageShaHex, exists := resolveImage(src)
+	if !exists {
+		log.Fatalf("No such image or running container: %s\n", src)
+	}
+	mntPath, cleanup, err := mountImageReadOnly(imageShaHex)
+	if err != nil {
+		log.Fatalf("Unable to mount image %s: %v\n", imageShaHex, err)
+	}
+	subject := src
+	if imageShaHex == src {
+		if tags := getTagsForHash(imageShaHex); len(tags) > 0 {
+			subject = tags[0]
+		}
+	}
+	return mntPath, subject, cleanup
+}
+
+func getInstalledPackages(root string) []sbomPackage {
+	var packages []sbomPackage
+	packages = append(packages, getApkPackages(root)...)
+	packages = append(packages, getDpkgPackages(root)...)
+	packages = append(packages, getRpmPackages(root)...)
+	packages = append(packages, getLanguagePackages(root)...)
+	sort.SliceStable(packages, func(i, j int) bool {
+		if packages[i].pkgType != packages[j].pkgType {
+			return packages[i].pkgType < packages[j].pkgType
+		}
+		return packages[i].name < packages[j].name
+	})
+	return packages
+}
+
+/*
+	Called for "gocker sbom". src is a running container's ID, or an
+	image.
+*/
+
+func printSBOM(src string, format string, output string) {
+	if !stringInSlice(format, []string{"table", "spdx-json", "cyclonedx-json"}) {
+		log.Fatalf("Unknown format %s, use table, spdx-json or cyclonedx-json\n", format)
+	}
+	root, subject, cleanup := mountPackageSource(src)
+	defer cleanup()
+	release := parseOSRelease(root)
+	packages := getInstalledPackages(root)
+
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "table":
+		fmt.Fprintf(&buf, "%-40s %-32s %s\n", "NAME", "VERSION", "TYPE")
+		for _, pkg := range packages {
+			fmt.Fprintf(&buf, "%-40s %-32s %s\n", pkg.name, pkg.version, pkg.pkgType)
+		}
+	case "spdx-json":
+		err = writeSPDX(&buf, subject, release, packages)
+	case "cyclonedx-json":
+		err = writeCycloneDX(&buf, subject, release, packages)
+	}
+	if err == nil && len(output) > 0 && output != "-" {
+		err = ioutil.WriteFile(output, buf.Bytes(), 0644)
+	} else if err == nil {
+		_, err = os.Stdout.Write(buf.Bytes())
+	}
+	if err != nil {
+		log.Printf("Unable to write SBOM: %v\n", err)
+	}
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+	"gocker scan" matches the packages "gocker sbom" finds against a local
+	database of advisories in the OSV format (https://ossf.github.io/osv-schema/),
+	without going to the network. The database is what OSV exports, as
+	any mix of:
+	- .json or .jsonl files with a single advisory, a list of them or one
+	  per line
+	- .zip files of those, like https://osv-vulnerabilities.storage.googleapis.com/<ecosystem>/all.zip
+	- directories of either
+	By default, everything under /var/lib/gocker/advisories is loaded.
+
+	Distro packages are matched against the ecosystem of the distro the
+	image is built on, like "Debian:12" or "Alpine:v3.18", by their own
+	name or that of the source package they were built from, which is
+	what most distros publish advisories for.
+*/
+
+type osvEvent map[string]string
+
+type osvAffected struct {
+	Package struct {
+		Ecosystem string `json:"ecosystem"`
+		Name      string `json:"name"`
+	} `json:"package"`
+	Ranges []struct {
+		Type   string     `json:"type"`
+		Events []osvEvent `json:"events"`
+	} `json:"ranges"`
+	Versions          []string               `json:"versions"`
+	EcosystemSpecific map[string]interface{} `json:"ecosystem_specific"`
+	DatabaseSpecific  map[string]interface{} `json:"database_specific"`
+}
+
+type osvVulnerability struct {
+	ID        string `json:"id"`
+	Summary   string `json:"summary"`
+	Withdrawn string `json:"withdrawn"`
+	Severity  []struct {
+		Type  string `json:"type"`
+		Score string `json:"score"`
+	} `json:"severity"`
+	Affected         []osvAffected          `json:"affected"`
+	DatabaseSpecific map[string]interface{} `json:"database_specific"`
+}
+
+type scanFinding struct {
+	id       string
+	pkg      sbomPackage
+	fixed    string
+	severity string
+}
+
+var severityRanks = map[string]int{"UNKNOWN": 0, "LOW": 1, "MEDIUM": 2, "HIGH": 3, "CRITICAL": 4}
+
+var osvDistroEcosystems = map[string]string{
+	"alpine":    "Alpine",
+	"wolfi":     "Wolfi",
+	"debian":    "Debian",
+	"ubuntu":    "Ubuntu",
+	"rhel":      "Red Hat",
+	"almalinux": "AlmaLinux",
+	"rocky":     "Rocky Linux",
+	"sles":      "SUSE",
+}
+
+var osvLanguageEcosystems = map[string]string{
+	"npm":  "npm",
+	"pypi": "PyPI",
+	"gem":  "RubyGems",
+}
+
+/*
+	Advisories are looked up by ecosystem, without its version, and
+	package name. PyPI doesn't tell "-" from "_", nor upper from lower
+	case, in package names.
+*/
+
+func getAdvisoryKey(ecosystem string, pkgName string) string {
+	ecosystem = strings.SplitN(ecosystem, ":", 2)[0]
+	if ecosystem == "PyPI" {
+		pkgName = strings.ReplaceAll(strings.ToLower(pkgName), "_", "-")
+	}
+	return ecosystem + "/" + pkgName
+}
+
+type advisoryDB map[string][]*osvVulnerability
+
+func (db advisoryDB) add(vuln *osvVulnerability) {
+	if len(vuln.ID) == 0 || len(vuln.Withdrawn) > 0 {
+		return
+	}
+	seen := make(map[string]bool)
+	for _, affected := range vuln.Affected {
+		key := getAdvisoryKey(affected.Package.Ecosystem, affected.Package.Name)
+		if !seen[key] {
+			seen[key] = true
+			db[key] = append(db[key], vuln)
+		}
+	}
+}
+
+func (db advisoryDB) parse(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var vulns []*osvVulnerability
+		if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '[' {
+			if err := json.Unmarshal(raw, &vulns); err != nil {
+				return err
+			}
+		} else {
+			vuln := &osvVulnerability{}
+			if err := json.Unmarshal(raw, vuln); err != nil {
+				return err
+			}
+			vulns = []*osvVulnerability{vuln}
+		}
+		for _, vuln := range vulns {
+			db.add(vuln)
+		}
+	}
+}
+
+func isAdvisoryFile(path string) bool {
+	return strings.HasSuffix(path, ".json") || strings.HasSuffix(path, ".jsonl")
+}
+
+func (db advisoryDB) loadZip(path string) error {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	for _, file := range zr.File {
+		if !isAdvisoryFile(file.Name) {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return err
+		}
+		err = db.parse(rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", file.Name, err)
+		}
+	}
+	return nil
+}
+
+func (db advisoryDB) loadFile(path string) error {
+	if strings.HasSuffix(path, ".zip") {
+		return db.loadZip(path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return db.parse(file)
+}
+
+func loadAdvisoryDB(paths []string) advisoryDB {
+	db := make(advisoryDB)
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Fatalf("Unable to read advisory database: %v\n", err)
+		}
+		if !info.IsDir() {
+			if err := db.loadFile(path); err != nil {
+				log.Fatalf("Unable to load advisories from %s: %v\n", path, err)
+			}
+			continue
+		}
+		err = filepath.Walk(path, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() || !isAdvisoryFile(filePath) && !strings.HasSuffix(filePath, ".zip") {
+				return nil
+			}
+			if err := db.loadFile(filePath); err != nil {
+				return fmt.Errorf("%s: %v", filePath, err)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Fatalf("Unable to load advisories from %s: %v\n", path, err)
+		}
+	}
+	return db
+}
+
+/*
+	The OSV ecosystem the packages of an image's distro are in, if we
+	know it.
+*/
+
+func getDistroEcosystem(release osRelease) string {
+	if strings.HasPrefix(release["ID"], "opensuse") {
+		return "openSUSE"
+	}
+	return osvDistroEcosystems[release["ID"]]
+}
+
+/*
+	Distro ecosystems usually carry the distro's version, as in
+	"Debian:12" or "Alpine:v3.18", and advisories for other versions of
+	the distro don't apply. Where what follows isn't a version, as with
+	"Red Hat:enterprise_linux:9::baseos", we can't tell and take it.
+*/
+
+func isEcosystemForRelease(ecosystem string, release osRelease) bool {
+	parts := strings.Split(ecosystem, ":")
+	if len(parts) < 2 {
+		return true
+	}
+	version := strings.TrimPrefix(parts[1], "v")
+	if len(version) == 0 || !isDigit(version[0]) {
+		return true
+	}
+	versionID := release["VERSION_ID"]
+	return versionID == version || strings.HasPrefix(versionID, version+".")
+}
+
+func getEventVersion(event osvEvent) string {
+	for _, kind := range []string{"introduced", "fixed", "last_affected", "limit"} {
+		if version, ok := event[kind]; ok {
+			return version
+		}
+	}
+	return ""
+}
+
+/*
+	Follows the evaluation in the OSV schema: with the events of a range
+	sorted by version, each one the installed version has reached either
+	starts or ends an affected stretch. Returns whether the installed
+	version is affected and, if so, the version that fixed it.
+*/
+
+func isVersionInRange(pkgType string, version string, events []osvEvent) (bool, string) {
+	sorted := append([]osvEvent(nil), events...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := getEventVersion(sorted[i]), getEventVersion(sorted[j])
+		if a == "0" || b == "0" {
+			return a == "0" && b != "0"
+		}
+		return compareVersions(pkgType, a, b) < 0
+	})
+	affected, fixed := false, ""
+	for _, event := range sorted {
+		if introduced, ok := event["introduced"]; ok {
+			if introduced == "0" || compareVersions(pkgType, version, introduced) >= 0 {
+				affected, fixed = true, ""
+			}
+		} else if fixedVersion, ok := event["fixed"]; ok {
+			if compareVersions(pkgType, version, fixedVersion) >= 0 {
+				affected = false
+			} else if affected && len(fixed) == 0 {
+				fixed = fixedVersion
+			}
+		} else if lastAffected, ok := event["last_affected"]; ok {
+			if compareVersions(pkgType, version, lastAffected) > 0 {
+				affected = false
+			}
+		}
+	}
+	return affected, fixed
+}
+
+func isVersionAffected(pkgType string, version string, affected osvAffected) (bool, string) {
+	if stringInSlice(version, affected.Versions) {
+		return true, ""
+	}
+	for _, r := range affected.Ranges {
+		/* GIT ranges are commits, which we can't tell from an installed package */
+		if r.Type != "ECOSYSTEM" && r.Type != "SEMVER" {
+			continue
+		}
+		if ok, fixed := isVersionInRange(pkgType, version, r.Events); ok {
+			return true, fixed
+		}
+	}
+	return false, ""
+}
+
+func normalizeSeverity(severity string) string {
+	switch strings.ToUpper(severity) {
+	case "CRITICAL":
+		return "CRITICAL"
+	case "HIGH", "IMPORTANT":
+		return "HIGH"
+	case "MEDIUM", "MODERATE":
+		return "MEDIUM"
+	case "LOW", "NEGLIGIBLE", "UNIMPORTANT":
+		return "LOW"
+	}
+	return "UNKNOWN"
+}
+
+func roundUpCVSS(score float64) float64 {
+	i := int(math.Round(score * 100000))
+	if i%10000 == 0 {
+		return float64(i) / 100000
+	}
+	return float64(i/10000+1) / 10
+}
+
+/*
+	Works out the base score of a CVSS v3 vector, like
+	CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H, as laid out in the
+	CVSS v3.1 specification.
+*/
+
+func getCVSS3Score(vector string) (float64, bool) {
+	metrics := make(map[string]string)
+	for _, part := range strings.Split(vector, "/")[1:] {
+		if kv := strings.SplitN(part, ":", 2); len(kv) == 2 {
+			metrics[kv[0]] = kv[1]
+		}
+	}
+	changed := metrics["S"] == "C"
+	privileges := map[string]float64{"N": 0.85, "L": 0.62, "H": 0.27}
+	if changed {
+		privileges = map[string]float64{"N": 0.85, "L": 0.68, "H": 0.5}
+	}
+	impacts := map[string]float64{"H": 0.56, "L": 0.22, "N": 0}
+	weights := []struct {
+		metric string
+		values map[string]float64
+	}{
+		{"AV", map[string]float64{"N": 0.85, "A": 0.62, "L": 0.55, "P": 0.2}},
+		{"AC", map[string]float64{"L": 0.77, "H": 0.44}},
+		{"PR", privileges},
+		{"UI", map[string]float64{"N": 0.85, "R": 0.62}},
+		{"C", impacts}, {"I", impacts}, {"A", impacts},
+	}
+	w := make(map[string]float64)
+	for _, weight := range weights {
+		value, ok := weight.values[metrics[weight.metric]]
+		if !ok {
+			return 0, false
+		}
+		w[weight.metric] = value
+	}
+
+	iss := 1 - (1-w["C"])*(1-w["I"])*(1-w["A"])
+	impact := 6.42 * iss
+	if changed {
+		impact = 7.52*(iss-0.029) - 3.25*math.Pow(iss-0.02, 15)
+	}
+	exploitability := 8.22 * w["AV"] * w["AC"] * w["PR"] * w["UI"]
+	if impact <= 0 {
+		return 0, true
+	}
+	if changed {
+		return roundUpCVSS(math.Min(1.08*(impact+exploitability), 10)), true
+	}
+	return roundUpCVSS(math.Min(impact+exploitability, 10)), true
+}
+
+func getScoreSeverity(score float64) string {
+	switch {
+	case score >= 9:
+		return "CRITICAL"
+	case score >= 7:
+		return "HIGH"
+	case score >= 4:
+		return "MEDIUM"
+	case score > 0:
+		return "LOW"
+	}
+	return "UNKNOWN"
+}
+
+/*
+	What the publisher of an advisory rated it goes first, as distros
+	rate how bad something is for their own packages. Failing that, a
+	CVSS score is used.
+*/
+
+func getSeverity(vuln *osvVulnerability, affected osvAffected) string {
+	for _, specific := range []map[string]interface{}{affected.EcosystemSpecific,
+		affected.DatabaseSpecific, vuln.DatabaseSpecific} {
+		if severity, ok := specific["severity"].(string); ok && normalizeSeverity(severity) != "UNKNOWN" {
+			return normalizeSeverity(severity)
+		}
+	}
+	for _, severity := range vuln.Severity {
+		if severity.Type != "CVSS_V3" {
+			if label := normalizeSeverity(severity.Score); label != "UNKNOWN" {
+				return label
+			}
+		}
+	}
+	for _, severity := range vuln.Severity {
+		if severity.Type == "CVSS_V3" {
+			if score, ok := getCVSS3Score(severity.Score); ok {
+				return getScoreSeverity(score)
+			}
+		} else if score, err := strconv.ParseFloat(severity.Score, 64); err == nil {
+			return getScoreSeverity(score)
+		}
+	}
+	return "UNKNOWN"
+}
+
+func getPackageEcosystem(pkg sbomPackage, release osRelease) string {
+	if ecosystem, ok := osvLanguageEcosystems[pkg.pkgType]; ok {
+		return ecosystem
+	}
+	return getDistroEcosystem(release)
+}
+
+func matchAdvisories(db advisoryDB, release osRelease, packages []sbomPackage) []scanFinding {
+	var findings []scanFinding
+	seen := make(map[string]bool)
+	for _, pkg := range packages {
+		ecosystem := getPackageEcosystem(pkg, release)
+		if len(ecosystem) == 0 {
+			continue
+		}
+		pkgNames := []string{pkg.name}
+		if len(pkg.source) > 0 && pkg.source != pkg.name {
+			pkgNames = append(pkgNames, pkg.source)
+		}
+		for _, pkgName := range pkgNames {
+			key := getAdvisoryKey(ecosystem, pkgName)
+			for _, vuln := range db[key] {
+				for _, affected := range vuln.Affected {
+					if getAdvisoryKey(affected.Package.Ecosystem, affected.Package.Name) != key ||
+						!isEcosystemForRelease(affected.Package.Ecosystem, release) {
+						continue
+					}
+					ok, fixed := isVersionAffected(pkg.pkgType, pkg.version, affected)
+					findingKey := vuln.ID + "/" + pkg.pkgType + "/" + pkg.name + "/" + pkg.version + "/" + pkg.location
+					if !ok || seen[findingKey] {
+						continue
+					}
+					seen[findingKey] = true
+					findings = append(findings, scanFinding{id: vuln.ID, pkg: pkg, fixed: fixed,
+						severity: getSeverity(vuln, affected)})
+				}
+			}
+		}
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		if severityRanks[findings[i].severity] != severityRanks[findings[j].severity] {
+			return severityRanks[findings[i].severity] > severityRanks[findings[j].severity]
+		}
+		if findings[i].pkg.name != findings[j].pkg.name {
+			return findings[i].pkg.name < findings[j].pkg.name
+		}
+		return findings[i].id < findings[j].id
+	})
+	return findings
+}
+
+/*
+	Whether anything in findings is at or above failOn, which is what
+	makes "gocker scan --fail-on" exit with an error. Without failOn,
+	nothing is.
+*/
+
+func hasFindingsAtOrAbove(findings []scanFinding, failOn string) bool {
+	if len(failOn) == 0 {
+		return false
+	}
+	for _, finding := range findings {
+		if severityRanks[finding.severity] >= severityRanks[failOn] {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Called for "gocker scan". src is a running container's ID, or an
+	image. Returns false if anything at or above failOn was found.
+*/
+
+func scanImage(src string, dbPaths []string, failOn string) bool {
+	failOn = strings.ToUpper(failOn)
+	if _, ok := severityRanks[failOn]; len(failOn) > 0 && !ok {
+		log.Fatalf("Unknown severity %s, use low, medium, high or critical\n", failOn)
+	}
+	if len(dbPaths) == 0 {
+		dbPaths = []string{getGockerAdvisoriesPath()}
+	}
+	db := loadAdvisoryDB(dbPaths)
+	if len(db) == 0 {
+		log.Fatalf("No advisories found in %s\n", strings.Join(dbPaths, ", "))
+	}
+
+	root, _, cleanup := mountPackageSource(src)
+	defer cleanup()
+	release := parseOSRelease(root)
+	packages := getInstalledPackages(root)
+	if len(getDistroEcosystem(release)) == 0 && len(release["ID"]) > 0 {
+		log.Printf("No advisories are known for %s, only language packages are scanned\n", release["ID"])
+	}
+	findings := matchAdvisories(db, release, packages)
+
+	counts := make(map[string]int)
+	fmt.Printf("%-10s %-22s %-30s %-24s %-24s %s\n", "SEVERITY", "ID", "PACKAGE", "INSTALLED", "FIXED", "TYPE")
+	for _, finding := range findings {
+		fixed := finding.fixed
+		if len(fixed) == 0 {
+			fixed = "-"
+		}
+		fmt.Printf("%-10s %-22s %-30s %-24s %-24s %s\n", finding.severity, finding.id,
+			finding.pkg.name, finding.pkg.version, fixed, finding.pkg.pkgType)
+		counts[finding.severity]++
+	}
+	fmt.Printf("\nTotal: %d (CRITICAL: %d, HIGH: %d, MEDIUM: %d, LOW: %d, UNKNOWN: %d)\n", len(findings),
+		counts["CRITICAL"], counts["HIGH"], counts["MEDIUM"], counts["LOW"], counts["UNKNOWN"])
+	return !hasFindingsAtOrAbove(findings, failOn)
+}
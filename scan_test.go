@@ -0,0 +1,191 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsVersionInRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		pkgType  string
+		version  string
+		events   []osvEvent
+		affected bool
+		fixedBy  string
+	}{
+		{"before introduced", "", "0.9", []osvEvent{{"introduced": "1.0"}, {"fixed": "1.5"}}, false, ""},
+		{"at introduced", "", "1.0", []osvEvent{{"introduced": "1.0"}, {"fixed": "1.5"}}, true, "1.5"},
+		{"just before fixed", "", "1.4.9", []osvEvent{{"introduced": "1.0"}, {"fixed": "1.5"}}, true, "1.5"},
+		{"at fixed", "", "1.5", []osvEvent{{"introduced": "1.0"}, {"fixed": "1.5"}}, false, ""},
+		{"never fixed", "", "9.0", []osvEvent{{"introduced": "0"}}, true, ""},
+		{"at last affected", "", "1.2.3", []osvEvent{{"introduced": "0"}, {"last_affected": "1.2.3"}}, true, ""},
+		{"after last affected", "", "1.2.4", []osvEvent{{"introduced": "0"}, {"last_affected": "1.2.3"}}, false, ""},
+		{"before last affected", "", "1.0", []osvEvent{{"introduced": "0"}, {"last_affected": "1.2.3"}}, true, ""},
+		{"last affected, then reintroduced", "", "3.0", []osvEvent{
+			{"introduced": "1.0"}, {"last_affected": "1.4"}, {"introduced": "2.0"},
+		}, true, ""},
+		{"between last affected and reintroduced", "", "1.5", []osvEvent{
+			{"introduced": "1.0"}, {"last_affected": "1.4"}, {"introduced": "2.0"},
+		}, false, ""},
+		/* Events needn't be listed in order */
+		{"first of two stretches", "", "1.0", []osvEvent{
+			{"fixed": "2.3"}, {"introduced": "2.0"}, {"fixed": "1.2"}, {"introduced": "0"},
+		}, true, "1.2"},
+		{"between two stretches", "", "1.5", []osvEvent{
+			{"fixed": "2.3"}, {"introduced": "2.0"}, {"fixed": "1.2"}, {"introduced": "0"},
+		}, false, ""},
+		{"second of two stretches", "", "2.1", []osvEvent{
+			{"fixed": "2.3"}, {"introduced": "2.0"}, {"fixed": "1.2"}, {"introduced": "0"},
+		}, true, "2.3"},
+		/* Versions are compared the way the package's type orders them */
+		{"dpkg pre-release", "deb", "1.0~rc1-1", []osvEvent{{"introduced": "0"}, {"fixed": "1.0-1"}}, true, "1.0-1"},
+		{"dpkg epoch", "deb", "1:0.9-1", []osvEvent{{"introduced": "0"}, {"fixed": "2.0-1"}}, false, ""},
+		{"rpm caret", "rpm", "1.0^git1-1", []osvEvent{{"introduced": "0"}, {"last_affected": "1.0-1"}}, false, ""},
+		{"apk revision", "apk", "1.2.3-r1", []osvEvent{{"introduced": "0"}, {"fixed": "1.2.3-r2"}}, true, "1.2.3-r2"},
+		{"apk patch", "apk", "1.2.3_p1", []osvEvent{{"introduced": "0"}, {"fixed": "1.2.3-r2"}}, false, ""},
+	}
+	for _, test := range tests {
+		affected, fixedBy := isVersionInRange(test.pkgType, test.version, test.events)
+		if affected != test.affected || fixedBy != test.fixedBy {
+			t.Errorf("%s: got (%v, %q), want (%v, %q)", test.name, affected, fixedBy, test.affected, test.fixedBy)
+		}
+	}
+}
+
+/*
+	Scores from the examples in the CVSS v3.1 specification and the
+	NVD's calculator.
+*/
+
+func TestGetCVSS3Score(t *testing.T) {
+	tests := []struct {
+		vector string
+		score  float64
+		valid  bool
+	}{
+		{"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H", 9.8, true},
+		{"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:C/C:H/I:H/A:H", 10.0, true},
+		{"CVSS:3.0/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:N/A:N", 7.5, true},
+		{"CVSS:3.1/AV:N/AC:L/PR:N/UI:R/S:C/C:L/I:L/A:N", 6.1, true},
+		{"CVSS:3.1/AV:L/AC:L/PR:L/UI:N/S:U/C:H/I:H/A:H", 7.8, true},
+		{"CVSS:3.1/AV:N/AC:H/PR:N/UI:N/S:U/C:H/I:N/A:N", 5.9, true},
+		{"CVSS:3.1/AV:N/AC:L/PR:H/UI:R/S:C/C:L/I:L/A:N", 4.8, true},
+		{"CVSS:3.1/AV:P/AC:H/PR:H/UI:R/S:U/C:L/I:N/A:N", 1.6, true},
+		{"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:N/I:N/A:N", 0, true},
+		{"CVSS:3.1/AV:X/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H", 0, false},
+		{"CVSS:3.1/AV:N/AC:L", 0, false},
+	}
+	for _, test := range tests {
+		score, valid := getCVSS3Score(test.vector)
+		if score != test.score || valid != test.valid {
+			t.Errorf("%s: got (%v, %v), want (%v, %v)", test.vector, score, valid, test.score, test.valid)
+		}
+	}
+	/* Round up goes to the next tenth, but not for floating point error below that */
+	for score, want := range map[float64]float64{4.0: 4.0, 4.02: 4.1, 4.00001: 4.1, 4.000001: 4.0, 9.99: 10.0} {
+		if got := roundUpCVSS(score); got != want {
+			t.Errorf("roundUpCVSS(%v) = %v, want %v", score, got, want)
+		}
+	}
+}
+
+/*
+	Advisories as OSV exports them. Debian publishes them for source
+	packages, and for each release of Debian.
+*/
+
+const testAdvisories = `{"id": "DSA-0001-1", "affected": [
+	{"package": {"ecosystem": "Debian:12", "name": "openssl"},
+	 "ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}, {"fixed": "3.0.11-1~deb12u2"}]}]},
+	{"package": {"ecosystem": "Debian:11", "name": "openssl"},
+	 "ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}, {"fixed": "1.1.1w-0+deb11u1"}]}]}],
+	"severity": [{"type": "CVSS_V3", "score": "CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H"}]}
+{"id": "DSA-0002-1", "affected": [
+	{"package": {"ecosystem": "Debian:12", "name": "zlib"},
+	 "ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}, {"last_affected": "1:1.2.13.dfsg-1"}]}],
+	 "database_specific": {"severity": "low"}}],
+	"severity": [{"type": "CVSS_V3", "score": "CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H"}]}
+[{"id": "DSA-0003-1", "withdrawn": "2023-01-01T00:00:00Z", "affected": [
+	{"package": {"ecosystem": "Debian:12", "name": "zlib"},
+	 "ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}]}]}]},
+ {"id": "DSA-0004-1", "affected": [
+	{"package": {"ecosystem": "Debian:12", "name": "zlib"},
+	 "ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}, {"fixed": "1:1.2.13.dfsg-1"}]}]}]},
+ {"id": "PYSEC-0001", "affected": [
+	{"package": {"ecosystem": "PyPI", "name": "Typing_Extensions"},
+	 "ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "4.0"}, {"fixed": "4.5.post1"}]}]}],
+	"severity": [{"type": "CVSS_V3", "score": "CVSS:3.1/AV:N/AC:H/PR:N/UI:N/S:U/C:H/I:N/A:N"}]},
+ {"id": "PYSEC-0002", "affected": [
+	{"package": {"ecosystem": "PyPI", "name": "requests"},
+	 "ranges": [{"type": "GIT", "events": [{"introduced": "0"}]}], "versions": ["2.0.0"]}]}]
+`
+
+func TestMatchAdvisories(t *testing.T) {
+	db := make(advisoryDB)
+	if err := db.parse(strings.NewReader(testAdvisories)); err != nil {
+		t.Fatal(err)
+	}
+	release := osRelease{"ID": "debian", "VERSION_ID": "12"}
+	packages := []sbomPackage{
+		{name: "libssl3", source: "openssl", version: "3.0.11-1~deb12u1", pkgType: "deb"},
+		{name: "openssl", version: "3.0.11-1~deb12u2", pkgType: "deb"},
+		{name: "zlib1g", source: "zlib", version: "1:1.2.13.dfsg-1", pkgType: "deb"},
+		{name: "typing-extensions", version: "4.5", pkgType: "pypi", location: "/usr/lib/python3/dist-packages"},
+		{name: "requests", version: "2.0.0", pkgType: "pypi"},
+		{name: "requests", version: "2.31.0", pkgType: "pypi", location: "/opt/venv"},
+	}
+	findings := matchAdvisories(db, release, packages)
+
+	/* Most severe first, then by package and ID */
+	want := []struct {
+		id       string
+		pkg      string
+		fixed    string
+		severity string
+	}{
+		{"DSA-0001-1", "libssl3", "3.0.11-1~deb12u2", "CRITICAL"},
+		{"PYSEC-0001", "typing-extensions", "4.5.post1", "MEDIUM"},
+		{"DSA-0002-1", "zlib1g", "", "LOW"},
+		{"PYSEC-0002", "requests", "", "UNKNOWN"},
+	}
+	if len(findings) != len(want) {
+		for _, finding := range findings {
+			t.Logf("found %s in %s %s", finding.id, finding.pkg.name, finding.pkg.version)
+		}
+		t.Fatalf("got %d findings, want %d", len(findings), len(want))
+	}
+	for i, finding := range findings {
+		if finding.id != want[i].id || finding.pkg.name != want[i].pkg ||
+			finding.fixed != want[i].fixed || finding.severity != want[i].severity {
+			t.Errorf("finding %d is %s in %s, fixed by %q, %s; want %s in %s, fixed by %q, %s", i,
+				finding.id, finding.pkg.name, finding.fixed, finding.severity,
+				want[i].id, want[i].pkg, want[i].fixed, want[i].severity)
+		}
+	}
+
+	tests := []struct {
+		failOn string
+		fails  bool
+	}{
+		{"", false},
+		{"CRITICAL", true},
+		{"HIGH", true},
+		{"LOW", true},
+	}
+	for _, test := range tests {
+		if got := hasFindingsAtOrAbove(findings, test.failOn); got != test.fails {
+			t.Errorf("--fail-on %q: got %v, want %v", test.failOn, got, test.fails)
+		}
+	}
+	/* Without the critical openssl finding, only the medium one and below are left */
+	if hasFindingsAtOrAbove(findings[1:], "HIGH") {
+		t.Error("--fail-on HIGH fails on findings that are at most MEDIUM")
+	}
+	if !hasFindingsAtOrAbove(findings[1:], "MEDIUM") {
+		t.Error("--fail-on MEDIUM passes with a MEDIUM finding")
+	}
+	if hasFindingsAtOrAbove(nil, "LOW") {
+		t.Error("--fail-on LOW fails without findings")
+	}
+}
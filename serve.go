@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+	"gocker registry serve" serves the images in our store, read-only,
+	over the parts of the OCI distribution API that pulling needs:
+
+	GET /v2/                             API version check
+	GET /v2/_catalog                     image names
+	GET /v2/<name>/tags/list             tags of an image
+	GET /v2/<name>/manifests/<ref>       manifest by tag or digest
+	GET /v2/<name>/blobs/<digest>        config or layer
+
+	Images are served under the names we store them by, so ubuntu:20.04
+	is pulled as <host:port>/ubuntu:20.04. As with "gocker push", layers
+	are packed from what is stored under images/<hash>/<layer>/fs, which
+	is slow, so an image is packed the first time it is asked for and its
+	manifest and blobs are kept in a temporary directory until the server
+	exits. Each image is packed once, while requests for other images go
+	on being served. Blobs are only served under the names of the images
+	they are part of.
+*/
+
+type servedImage struct {
+	once           sync.Once
+	err            error
+	manifest       []byte
+	manifestDigest v1.Hash
+	mediaType      types.MediaType
+	blobs          map[v1.Hash]int64
+}
+
+type imageServer struct {
+	blobsDir string
+	mu       sync.Mutex
+	images   map[string]*servedImage
+}
+
+type registryError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeRegistryError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string][]registryError{
+		"errors": {{Code: code, Message: message}},
+	})
+}
+
+func writeRegistryJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+/*
+	Clients ask for Docker Hub images without the library/ prefix we
+	drop from their names too, but may add it.
+*/
+
+func getServedImageTags(imgName string) map[string]string {
+	idb := imagesDB{}
+	parseImagesMetadata(&idb)
+	tags := make(map[string]string)
+	for tag, imageShaHex := range idb[strings.TrimPrefix(imgName, "library/")] {
+		/* Tags like sha256:... are images we pulled by digest */
+		if !strings.Contains(tag, ":") {
+			tags[tag] = imageShaHex
+		}
+	}
+	return tags
+}
+
+/*
+	Images packed at the same time may share layers, so blobs are written
+	under a name of their own and renamed into place.
+*/
+
+func (s *imageServer) storeBlob(si *servedImage, digest v1.Hash, r io.Reader) error {
+	file, err := ioutil.TempFile(s.blobsDir, digest.Hex+"-")
+	if err != nil {
+		return err
+	}
+	size, err := io.Copy(file, r)
+	file.Close()
+	if err == nil {
+		err = os.Rename(file.Name(), s.blobsDir+"/"+digest.Hex)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	si.blobs[digest] = size
+	return nil
+}
+
+/*
+	Returns the image with imageShaHex, packing it unless we already did.
+	The lock is only held to find the image, so that packing one image
+	doesn't hold up requests for others. Those for the same image wait
+	for it to be packed. An image that couldn't be packed is tried again
+	the next time it is asked for.
+*/
+
+func (s *imageServer) getImage(imageShaHex string) (*servedImage, error) {
+	s.mu.Lock()
+	si, ok := s.images[imageShaHex]
+	if !ok {
+		si = &servedImage{blobs: make(map[v1.Hash]int64)}
+		s.images[imageShaHex] = si
+	}
+	s.mu.Unlock()
+
+	si.once.Do(func() {
+		si.err = s.packImage(imageShaHex, si)
+	})
+	if si.err != nil {
+		s.mu.Lock()
+		if s.images[imageShaHex] == si {
+			delete(s.images, imageShaHex)
+		}
+		s.mu.Unlock()
+		return nil, si.err
+	}
+	return si, nil
+}
+
+/*
+	Packs the image with imageShaHex and stores its config and layers
+	as blobs.
+*/
+
+func (s *imageServer) packImage(imageShaHex string, si *servedImage) error {
+	img, cleanup, err := packStoredImage(imageShaHex)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return err
+		}
+		rc, err := layer.Compressed()
+		if err != nil {
+			return err
+		}
+		err = s.storeBlob(si, digest, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	rawConfig, err := img.RawConfigFile()
+	if err != nil {
+		return err
+	}
+	configDigest, err := img.ConfigName()
+	if err != nil {
+		return err
+	}
+	if err := s.storeBlob(si, configDigest, bytes.NewReader(rawConfig)); err != nil {
+		return err
+	}
+
+	if si.manifest, err = img.RawManifest(); err != nil {
+		return err
+	}
+	if si.manifestDigest, err = img.Digest(); err != nil {
+		return err
+	}
+	if si.mediaType, err = img.MediaType(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *imageServer) serveCatalog(w http.ResponseWriter) {
+	idb := imagesDB{}
+	parseImagesMetadata(&idb)
+	repositories := []string{}
+	for imgName := range idb {
+		if len(getServedImageTags(imgName)) > 0 {
+			repositories = append(repositories, imgName)
+		}
+	}
+	sort.Strings(repositories)
+	writeRegistryJSON(w, map[string][]string{"repositories": repositories})
+}
+
+func (s *imageServer) serveTags(w http.ResponseWriter, imgName string) {
+	tags := []string{}
+	for tag := range getServedImageTags(imgName) {
+		tags = append(tags, tag)
+	}
+	if len(tags) == 0 {
+		writeRegistryError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository name not known to registry")
+		return
+	}
+	sort.Strings(tags)
+	writeRegistryJSON(w, map[string]interface{}{"name": imgName, "tags": tags})
+}
+
+/*
+	A manifest asked for by digest is one of those we serve for the
+	image's tags, so we have to pack those to find it.
+*/
+
+func (s *imageServer) serveManifest(w http.ResponseWriter, r *http.Request, imgName string, reference string) {
+	tags := getServedImageTags(imgName)
+	var imageHashes []string
+	if imageShaHex, ok := tags[reference]; ok {
+		imageHashes = []string{imageShaHex}
+	} else if strings.HasPrefix(reference, "sha256:") {
+		for _, imageShaHex := range tags {
+			imageHashes = append(imageHashes, imageShaHex)
+		}
+	}
+	for _, imageShaHex := range imageHashes {
+		si, err := s.getImage(imageShaHex)
+		if err != nil {
+			log.Printf("Unable to serve image %s: %v\n", imageShaHex, err)
+			writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+			return
+		}
+		if strings.HasPrefix(reference, "sha256:") && si.manifestDigest.String() != reference {
+			continue
+		}
+		w.Header().Set("Content-Type", string(si.mediaType))
+		w.Header().Set("Content-Length", fmt.Sprint(len(si.manifest)))
+		w.Header().Set("Docker-Content-Digest", si.manifestDigest.String())
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(si.manifest)
+		}
+		return
+	}
+	writeRegistryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+}
+
+/*
+	Blobs are stored when their image's manifest is first asked for,
+	which clients do before fetching blobs. If we were restarted in
+	between, the image's tags are packed again to find the blob. Only
+	the blobs of the images tagged with imgName are served under it.
+*/
+
+func (s *imageServer) serveBlob(w http.ResponseWriter, r *http.Request, imgName string, digestStr string) {
+	digest, err := v1.NewHash(digestStr)
+	if err != nil {
+		writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return
+	}
+	var size int64
+	ok := false
+	for _, imageShaHex := range getServedImageTags(imgName) {
+		si, err := s.getImage(imageShaHex)
+		if err != nil {
+			log.Printf("Unable to serve image %s: %v\n", imageShaHex, err)
+			continue
+		}
+		if size, ok = si.blobs[digest]; ok {
+			break
+		}
+	}
+	if !ok {
+		writeRegistryError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to registry")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", fmt.Sprint(size))
+	w.Header().Set("Docker-Content-Digest", digest.String())
+	if r.Method != http.MethodGet {
+		return
+	}
+	file, err := os.Open(s.blobsDir + "/" + digest.Hex)
+	if err != nil {
+		log.Printf("Unable to open blob %s: %v\n", digest, err)
+		return
+	}
+	defer file.Close()
+	_, _ = io.Copy(w, file)
+}
+
+/*
+	Both "gocker registry serve" and "gocker registry proxy" answer the
+	same read-only subset of the API, and only differ in where they get
+	what they serve from.
+*/
+
+type registryHandler interface {
+	serveCatalog(w http.ResponseWriter)
+	serveTags(w http.ResponseWriter, imgName string)
+	serveManifest(w http.ResponseWriter, r *http.Request, imgName string, reference string)
+	serveBlob(w http.ResponseWriter, r *http.Request, imgName string, digestStr string)
+}
+
+func serveRegistryAPI(h registryHandler, w http.ResponseWriter, r *http.Request) {
+	log.Printf("%s %s\n", r.Method, r.URL.Path)
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeRegistryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "this registry is read-only")
+		return
+	}
+
+	path := r.URL.Path
+	switch {
+	case path == "/v2/" || path == "/v2":
+		writeRegistryJSON(w, struct{}{})
+	case path == "/v2/_catalog":
+		h.serveCatalog(w)
+	case strings.HasPrefix(path, "/v2/") && strings.HasSuffix(path, "/tags/list"):
+		h.serveTags(w, strings.TrimSuffix(strings.TrimPrefix(path, "/v2/"), "/tags/list"))
+	case strings.HasPrefix(path, "/v2/") && strings.Contains(path, "/manifests/"):
+		i := strings.LastIndex(path, "/manifests/")
+		h.serveManifest(w, r, path[len("/v2/"):i], path[i+len("/manifests/"):])
+	case strings.HasPrefix(path, "/v2/") && strings.Contains(path, "/blobs/"):
+		i := strings.LastIndex(path, "/blobs/")
+		h.serveBlob(w, r, path[len("/v2/"):i], path[i+len("/blobs/"):])
+	default:
+		writeRegistryError(w, http.StatusNotFound, "NOT_FOUND", "not found")
+	}
+}
+
+func (s *imageServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serveRegistryAPI(s, w, r)
+}
+
+/*
+	Called for "gocker registry serve". Runs until interrupted.
+*/
+
+func serveRegistry(addr string) {
+	blobsDir, err := ioutil.TempDir(getGockerTempPath(), "registry-")
+	if err != nil {
+		log.Fatalf("Unable to create temporary directory: %v\n", err)
+	}
+	/* "gocker image prune" removes temporary files that haven't changed in a while */
+	go func() {
+		for range time.Tick(staleTempAge / 4) {
+			now := time.Now()
+			_ = os.Chtimes(blobsDir, now, now)
+		}
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		os.RemoveAll(blobsDir)
+		os.Exit(0)
+	}()
+
+	server := &imageServer{
+		blobsDir: blobsDir,
+		images:   make(map[string]*servedImage),
+	}
+	log.Printf("Serving local images on %s\n", addr)
+	err = http.ListenAndServe(addr, server)
+	os.RemoveAll(blobsDir)
+	log.Fatalf("Unable to serve registry: %v\n", err)
+}
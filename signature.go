@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	Which images need to be signed, and by whom, is set in
+	/etc/gocker/policy.json:
+	{
+		"default": [],
+		"repositories": {
+			"registry.example.com": ["keys/release.pub"],
+			"docker.io/library/alpine": ["/etc/gocker/keys/alpine.pub"]
+		}
+	}
+	An image has to be signed by one of the keys listed for the most
+	specific entry its repository falls under, or by one of the "default"
+	keys if there is none. An empty list means images needn't be signed.
+	Keys are PEM encoded public keys. Relative paths are relative to
+	/etc/gocker.
+
+	Signatures are the ones cosign stores in the registry, as an image
+	tagged sha256-<digest>.sig in the same repository as the image they
+	sign. Each of its layers is a payload naming the digest it signs,
+	with the signature of the payload in the layer's annotations.
+*/
+
+const cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+const cosignSignatureType = "cosign container image signature"
+
+type signaturePolicy struct {
+	Default      []string            `json:"default"`
+	Repositories map[string][]string `json:"repositories"`
+}
+
+type simpleSigningPayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+func parseSignaturePolicy() signaturePolicy {
+	policy := signaturePolicy{}
+	data, err := ioutil.ReadFile(getGockerConfigPath() + "/policy.json")
+	if os.IsNotExist(err) {
+		return policy
+	} else if err != nil {
+		log.Fatalf("Could not read signature policy: %v\n", err)
+	}
+	if err := json.Unmarshal(data, &policy); err != nil {
+		log.Fatalf("Unable to parse signature policy: %v\n", err)
+	}
+	return policy
+}
+
+/*
+	Policy entries are written the way users write image names, so
+	"docker.io/library/alpine" has to match index.docker.io/library/alpine.
+*/
+
+func normalizePolicyScope(scope string) string {
+	if strings.Contains(scope, "/") {
+		if repo, err := name.NewRepository(scope); err == nil {
+			return repo.Name()
+		}
+	} else if reg, err := name.NewRegistry(scope); err == nil {
+		return reg.Name()
+	}
+	return scope
+}
+
+func getRequiredKeys(repo name.Repository) []string {
+	policy := parseSignaturePolicy()
+	keys, matched := policy.Default, ""
+	for scope, scopeKeys := range policy.Repositories {
+		scope = normalizePolicyScope(scope)
+		if (repo.Name() == scope || strings.HasPrefix(repo.Name(), scope+"/")) && len(scope) > len(matched) {
+			keys, matched = scopeKeys, scope
+		}
+	}
+	return keys
+}
+
+func loadPublicKey(path string) (crypto.PublicKey, string, error) {
+	if !filepath.IsAbs(path) {
+		path = getGockerConfigPath() + "/" + path
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, "", fmt.Errorf("no PEM data in %s", path)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, "", err
+	}
+	fingerprint := sha256.Sum256(block.Bytes)
+	return pub, "sha256:" + hex.EncodeToString(fingerprint[:]), nil
+}
+
+func verifySignature(pub crypto.PublicKey, payload []byte, sig []byte) bool {
+	digest := sha256.Sum256(payload)
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		var esig struct{ R, S *big.Int }
+		if rest, err := asn1.Unmarshal(sig, &esig); err != nil || len(rest) > 0 {
+			return false
+		}
+		return ecdsa.Verify(key, digest[:], esig.R, esig.S)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, payload, sig)
+	}
+	return false
+}
+
+/*
+	Returns the payloads and signatures stored in repo for digest. An
+	image without signatures has no signature image to fetch.
+*/
+
+func fetchImageSignatures(repo name.Repository, digest v1.Hash) ([][]byte, [][]byte, error) {
+	sigRef := repo.Tag(digest.Algorithm + "-" + digest.Hex + ".sig")
+	sigImg, err := remote.Image(sigRef, getRemoteOptions(repo.Registry)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	sigManifest, err := sigImg.Manifest()
+	if err != nil {
+		return nil, nil, err
+	}
+	var payloads, sigs [][]byte
+	for _, desc := range sigManifest.Layers {
+		sig, err := base64.StdEncoding.DecodeString(desc.Annotations[cosignSignatureAnnotation])
+		if err != nil || len(sig) == 0 {
+			continue
+		}
+		layer, err := sigImg.LayerByDigest(desc.Digest)
+		if err != nil {
+			return nil, nil, err
+		}
+		rc, err := layer.Compressed()
+		if err != nil {
+			return nil, nil, err
+		}
+		payload, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		payloads = append(payloads, payload)
+		sigs = append(sigs, sig)
+	}
+	return payloads, sigs, nil
+}
+
+func isPayloadFor(payload []byte, repo name.Repository, digest v1.Hash) bool {
+	p := simpleSigningPayload{}
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return false
+	}
+	if p.Critical.Type != cosignSignatureType || p.Critical.Image.DockerManifestDigest != digest.String() {
+		return false
+	}
+	signedRepo, err := name.NewRepository(p.Critical.Identity.DockerReference)
+	return err == nil && signedRepo.Name() == repo.Name()
+}
+
+/*
+	Checks that one of keys signed the image with digest as an image of
+	repo, and returns the fingerprint of the key that did. The signatures
+	are fetched from sigRepo, which is repo or a mirror of it.
+*/
+
+func verifyDigestSignatures(sigRepo name.Repository, repo name.Repository, digest v1.Hash,
+	keys []string) (string, error) {
+	payloads, sigs, err := fetchImageSignatures(sigRepo, digest)
+	if err != nil {
+		return "", fmt.Errorf("no signatures found for %s@%s: %v", repo.Name(), digest, err)
+	}
+	for _, keyPath := range keys {
+		pub, fingerprint, err := loadPublicKey(keyPath)
+		if err != nil {
+			return "", fmt.Errorf("unable to load public key %s: %v", keyPath, err)
+		}
+		for i := range payloads {
+			if isPayloadFor(payloads[i], repo, digest) && verifySignature(pub, payloads[i], sigs[i]) {
+				return fingerprint, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%s@%s isn't signed by any of: %s", repo.Name(), digest, strings.Join(keys, ", "))
+}
+
+/*
+	Returns the digests a signature of img, which was resolved from desc,
+	may be for: the image's own and, if desc is the index the image was
+	picked from, the index's, as signing a tag that names a multi-platform
+	image signs the index. The index is the one the image came from, so
+	it lists the image.
+*/
+
+func getSignableDigests(desc *remote.Descriptor, img v1.Image) ([]v1.Hash, error) {
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, err
+	}
+	digests := []v1.Hash{digest}
+	if desc.Digest == digest {
+		return digests, nil
+	}
+	idx, err := desc.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	idxManifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range idxManifest.Manifests {
+		if child.Digest == digest {
+			return append(digests, desc.Digest), nil
+		}
+	}
+	return nil, fmt.Errorf("image %s isn't in index %s", digest, desc.Digest)
+}
+
+/*
+	What we verified a signature for: the repository the image was
+	signed as an image of, and the fingerprint of the key that signed it,
+	e.g. "index.docker.io/library/alpine@sha256:...".
+*/
+
+func getSignatureIdentity(repo name.Repository, fingerprint string) string {
+	return repo.Name() + "@" + fingerprint
+}
+
+/*
+	Checks that one of keys signed img, which was fetched from srcRef for
+	ref and resolved from desc, and returns the identity it was signed
+	with. Signatures name the repository the image was signed for, which
+	is ref's, even when they are fetched from a mirror.
+*/
+
+func checkImageSignatures(ref name.Reference, srcRef name.Reference, desc *remote.Descriptor,
+	img v1.Image, keys []string) (string, error) {
+	digests, err := getSignableDigests(desc, img)
+	if err != nil {
+		return "", err
+	}
+	var lastErr error
+	for _, digest := range digests {
+		fingerprint, err := verifyDigestSignatures(srcRef.Context(), ref.Context(), digest, keys)
+		if err == nil {
+			log.Printf("Verified signature of %s@%s by key %s\n", ref.Context().Name(), digest, fingerprint)
+			return getSignatureIdentity(ref.Context(), fingerprint), nil
+		}
+		lastErr = err
+	}
+	return "", lastErr
+}
+
+/*
+	Refuses img unless the policy's keys for ref signed it, and returns
+	the identity it was signed with. We go by ref for the policy, so that
+	a mirror can't be used to get around it.
+*/
+
+func verifyImageSignatures(ref name.Reference, srcRef name.Reference, desc *remote.Descriptor, img v1.Image) string {
+	keys := getRequiredKeys(ref.Context())
+	if len(keys) == 0 {
+		return ""
+	}
+	identity, err := checkImageSignatures(ref, srcRef, desc, img, keys)
+	if err != nil {
+		log.Fatalf("Refusing to use %s: %v\n", ref.Name(), err)
+	}
+	return identity
+}
+
+/*
+	Images stored locally were verified when pulled. We remember which
+	key signed them for which repository, so we don't have to go to the
+	registry every time we run one, and so that images we didn't pull,
+	pulled before the policy required signatures, or only verified as an
+	image of another repository, don't pass.
+*/
+
+func isSignedByKeys(signedBy []string, repo name.Repository, keys []string) bool {
+	if len(keys) == 0 {
+		return true
+	}
+	for _, keyPath := range keys {
+		_, fingerprint, err := loadPublicKey(keyPath)
+		if err != nil {
+			log.Fatalf("Unable to load public key %s: %v\n", keyPath, err)
+		}
+		if stringInSlice(getSignatureIdentity(repo, fingerprint), signedBy) {
+			return true
+		}
+	}
+	return false
+}
+
+func isImageSignedByKeys(imageShaHex string, repo name.Repository, keys []string) bool {
+	return isSignedByKeys(parseImageDetails(imageShaHex).SignedBy, repo, keys)
+}
+
+func recordImageSignature(imageShaHex string, identity string) {
+	if len(identity) == 0 {
+		return
+	}
+	details := parseImageDetails(imageShaHex)
+	if !stringInSlice(identity, details.SignedBy) {
+		details.SignedBy = append(details.SignedBy, identity)
+		storeImageDetails(imageShaHex, details)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+/*
+	A cosign signature image has the payload it signs as the contents
+	of a layer, uncompressed.
+*/
+
+type payloadLayer struct {
+	data []byte
+}
+
+func (l payloadLayer) Digest() (v1.Hash, error) {
+	hash, _, err := v1.SHA256(bytes.NewReader(l.data))
+	return hash, err
+}
+
+func (l payloadLayer) DiffID() (v1.Hash, error) {
+	return l.Digest()
+}
+
+func (l payloadLayer) Compressed() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(l.data)), nil
+}
+
+func (l payloadLayer) Uncompressed() (io.ReadCloser, error) {
+	return l.Compressed()
+}
+
+func (l payloadLayer) Size() (int64, error) {
+	return int64(len(l.data)), nil
+}
+
+func (l payloadLayer) MediaType() (types.MediaType, error) {
+	return "application/vnd.dev.cosign.simplesigning.v1+json", nil
+}
+
+func startTestRegistry(t *testing.T) (*httptest.Server, string) {
+	server := httptest.NewServer(registry.New(registry.Logger(nullLogger())))
+	return server, strings.TrimPrefix(server.URL, "http://")
+}
+
+func parseTestReference(t *testing.T, ref string) name.Reference {
+	parsed, err := name.ParseReference(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+/*
+	Creates a key pair and writes the public key where loadPublicKey()
+	can find it.
+*/
+
+func createTestKey(t *testing.T, dir string, keyName string) (*ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := dir + "/" + keyName + ".pub"
+	data := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return key, path
+}
+
+/*
+	Signs digest as an image of identity and pushes the signature to
+	sigRepo, the way "cosign sign" does.
+*/
+
+func pushTestSignature(t *testing.T, sigRepo string, identity string, digest v1.Hash, key *ecdsa.PrivateKey) {
+	p := simpleSigningPayload{}
+	p.Critical.Type = cosignSignatureType
+	p.Critical.Identity.DockerReference = identity
+	p.Critical.Image.DockerManifestDigest = digest.String()
+	payload, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(payload)
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigImg, err := mutate.Append(empty.Image, mutate.Addendum{
+		Layer:       payloadLayer{payload},
+		Annotations: map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(sig)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigRef := parseTestReference(t, sigRepo+":"+digest.Algorithm+"-"+digest.Hex+".sig")
+	if err := remote.Write(sigRef, sigImg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getTestImageDigest(t *testing.T, img v1.Image) v1.Hash {
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return digest
+}
+
+func TestImageSignatures(t *testing.T) {
+	server, host := startTestRegistry(t)
+	defer server.Close()
+	mirror, mirrorHost := startTestRegistry(t)
+	defer mirror.Close()
+	dir := createTestDir(t)
+	defer os.RemoveAll(dir)
+	key, keyPath := createTestKey(t, dir, "release")
+	otherKey, otherKeyPath := createTestKey(t, dir, "other")
+	platform := v1.Platform{OS: "linux", Architecture: "amd64"}
+
+	/* One image of each kind, with only the ones meant to pass signed */
+	unsigned := pushTestImage(t, host, "test/unsigned")
+	signed := pushTestImage(t, host, "test/signed")
+	pushTestSignature(t, host+"/test/signed", host+"/test/signed", getTestImageDigest(t, signed), key)
+	wrongKey := pushTestImage(t, host, "test/wrong-key")
+	pushTestSignature(t, host+"/test/wrong-key", host+"/test/wrong-key", getTestImageDigest(t, wrongKey), otherKey)
+	wrongRepo := pushTestImage(t, host, "test/wrong-repo")
+	pushTestSignature(t, host+"/test/wrong-repo", host+"/test/signed", getTestImageDigest(t, wrongRepo), key)
+
+	child, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
+		Add:        child,
+		Descriptor: v1.Descriptor{Platform: &platform},
+	})
+	if err := remote.WriteIndex(parseTestReference(t, host+"/test/index:latest"), idx); err != nil {
+		t.Fatal(err)
+	}
+	idxDigest, err := idx.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushTestSignature(t, host+"/test/index", host+"/test/index", idxDigest, key)
+
+	/* The mirror has the image and its signature, which names the upstream repository */
+	mirrored := pushTestImage(t, host, "test/mirrored")
+	if err := remote.Write(parseTestReference(t, mirrorHost+"/test/mirrored:latest"), mirrored); err != nil {
+		t.Fatal(err)
+	}
+	pushTestSignature(t, mirrorHost+"/test/mirrored", host+"/test/mirrored", getTestImageDigest(t, mirrored), key)
+	mirroredForMirror := pushTestImage(t, host, "test/mirror-identity")
+	if err := remote.Write(parseTestReference(t, mirrorHost+"/test/mirror-identity:latest"), mirroredForMirror); err != nil {
+		t.Fatal(err)
+	}
+	pushTestSignature(t, mirrorHost+"/test/mirror-identity", mirrorHost+"/test/mirror-identity",
+		getTestImageDigest(t, mirroredForMirror), key)
+
+	tests := []struct {
+		name   string
+		ref    string
+		srcRef string
+		keys   []string
+		valid  bool
+	}{
+		{"signed", host + "/test/signed:latest", "", []string{keyPath}, true},
+		{"signed by either key", host + "/test/signed:latest", "", []string{otherKeyPath, keyPath}, true},
+		{"unsigned", host + "/test/unsigned:latest", "", []string{keyPath}, false},
+		{"wrong key", host + "/test/wrong-key:latest", "", []string{keyPath}, false},
+		{"signed for another repository", host + "/test/wrong-repo:latest", "", []string{keyPath}, false},
+		{"index signature", host + "/test/index:latest", "", []string{keyPath}, true},
+		{"index signature, wrong key", host + "/test/index:latest", "", []string{otherKeyPath}, false},
+		{"mirrored pull", host + "/test/mirrored:latest", mirrorHost + "/test/mirrored:latest", []string{keyPath}, true},
+		{"mirrored pull signed for the mirror", host + "/test/mirror-identity:latest",
+			mirrorHost + "/test/mirror-identity:latest", []string{keyPath}, false},
+	}
+	for _, test := range tests {
+		ref := parseTestReference(t, test.ref)
+		srcRef := ref
+		if len(test.srcRef) > 0 {
+			srcRef = parseTestReference(t, test.srcRef)
+		}
+		img, desc, err := getRemoteImage(srcRef, platform)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		identity, err := checkImageSignatures(ref, srcRef, desc, img, test.keys)
+		if test.valid && err != nil {
+			t.Errorf("%s: refused: %v", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: accepted", test.name)
+		} else if test.valid && !isSignedByKeys([]string{identity}, ref.Context(), test.keys) {
+			t.Errorf("%s: signature recorded as %s doesn't count for %s", test.name, identity, ref.Context().Name())
+		}
+	}
+
+	/* What was verified for one repository doesn't count for another */
+	_, fingerprint, err := loadPublicKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedBy := []string{getSignatureIdentity(parseTestReference(t, host+"/test/signed:latest").Context(), fingerprint)}
+	if isSignedByKeys(signedBy, parseTestReference(t, host+"/test/wrong-repo:latest").Context(), []string{keyPath}) {
+		t.Error("signature recorded for test/signed counts for test/wrong-repo")
+	}
+	if !isSignedByKeys(signedBy, parseTestReference(t, host+"/test/signed:other").Context(), []string{keyPath}) {
+		t.Error("signature recorded for test/signed doesn't count for another tag of it")
+	}
+
+	/* An image that isn't in the index can't go by the index's signature */
+	idxImg, idxDesc, err := getRemoteImage(parseTestReference(t, host+"/test/index:latest"), platform)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkImageSignatures(parseTestReference(t, host+"/test/index:latest"),
+		parseTestReference(t, host+"/test/index:latest"), idxDesc, unsigned, []string{keyPath}); err == nil {
+		t.Error("image outside of the index accepted by the index's signature")
+	}
+	if _, err := checkImageSignatures(parseTestReference(t, host+"/test/index:latest"),
+		parseTestReference(t, host+"/test/index:latest"), idxDesc, idxImg, []string{keyPath}); err != nil {
+		t.Errorf("image from the index refused: %v", err)
+	}
+}
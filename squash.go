@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+/*
+	Applies the layer in layerDir on top of those merged into mergedDir
+	so far, the way overlay would stack them. Files are hard linked, as
+	in linkLayerDir(). Whiteouts and opaque directories only matter if
+	there are layers below what we merge, which keepWhiteouts says.
+*/
+
+func mergeLayerDir(layerDir string, mergedDir string, keepWhiteouts bool) error {
+	return filepath.Walk(layerDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(layerDir, path)
+		if err != nil || relPath == "." {
+			return err
+		}
+		dstPath := filepath.Join(mergedDir, relPath)
+		dstInfo, dstErr := os.Lstat(dstPath)
+
+		if isOverlayWhiteout(info) {
+			if err := os.RemoveAll(dstPath); err != nil {
+				return err
+			}
+			if !keepWhiteouts {
+				return nil
+			}
+			return unix.Mknod(dstPath, unix.S_IFCHR, 0)
+		}
+		if !info.IsDir() {
+			if err := os.RemoveAll(dstPath); err != nil {
+				return err
+			}
+			return os.Link(path, dstPath)
+		}
+
+		/* A directory replacing a whiteout hides what was deleted below, like an opaque one */
+		opaque := isOverlayOpaqueDir(path) || dstErr == nil && isOverlayWhiteout(dstInfo)
+		if dstErr == nil && (opaque || !dstInfo.IsDir()) {
+			if err := os.RemoveAll(dstPath); err != nil {
+				return err
+			}
+			dstErr = os.ErrNotExist
+		}
+		if dstErr != nil {
+			if err := os.Mkdir(dstPath, 0755); err != nil {
+				return err
+			}
+		}
+		if err := os.Chmod(dstPath, info.Mode()); err != nil {
+			return err
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			if err := os.Lchown(dstPath, int(stat.Uid), int(stat.Gid)); err != nil {
+				return err
+			}
+		}
+		if opaque && keepWhiteouts {
+			return unix.Lsetxattr(dstPath, overlayOpaqueXattr, []byte("y"), 0)
+		}
+		return nil
+	})
+}
+
+/*
+	Called for "gocker image squash". The layers of the image from the
+	one numbered from, counting from 0 at the bottom, up to the top are
+	merged into a single layer of a new image. The history entries of
+	the merged layers are kept, marked as not having created a layer,
+	and an entry for the squashed layer is added after them.
+*/
+
+func squashImage(src string, from int, dst string) {
+	srcImageShaHex, exists := resolveImage(src)
+	if !exists {
+		log.Fatalf("No such image: %s\n", src)
+	}
+	srcMani := manifest{}
+	if err := parseManifest(getManifestPathForImage(srcImageShaHex), &srcMani); err != nil {
+		log.Fatalf("Unable to read manifest for image %s: %v\n", srcImageShaHex, err)
+	}
+	if len(srcMani) == 0 || len(srcMani[0].Layers) == 0 {
+		log.Fatal("Could not find any layers.")
+	}
+	srcLayers := srcMani[0].Layers
+	if from < 0 || from >= len(srcLayers)-1 {
+		log.Fatalf("Nothing to squash: image %s has %d layers, --from has to be between 0 and %d\n",
+			srcImageShaHex, len(srcLayers), len(srcLayers)-2)
+	}
+	cfg := parseImageConfigFile(srcImageShaHex)
+	if len(cfg.RootFS.DiffIDs) != len(srcLayers) {
+		log.Fatalf("Image %s has %d layers but %d diff IDs\n", srcImageShaHex, len(srcLayers), len(cfg.RootFS.DiffIDs))
+	}
+
+	tmpPath, err := ioutil.TempDir(getGockerTempPath(), "squash-")
+	if err != nil {
+		log.Fatalf("Unable to create temporary directory: %v\n", err)
+	}
+	defer os.RemoveAll(tmpPath)
+	mergedDir := tmpPath + "/fs"
+	doOrDieWithMsg(os.Mkdir(mergedDir, 0755), "Unable to create temporary directory")
+	srcBasePath := getBasePathForImage(srcImageShaHex)
+	for _, layer := range srcLayers[from:] {
+		if err := mergeLayerDir(srcBasePath+"/"+getLayerDirName(layer)+"/fs", mergedDir, from > 0); err != nil {
+			log.Fatalf("Unable to merge layer %s: %v\n", getLayerDirName(layer), err)
+		}
+	}
+	log.Printf("Packing %d layers into one...\n", len(srcLayers)-from)
+	diffID, err := createLayerTarball(mergedDir, nil, tmpPath)
+	if err != nil {
+		log.Fatalf("Unable to pack squashed layer: %v\n", err)
+	}
+	layerFile := diffID + ".tar"
+
+	/* History entries that created a layer go with the layers in order */
+	layer := 0
+	for i := range cfg.History {
+		if cfg.History[i].EmptyLayer {
+			continue
+		}
+		if layer >= from {
+			cfg.History[i].EmptyLayer = true
+		}
+		layer++
+	}
+	/* Like "gocker history", we take layers without history to be the topmost */
+	for ; layer < from; layer++ {
+		cfg.History = append(cfg.History, v1.History{CreatedBy: "<missing>"})
+	}
+	now := v1.Time{Time: time.Now().UTC()}
+	cfg.Created = now
+	cfg.RootFS.DiffIDs = append(cfg.RootFS.DiffIDs[:from:from], v1.Hash{Algorithm: "sha256", Hex: diffID})
+	cfg.History = append(cfg.History, v1.History{
+		Created:   now,
+		CreatedBy: fmt.Sprintf("gocker image squash --from %d %s", from, src),
+		Comment:   fmt.Sprintf("Squashed %d layers of %s", len(srcLayers)-from, srcImageShaHex),
+	})
+	rawConfig, err := json.Marshal(cfg)
+	if err != nil {
+		log.Fatalf("Unable to marshal image config: %v\n", err)
+	}
+	pathConfig := tmpPath + "/config.json"
+	doOrDieWithMsg(ioutil.WriteFile(pathConfig, rawConfig, 0644), "Unable to write image config")
+	configHash := sha256.Sum256(rawConfig)
+	fullImageHex := hex.EncodeToString(configHash[:])
+	imageShaHex := fullImageHex[:12]
+
+	imageBasePath := getBasePathForImage(imageShaHex)
+	doOrDieWithMsg(os.Mkdir(imageBasePath, 0755), "Unable to create image directory")
+	layerTrees, err := linkImageLayers(srcImageShaHex, imageShaHex, srcLayers[:from], cfg.RootFS.DiffIDs)
+	if err != nil {
+		os.RemoveAll(imageBasePath)
+		log.Fatalf("Unable to link layers: %v\n", err)
+	}
+	/* The merged files are links to those of the image's layers already, so we keep them */
+	newLayerDir := imageBasePath + "/" + getLayerDirName(layerFile)
+	_ = os.MkdirAll(newLayerDir, 0755)
+	if err := os.Rename(mergedDir, newLayerDir+"/fs"); err != nil {
+		os.RemoveAll(imageBasePath)
+		log.Fatalf("Unable to move squashed layer: %v\n", err)
+	}
+	entry := manifestEntry{
+		Config: fullImageHex + ".json",
+		Layers: append(append([]string{}, srcLayers[:from]...), layerFile),
+	}
+	storeImageManifest(imageShaHex, pathConfig, entry, layerTrees)
+	if platform := parseImageDetails(srcImageShaHex).Platform; len(platform) > 0 {
+		details := parseImageDetails(imageShaHex)
+		details.Platform = platform
+		storeImageDetails(imageShaHex, details)
+	}
+
+	if len(dst) > 0 {
+		imgName, tagName := getImageNameAndTag(dst)
+		storeImageMetadata(imgName, tagName, imageShaHex)
+		log.Printf("Squashed %s into %s as %s\n", srcImageShaHex, imageShaHex, formatImageNameAndTag(imgName, tagName))
+	} else {
+		log.Printf("Squashed %s into %s\n", srcImageShaHex, imageShaHex)
+	}
+}
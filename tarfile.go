@@ -2,20 +2,116 @@ package main
 
 import (
 	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"golang.org/x/sys/unix"
 	"path/filepath"
+	"strings"
+	"syscall"
 )
 
+/*
+	Image layers mark files deleted from the layers below them with an
+	empty ".wh.<name>" file, and directories whose contents replace those
+	below with a ".wh..wh..opq" file inside them. The overlay file system
+	has its own way of saying the same: a 0/0 character device in place
+	of the deleted file and an xattr on opaque directories. We convert
+	between the two when unpacking and packing layers.
+*/
+
+const whiteoutPrefix = ".wh."
+const whiteoutOpaqueDir = ".wh..wh..opq"
+const overlayOpaqueXattr = "trusted.overlay.opaque"
+
+func createOverlayWhiteout(path string) error {
+	dir, base := filepath.Split(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if base == whiteoutOpaqueDir {
+		return unix.Lsetxattr(dir, overlayOpaqueXattr, []byte("y"), 0)
+	}
+	err := unix.Mknod(filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)), unix.S_IFCHR, 0)
+	if os.IsExist(err) {
+		return nil
+	}
+	return err
+}
+
+func isOverlayWhiteout(info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && info.Mode()&os.ModeCharDevice != 0 && stat.Rdev == 0
+}
+
+func isOverlayOpaqueDir(path string) bool {
+	value := make([]byte, 1)
+	size, err := unix.Lgetxattr(path, overlayOpaqueXattr, value)
+	return err == nil && size == 1 && value[0] == 'y'
+}
+
+/*
+	Layers pulled from registries are gzip compressed, layers from
+	"docker save" aren't. This lets us read both the same way.
+*/
+
+func getDecompressedReader(r io.Reader) (io.Reader, error) {
+	bufReader := bufio.NewReader(r)
+	if magic, err := bufReader.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(bufReader)
+	}
+	return bufReader, nil
+}
+
+/*
+	Returns name, a path in a tarball or an archive's manifest, cleaned
+	up and relative to where the tarball is unpacked. Tarballs can come
+	from anywhere, so absolute paths and ".." are refused outright.
+*/
+
+func getSafeEntryName(name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return "", fmt.Errorf("absolute path %s in tarball", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("path %s in tarball leads out of it", name)
+		}
+	}
+	return filepath.Clean(name), nil
+}
+
+/*
+	Unpacks the tarball into target, converting whiteouts for overlay.
+	Parent directories are looked up in target with resolveInRoot(), so
+	that symlinks, whether the tarball brings them or not, never lead
+	outside of it, and files replace symlinks in their way rather than
+	being written through them.
+*/
+
 func untar(tarball, target string) error {
-	hardLinks := make(map[string]string)
 	reader, err := os.Open(tarball)
 	if err != nil {
 		return err
 	}
 	defer reader.Close()
-	tarReader := tar.NewReader(reader)
+	layerReader, err := getDecompressedReader(reader)
+	if err != nil {
+		return err
+	}
+	return untarReader(layerReader, target)
+}
+
+/*
+	Same as untar(), but for an uncompressed tarball read from r.
+*/
+
+func untarReader(r io.Reader, target string) error {
+	hardLinks := make(map[string]string)
+	tarReader := tar.NewReader(r)
 
 	for {
 		header, err := tarReader.Next()
@@ -25,8 +121,28 @@ func untar(tarball, target string) error {
 			return err
 		}
 
-		path := filepath.Join(target, header.Name)
+		name, err := getSafeEntryName(header.Name)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			continue
+		}
+		parent, err := resolveInRoot(target, filepath.Dir(name))
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return err
+		}
+		path := filepath.Join(parent, filepath.Base(name))
 		info := header.FileInfo()
+		if strings.HasPrefix(filepath.Base(path), whiteoutPrefix) {
+			if err := createOverlayWhiteout(path); err != nil {
+				return err
+			}
+			continue
+		}
 
 		switch header.Typeflag {
 		case tar.TypeDir:
@@ -37,14 +153,15 @@ func untar(tarball, target string) error {
 
 		case tar.TypeLink:
 			/* Store details of hard links, which we process finally */
-			linkPath := filepath.Join(target, header.Linkname)
-			linkPath2 := filepath.Join(target, header.Name)
-			hardLinks[linkPath2] = linkPath
+			linkName, err := getSafeEntryName(header.Linkname)
+			if err != nil {
+				return err
+			}
+			hardLinks[name] = linkName
 			continue
 
 		case tar.TypeSymlink:
-			linkPath := filepath.Join(target, header.Name)
-			if err := os.Symlink(header.Linkname, linkPath); err != nil {
+			if err := os.Symlink(header.Linkname, path); err != nil {
 				if os.IsExist(err) {
 					continue
 				}
@@ -53,11 +170,12 @@ func untar(tarball, target string) error {
 			continue
 
 		case tar.TypeReg:
-			/* Ensure any missing directories are created */
-			if _, err := os.Stat(filepath.Dir(path)); os.IsNotExist(err) {
-				os.MkdirAll(filepath.Dir(path), 0755)
+			if existing, err := os.Lstat(path); err == nil && !existing.Mode().IsRegular() && !existing.IsDir() {
+				if err := os.Remove(path); err != nil {
+					return err
+				}
 			}
-			file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
+			file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|unix.O_NOFOLLOW, info.Mode())
 			if os.IsExist(err) {
 				continue
 			}
@@ -76,10 +194,141 @@ func untar(tarball, target string) error {
 	}
 
 	/* To create hard links the targets must exist, so we do this finally */
-	for k, v := range hardLinks {
-		if err := os.Link(v, k); err != nil {
+	for name, linkName := range hardLinks {
+		path, err := resolveLinkInRoot(target, name)
+		if err != nil {
+			return err
+		}
+		linkPath, err := resolveLinkInRoot(target, linkName)
+		if err != nil {
+			return err
+		}
+		if err := os.Link(linkPath, path); err != nil {
 			return err
 		}
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+/*
+	Writes the contents of srcDir as a tarball, with paths relative to
+	srcDir. Files with more than one link are stored once and then as
+	hard links, so that untar() recreates them the same way. Like
+	"tar --one-file-system", we don't descend into other file systems
+	mounted under srcDir, such as a container's /proc. Overlay whiteouts
+	are written out as ".wh." files.
+*/
+
+func tarDirectory(srcDir string, w io.Writer) error {
+	return tarDirectoryWithout(srcDir, nil, w)
+}
+
+/*
+	Like tarDirectory(), but leaves out the paths in excluded, which are
+	relative to srcDir, and whatever is under them.
+*/
+
+func tarDirectoryWithout(srcDir string, excluded []string, w io.Writer) error {
+	tarWriter := tar.NewWriter(w)
+	if err := writeTarEntriesWithout(tarWriter, srcDir, "", excluded); err != nil {
+		return err
+	}
+	return tarWriter.Close()
+}
+
+/*
+	Adds srcPath, and whatever is under it if it is a directory, to the
+	tarball as tarDirectory() does, with name in place of srcPath in the
+	paths. With no name, srcPath itself is left out.
+*/
+
+func writeTarEntries(tarWriter *tar.Writer, srcPath string, name string) error {
+	return writeTarEntriesWithout(tarWriter, srcPath, name, nil)
+}
+
+func writeTarEntriesWithout(tarWriter *tar.Writer, srcPath string, name string, excluded []string) error {
+	excludedPaths := make(map[string]bool)
+	for _, p := range excluded {
+		excludedPaths[strings.TrimPrefix(filepath.Clean("/"+p), "/")] = true
+	}
+	hardLinks := make(map[uint64]string)
+	var srcStat syscall.Stat_t
+	if err := syscall.Lstat(srcPath, &srcStat); err != nil {
+		return err
+	}
+
+	return filepath.Walk(srcPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(srcPath, path)
+		if err != nil || relPath == "." && len(name) == 0 {
+			return err
+		}
+		if excludedPaths[relPath] && info.IsDir() {
+			return filepath.SkipDir
+		} else if excludedPaths[relPath] {
+			return nil
+		}
+		relPath = filepath.Join(name, relPath)
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = relPath
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if isOverlayWhiteout(info) {
+			header = &tar.Header{
+				Name:     filepath.Join(filepath.Dir(relPath), whiteoutPrefix+info.Name()),
+				Mode:     0644,
+				ModTime:  info.ModTime(),
+				Typeflag: tar.TypeReg,
+			}
+		}
+
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() && stat.Nlink > 1 {
+			if target, ok := hardLinks[stat.Ino]; ok {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = target
+				header.Size = 0
+			} else {
+				hardLinks[stat.Ino] = relPath
+			}
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && info.IsDir() && stat.Dev != srcStat.Dev {
+			return filepath.SkipDir
+		}
+		if info.IsDir() && isOverlayOpaqueDir(path) {
+			opaqueHeader := &tar.Header{
+				Name:     header.Name + whiteoutOpaqueDir,
+				Mode:     0644,
+				ModTime:  info.ModTime(),
+				Typeflag: tar.TypeReg,
+			}
+			if err := tarWriter.WriteHeader(opaqueHeader); err != nil {
+				return err
+			}
+		}
+		if header.Typeflag != tar.TypeReg || header.Size == 0 {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tarWriter, file)
+		file.Close()
+		return err
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+/*
+	Looks up name, a user or group name or a numeric ID, in an
+	/etc/passwd or /etc/group style file. Returns the ID and, for
+	/etc/passwd, the user's primary group.
+*/
+
+func lookupIDInFile(path string, name string) (uint32, uint32, error) {
+	id, err := strconv.ParseUint(name, 10, 32)
+	isNumeric := err == nil
+	file, err := os.Open(path)
+	if err != nil {
+		if isNumeric && os.IsNotExist(err) {
+			return uint32(id), 0, nil
+		}
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 3 {
+			continue
+		}
+		if fields[0] != name && !(isNumeric && fields[2] == name) {
+			continue
+		}
+		entryID, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid ID in %s: %s", path, fields[2])
+		}
+		var groupID uint64
+		if len(fields) > 3 {
+			groupID, _ = strconv.ParseUint(fields[3], 10, 32)
+		}
+		return uint32(entryID), uint32(groupID), nil
+	}
+	if isNumeric {
+		return uint32(id), 0, nil
+	}
+	return 0, 0, fmt.Errorf("no entry for %s in %s", name, path)
+}
+
+/*
+	Works out who to run a container's command as, from the "user" or
+	"user:group" of the image's USER. Must be called after we chroot into
+	the container, since it reads the container's /etc/passwd.
+*/
+
+func getContainerUserCredential(user string) (*syscall.Credential, error) {
+	parts := strings.SplitN(user, ":", 2)
+	uid, gid, err := lookupIDInFile("/etc/passwd", parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) > 1 {
+		if gid, _, err = lookupIDInFile("/etc/group", parts[1]); err != nil {
+			return nil, err
+		}
+	}
+	return &syscall.Credential{Uid: uid, Gid: gid}, nil
+}
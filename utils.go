@@ -11,8 +11,16 @@ import (
 const gockerHomePath 		= "/var/lib/gocker"
 const gockerTempPath 		= gockerHomePath + "/tmp"
 const gockerImagesPath 		= gockerHomePath + "/images"
+const gockerBuildCachePath 	= gockerHomePath + "/build-cache"
+const gockerVolumesPath 	= gockerHomePath + "/volumes"
+const gockerQuarantinePath 	= gockerHomePath + "/quarantine"
+const gockerProxyCachePath 	= gockerHomePath + "/proxy-cache"
+const gockerAdvisoriesPath 	= gockerHomePath + "/advisories"
 const gockerContainersPath 	= "/var/run/gocker/containers"
 const gockerNetNsPath 		= "/var/run/gocker/net-ns"
+const gockerMountsPath 		= "/var/run/gocker/mounts"
+const gockerConfigPath 		= "/etc/gocker"
+const gockerCertsPath 		= gockerConfigPath + "/certs.d"
 
 func doOrDie(err error) {
 	if err != nil {
@@ -48,7 +56,8 @@ func createDirsIfDontExist(dirs []string) error {
 }
 
 func initGockerDirs() (err error) {
-	dirs := []string {gockerHomePath, gockerTempPath, gockerImagesPath, gockerContainersPath}
+	dirs := []string {gockerHomePath, gockerTempPath, gockerImagesPath, gockerBuildCachePath,
+		gockerContainersPath, gockerVolumesPath}
 	return createDirsIfDontExist(dirs)
 }
 
@@ -60,6 +69,26 @@ func getGockerImagesPath() string {
 	return gockerImagesPath
 }
 
+func getGockerBuildCachePath() string {
+	return gockerBuildCachePath
+}
+
+func getGockerVolumesPath() string {
+	return gockerVolumesPath
+}
+
+func getGockerQuarantinePath() string {
+	return gockerQuarantinePath
+}
+
+func getGockerProxyCachePath() string {
+	return gockerProxyCachePath
+}
+
+func getGockerAdvisoriesPath() string {
+	return gockerAdvisoriesPath
+}
+
 func getGockerTempPath() string {
 	return gockerTempPath
 }
@@ -72,6 +101,18 @@ func getGockerNetNsPath() string {
 	return gockerNetNsPath
 }
 
+func getGockerMountsPath() string {
+	return gockerMountsPath
+}
+
+func getGockerConfigPath() string {
+	return gockerConfigPath
+}
+
+func getGockerCertsPath() string {
+	return gockerCertsPath
+}
+
 func copyFile(src, dst string) error {
 	in, err := os.Open(src)
 	if err != nil {
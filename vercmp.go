@@ -0,0 +1,406 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/*
+	Each package manager orders versions its own way. These return a
+	negative number, zero or a positive number as a is older than, the
+	same as or newer than b.
+*/
+
+func compareVersions(pkgType string, a string, b string) int {
+	switch pkgType {
+	case "deb":
+		return compareDpkgVersions(a, b)
+	case "rpm":
+		return compareRpmVersions(a, b)
+	case "apk":
+		return compareApkVersions(a, b)
+	}
+	return compareGenericVersions(a, b)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func compareInts(a int, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+/*
+	Compares two strings of digits as numbers, however long they are.
+*/
+
+func compareNumeric(a string, b string) int {
+	a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		return compareInts(len(a), len(b))
+	}
+	return strings.Compare(a, b)
+}
+
+/*
+	dpkg versions are [epoch:]upstream[-revision]. Within each part,
+	runs of non-digits are compared character by character, with letters
+	sorting before everything else and "~" before even the end of the
+	string, so 1.0~rc1 is older than 1.0. Runs of digits are compared as
+	numbers.
+*/
+
+func splitDpkgVersion(v string) (int, string, string) {
+	epoch := 0
+	if i := strings.Index(v, ":"); i >= 0 {
+		epoch, _ = strconv.Atoi(v[:i])
+		v = v[i+1:]
+	}
+	revision := ""
+	if i := strings.LastIndex(v, "-"); i >= 0 {
+		v, revision = v[:i], v[i+1:]
+	}
+	return epoch, v, revision
+}
+
+func dpkgCharOrder(s string, i int) int {
+	if i >= len(s) || isDigit(s[i]) {
+		return 0
+	}
+	switch {
+	case isLetter(s[i]):
+		return int(s[i])
+	case s[i] == '~':
+		return -1
+	}
+	return int(s[i]) + 256
+}
+
+func compareDpkgParts(a string, b string) int {
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		for i < len(a) && !isDigit(a[i]) || j < len(b) && !isDigit(b[j]) {
+			if ac, bc := dpkgCharOrder(a, i), dpkgCharOrder(b, j); ac != bc {
+				return ac - bc
+			}
+			i++
+			j++
+		}
+		if i > len(a) {
+			i = len(a)
+		}
+		if j > len(b) {
+			j = len(b)
+		}
+		si, sj := i, j
+		for i < len(a) && isDigit(a[i]) {
+			i++
+		}
+		for j < len(b) && isDigit(b[j]) {
+			j++
+		}
+		if c := compareNumeric(a[si:i], b[sj:j]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func compareDpkgVersions(a string, b string) int {
+	aEpoch, aUpstream, aRevision := splitDpkgVersion(a)
+	bEpoch, bUpstream, bRevision := splitDpkgVersion(b)
+	if c := compareInts(aEpoch, bEpoch); c != 0 {
+		return c
+	}
+	if c := compareDpkgParts(aUpstream, bUpstream); c != 0 {
+		return c
+	}
+	return compareDpkgParts(aRevision, bRevision)
+}
+
+/*
+	rpm versions are [epoch:]version-release, and each part is compared
+	like rpmvercmp() does: runs of digits and runs of letters are compared
+	in turn, with everything else only separating them. A run of digits
+	is newer than one of letters. "~" sorts before anything, even the
+	end of the string, and "^" after the end of the string but before
+	anything else.
+*/
+
+func splitRpmVersion(v string) (int, string, string) {
+	epoch := 0
+	if i := strings.Index(v, ":"); i >= 0 {
+		epoch, _ = strconv.Atoi(v[:i])
+		v = v[i+1:]
+	}
+	release := ""
+	if i := strings.LastIndex(v, "-"); i >= 0 {
+		v, release = v[:i], v[i+1:]
+	}
+	return epoch, v, release
+}
+
+func rpmvercmp(a string, b string) int {
+	if a == b {
+		return 0
+	}
+	isSeparator := func(c byte) bool {
+		return !isDigit(c) && !isLetter(c) && c != '~' && c != '^'
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		for i < len(a) && isSeparator(a[i]) {
+			i++
+		}
+		for j < len(b) && isSeparator(b[j]) {
+			j++
+		}
+		aTilde, bTilde := i < len(a) && a[i] == '~', j < len(b) && b[j] == '~'
+		if aTilde || bTilde {
+			if !aTilde {
+				return 1
+			}
+			if !bTilde {
+				return -1
+			}
+			i++
+			j++
+			continue
+		}
+		aCaret, bCaret := i < len(a) && a[i] == '^', j < len(b) && b[j] == '^'
+		if aCaret || bCaret {
+			if i >= len(a) {
+				return -1
+			}
+			if j >= len(b) {
+				return 1
+			}
+			if !aCaret {
+				return 1
+			}
+			if !bCaret {
+				return -1
+			}
+			i++
+			j++
+			continue
+		}
+		if i >= len(a) || j >= len(b) {
+			break
+		}
+		si, sj := i, j
+		numeric := isDigit(a[i])
+		matches := isLetter
+		if numeric {
+			matches = isDigit
+		}
+		for i < len(a) && matches(a[i]) {
+			i++
+		}
+		for j < len(b) && matches(b[j]) {
+			j++
+		}
+		if sj == j {
+			if numeric {
+				return 1
+			}
+			return -1
+		}
+		var c int
+		if numeric {
+			c = compareNumeric(a[si:i], b[sj:j])
+		} else {
+			c = strings.Compare(a[si:i], b[sj:j])
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	switch {
+	case i >= len(a) && j >= len(b):
+		return 0
+	case i < len(a):
+		return 1
+	}
+	return -1
+}
+
+func compareRpmVersions(a string, b string) int {
+	aEpoch, aVersion, aRelease := splitRpmVersion(a)
+	bEpoch, bVersion, bRelease := splitRpmVersion(b)
+	if c := compareInts(aEpoch, bEpoch); c != 0 {
+		return c
+	}
+	if c := rpmvercmp(aVersion, bVersion); c != 0 {
+		return c
+	}
+	return rpmvercmp(aRelease, bRelease)
+}
+
+/*
+	apk versions look like 1.2.3a_rc1_p2-r4: numbers separated by dots,
+	an optional letter, suffixes and the package revision. Suffixes
+	_alpha, _beta, _pre and _rc come before the release itself, while
+	_cvs, _svn, _git, _hg and _p come after it.
+*/
+
+var apkSuffixOrder = map[string]int{
+	"alpha": -4, "beta": -3, "pre": -2, "rc": -1,
+	"cvs": 1, "svn": 2, "git": 3, "hg": 4, "p": 5,
+}
+
+type apkVersion struct {
+	numbers  []string
+	letter   byte
+	suffixes []string
+	revision int
+}
+
+func parseApkVersion(v string) apkVersion {
+	parsed := apkVersion{}
+	if i := strings.LastIndex(v, "-r"); i >= 0 {
+		if revision, err := strconv.Atoi(v[i+2:]); err == nil {
+			parsed.revision = revision
+			v = v[:i]
+		}
+	}
+	parts := strings.Split(v, "_")
+	base := parts[0]
+	if len(base) > 0 && isLetter(base[len(base)-1]) {
+		parsed.letter = base[len(base)-1]
+		base = base[:len(base)-1]
+	}
+	parsed.numbers = strings.Split(base, ".")
+	parsed.suffixes = parts[1:]
+	return parsed
+}
+
+func compareApkSuffixes(a []string, b []string) int {
+	for k := 0; k < len(a) || k < len(b); k++ {
+		var aName, bName, aNum, bNum string
+		if k < len(a) {
+			aName = strings.TrimRightFunc(a[k], unicode.IsDigit)
+			aNum = a[k][len(aName):]
+		}
+		if k < len(b) {
+			bName = strings.TrimRightFunc(b[k], unicode.IsDigit)
+			bNum = b[k][len(bName):]
+		}
+		if c := compareInts(apkSuffixOrder[aName], apkSuffixOrder[bName]); c != 0 {
+			return c
+		}
+		if c := compareNumeric(aNum, bNum); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func compareApkVersions(a string, b string) int {
+	av, bv := parseApkVersion(a), parseApkVersion(b)
+	for k := 0; k < len(av.numbers) || k < len(bv.numbers); k++ {
+		if k >= len(av.numbers) {
+			return -1
+		}
+		if k >= len(bv.numbers) {
+			return 1
+		}
+		if c := compareNumeric(av.numbers[k], bv.numbers[k]); c != 0 {
+			return c
+		}
+	}
+	if c := compareInts(int(av.letter), int(bv.letter)); c != 0 {
+		return c
+	}
+	if c := compareApkSuffixes(av.suffixes, bv.suffixes); c != 0 {
+		return c
+	}
+	return compareInts(av.revision, bv.revision)
+}
+
+/*
+	Language packages mostly use semantic versions, or something close
+	to it. Runs of digits compare as numbers and runs of letters as
+	strings. Where one version ends and the other goes on with letters,
+	those mark a pre-release like 1.0.0-rc1 or 1.0rc1, which comes before
+	the release, unless they mark a post-release like 1.0.post1.
+*/
+
+var postReleaseMarkers = []string{"post", "p", "pl", "patch", "r", "rev"}
+
+func splitVersionRuns(v string) []string {
+	var runs []string
+	for i := 0; i < len(v); {
+		j := i
+		switch {
+		case isDigit(v[i]):
+			for j < len(v) && isDigit(v[j]) {
+				j++
+			}
+		case isLetter(v[i]):
+			for j < len(v) && isLetter(v[j]) {
+				j++
+			}
+		default:
+			i++
+			continue
+		}
+		runs = append(runs, strings.ToLower(v[i:j]))
+		i = j
+	}
+	return runs
+}
+
+func compareGenericVersions(a string, b string) int {
+	/* Build metadata doesn't count in semantic versions */
+	a, b = strings.SplitN(a, "+", 2)[0], strings.SplitN(b, "+", 2)[0]
+	aRuns, bRuns := splitVersionRuns(strings.TrimPrefix(a, "v")), splitVersionRuns(strings.TrimPrefix(b, "v"))
+	for k := 0; k < len(aRuns) || k < len(bRuns); k++ {
+		if k >= len(aRuns) || k >= len(bRuns) {
+			sign, rest := 1, aRuns
+			if k >= len(aRuns) {
+				sign, rest = -1, bRuns
+			}
+			if isDigit(rest[k][0]) || stringInSlice(rest[k], postReleaseMarkers) {
+				return sign
+			}
+			return -sign
+		}
+		aNumeric, bNumeric := isDigit(aRuns[k][0]), isDigit(bRuns[k][0])
+		switch {
+		case aNumeric && bNumeric:
+			if c := compareNumeric(aRuns[k], bRuns[k]); c != 0 {
+				return c
+			}
+		case aNumeric:
+			return 1
+		case bNumeric:
+			return -1
+		default:
+			/* A post-release is newer than any pre-release of the same version */
+			aPost, bPost := stringInSlice(aRuns[k], postReleaseMarkers), stringInSlice(bRuns[k], postReleaseMarkers)
+			if aPost != bPost {
+				if aPost {
+					return 1
+				}
+				return -1
+			}
+			if c := strings.Compare(aRuns[k], bRuns[k]); c != 0 {
+				return c
+			}
+		}
+	}
+	return 0
+}
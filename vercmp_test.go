@@ -0,0 +1,164 @@
+package main
+
+import (
+	"testing"
+)
+
+func getSign(c int) int {
+	return compareInts(c, 0)
+}
+
+/*
+	Orderings are checked both ways round, as a comparison that only
+	holds one way is as wrong as one that doesn't hold at all.
+*/
+
+func checkVersionOrder(t *testing.T, pkgType string, a string, b string, want int) {
+	if got := getSign(compareVersions(pkgType, a, b)); got != want {
+		t.Errorf("%s: compare(%q, %q) = %d, want %d", pkgType, a, b, got, want)
+	}
+	if got := getSign(compareVersions(pkgType, b, a)); got != -want {
+		t.Errorf("%s: compare(%q, %q) = %d, want %d", pkgType, b, a, got, -want)
+	}
+}
+
+/*
+	Each list is in ascending order, so every version in it has to come
+	before all those after it.
+*/
+
+func checkVersionChains(t *testing.T, pkgType string, chains [][]string) {
+	for _, chain := range chains {
+		for i := range chain {
+			for j := i + 1; j < len(chain); j++ {
+				checkVersionOrder(t, pkgType, chain[i], chain[j], -1)
+			}
+		}
+	}
+}
+
+/*
+	From dpkg's own tests and the Debian policy manual.
+*/
+
+func TestCompareDpkgVersions(t *testing.T) {
+	checkVersionChains(t, "deb", [][]string{
+		{"1.0~rc1", "1.0", "1.0-1"},
+		{"1.0~~", "1.0~~a", "1.0~", "1.0", "1.0a"},
+		{"1.0-1~bpo1", "1.0-1", "1.0-1.1", "1.0-2"},
+		{"1.0a", "1.0+dfsg", "1.0.1"},
+		{"1:0.9", "1:1.0", "2:0.1"},
+		{"2.0", "1:0.1"},
+		{"1", "a1", "b"},
+		{"1.9", "1.10", "1.100"},
+		{"1.0-2-3", "1.0-3-1"},
+	})
+	tests := []struct {
+		a    string
+		b    string
+		want int
+	}{
+		{"1.0", "1.0", 0},
+		{"0:1.0", "1.0", 0},
+		{"1.002", "1.2", 0},
+		{"1.0-0", "1.0", 0},
+		/* Both indices move in lock-step through runs of non-digits */
+		{"1.a", "1.", 1},
+		{"1.~", "1.", -1},
+		{"1a1", "1a", 1},
+		{"1a", "1a.", -1},
+		{"1.0", "1.0.", -1},
+		{"1~~a", "1~~", 1},
+		{"1+1", "1+a", -1},
+	}
+	for _, test := range tests {
+		checkVersionOrder(t, "deb", test.a, test.b, test.want)
+	}
+}
+
+/*
+	From the tests of rpmvercmp() in rpm.
+*/
+
+func TestCompareRpmVersions(t *testing.T) {
+	checkVersionChains(t, "rpm", [][]string{
+		{"1.0", "2.0"},
+		{"2.0", "2.0.1", "2.0.1a"},
+		{"5.5p1", "5.5p2", "5.5p10", "5.6p1", "6.5p1"},
+		{"10xyz", "10.1xyz"},
+		{"xyz10", "xyz10.1"},
+		{"xyz.4", "2", "8"},
+		{"6.0", "6.0.rc1"},
+		{"10a1", "10a2", "10b2"},
+		{"1.0a", "1.0aa"},
+		{"10.0001", "10.0039"},
+		{"4.999.9", "5.0"},
+		{"20101121", "20101122"},
+		{"1.0~rc1", "1.0~rc2", "1.0"},
+		{"1.0~rc1~git123", "1.0~rc1", "1.0~rc1^git1", "1.0"},
+		{"1.0", "1.0^", "1.0^git1", "1.0^git2", "1.01"},
+		{"1.0", "1.0^20160101", "1.0^20160101^git1", "1.0^20160102", "1.0.1"},
+		{"1.0^git1~pre", "1.0^git1"},
+		{"1.fc4", "1.0"},
+		{"2a", "2.0"},
+		{"1.0-1", "1.0-2", "1.0.1-1", "1:0.1-1"},
+	})
+	tests := []struct {
+		a    string
+		b    string
+		want int
+	}{
+		{"1.0", "1.0", 0},
+		{"10.0001", "10.1", 0},
+		{"2_0", "2.0", 0},
+		{"3.0.0_fc", "3.0.0.fc", 0},
+		{"a+", "a_", 0},
+		{"+a", "_a", 0},
+		{"_+", "+_", 0},
+		{"+", "_", 0},
+		{"1.0~rc1", "1.0~rc1", 0},
+		{"1.0^", "1.0^", 0},
+		{"0:1.0-1", "1.0-1", 0},
+	}
+	for _, test := range tests {
+		checkVersionOrder(t, "rpm", test.a, test.b, test.want)
+	}
+}
+
+/*
+	From apk-tools' version tests. A revision only tells builds of the
+	same upstream version apart, so any suffix or letter outweighs it.
+*/
+
+func TestCompareApkVersions(t *testing.T) {
+	checkVersionChains(t, "apk", [][]string{
+		{"1.2.3_rc1", "1.2.3", "1.2.3-r1", "1.2.3_p1"},
+		{"1.0_alpha", "1.0_beta", "1.0_pre", "1.0_rc", "1.0", "1.0_cvs", "1.0_svn", "1.0_git", "1.0_hg", "1.0_p"},
+		{"1.0_rc", "1.0_rc1", "1.0_rc2", "1.0_rc10"},
+		{"1.0_rc1_pre1", "1.0_rc1", "1.0_rc1_p1"},
+		{"1.0", "1.0-r1", "1.0-r2", "1.0-r10"},
+		{"1.2.3", "1.2.3_p1", "1.2.3a", "1.2.3b", "1.2.4"},
+		{"1.2", "1.2.0", "1.2.1", "1.10"},
+		{"0.9_rc1-r5", "0.9-r0"},
+	})
+	tests := []struct {
+		a    string
+		b    string
+		want int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"1.2.3-r0", "1.2.3", 0},
+	}
+	for _, test := range tests {
+		checkVersionOrder(t, "apk", test.a, test.b, test.want)
+	}
+}
+
+func TestCompareGenericVersions(t *testing.T) {
+	checkVersionChains(t, "npm", [][]string{
+		{"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-beta", "1.0.0-rc.1", "1.0.0", "1.0.1", "1.1.0", "2.0.0"},
+		{"1.9.0", "1.10.0", "v1.11.0"},
+		{"1.0rc1", "1.0", "1.0.post1", "1.1"},
+	})
+	checkVersionOrder(t, "npm", "1.0.0+build.1", "1.0.0+build.2", 0)
+}
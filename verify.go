@@ -0,0 +1,424 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	We don't keep the layer tarballs around, so there is nothing to check
+	a layer's files against later. Instead, when an image is stored, we
+	record every file of each layer, with a digest of its contents, in a
+	tree.json next to the layer's fs directory:
+
+	images/<hash>/<layer>/fs         the unpacked layer
+	images/<hash>/<layer>/tree.json  the files in fs as we stored them
+
+	The digests are taken from the tarball as it is unpacked, the same
+	stream that has to come out to the layer's diff ID, rather than from
+	what ended up on disk. The digest of each tree.json is kept in the
+	image's metadata.json by diff ID, which the config, and so the image
+	ID, covers. "gocker image verify" compares the files against these,
+	and the image config against the digest it is stored under.
+*/
+
+type fileTreeEntry struct {
+	Path   string
+	Mode   os.FileMode
+	Size   int64  `json:",omitempty"`
+	Digest string `json:",omitempty"`
+	Link   string `json:",omitempty"`
+}
+
+func getLayerTreePath(imageShaHex string, layer string) string {
+	return getBasePathForImage(imageShaHex) + "/" + getLayerDirName(layer) + "/tree.json"
+}
+
+func getFileDigest(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func getFileTree(dir string) ([]fileTreeEntry, error) {
+	return getFileTreeWithDigests(dir, nil)
+}
+
+/*
+	Same as getFileTree(), except that the digests of regular files are
+	taken from digests, by their path relative to dir, if it is not nil.
+*/
+
+func getFileTreeWithDigests(dir string, digests map[string]string) ([]fileTreeEntry, error) {
+	var tree []fileTreeEntry
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil || relPath == "." {
+			return err
+		}
+		entry := fileTreeEntry{Path: relPath, Mode: info.Mode()}
+		switch {
+		case info.Mode().IsRegular():
+			entry.Size = info.Size()
+			if digests == nil {
+				if entry.Digest, err = getFileDigest(path); err != nil {
+					return err
+				}
+			} else if entry.Digest = digests[relPath]; len(entry.Digest) == 0 {
+				return fmt.Errorf("%s isn't a file in the layer's tarball", relPath)
+			}
+		case info.Mode()&os.ModeSymlink != 0:
+			if entry.Link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		tree = append(tree, entry)
+		return nil
+	})
+	return tree, err
+}
+
+func getDataDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+/*
+	Writes the tree.json of the layer unpacked in layerDir/fs and returns
+	its digest. Regular files get their digests from digests, when it is
+	not nil, and are read for them otherwise.
+*/
+
+func storeLayerFileTree(layerDir string, digests map[string]string) (string, error) {
+	tree, err := getFileTreeWithDigests(layerDir+"/fs", digests)
+	if err != nil {
+		return "", err
+	}
+	treeBytes, err := json.Marshal(tree)
+	if err != nil {
+		return "", err
+	}
+	return getDataDigest(treeBytes), ioutil.WriteFile(layerDir+"/tree.json", treeBytes, 0644)
+}
+
+/*
+	Copies the tree.json of srcLayer in image srcImageShaHex, the layer
+	with diffID, to dstLayerDir and returns its digest. Returns no digest
+	if the image has none recorded for it, and an error if its tree.json
+	doesn't match the one it has.
+*/
+
+func copyLayerFileTree(srcImageShaHex string, srcLayer string, diffID string, dstLayerDir string) (string, error) {
+	treeDigest, ok := parseImageDetails(srcImageShaHex).LayerTrees[diffID]
+	if !ok {
+		return "", nil
+	}
+	treeBytes, err := ioutil.ReadFile(getLayerTreePath(srcImageShaHex, srcLayer))
+	if err != nil {
+		return "", err
+	}
+	if getDataDigest(treeBytes) != treeDigest {
+		return "", fmt.Errorf("file tree of layer %s doesn't match its digest", diffID)
+	}
+	return treeDigest, ioutil.WriteFile(dstLayerDir+"/tree.json", treeBytes, 0644)
+}
+
+/*
+	Reads a layer tarball for the digests of its regular files, by their
+	cleaned paths, into files. Hard links get the digest of what they
+	link to, once everything has been read, as untar() creates them last.
+*/
+
+func readTarDigests(r io.Reader, files map[string]string) error {
+	hardLinks := make(map[string]string)
+	tarReader := tar.NewReader(r)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(filepath.Clean("/"+header.Name), "/")
+		delete(files, name)
+		delete(hardLinks, name)
+		switch header.Typeflag {
+		case tar.TypeReg:
+			hasher := sha256.New()
+			if _, err := io.Copy(hasher, tarReader); err != nil {
+				return err
+			}
+			files[name] = "sha256:" + hex.EncodeToString(hasher.Sum(nil))
+		case tar.TypeLink:
+			hardLinks[name] = strings.TrimPrefix(filepath.Clean("/"+header.Linkname), "/")
+		}
+	}
+	for name, linkName := range hardLinks {
+		if digest, ok := files[linkName]; ok {
+			files[name] = digest
+		}
+	}
+	return nil
+}
+
+/*
+	What a layer tarball had in it, as it was read: its diff ID and the
+	digests of its regular files.
+*/
+
+type layerDigests struct {
+	diffID string
+	files  map[string]string
+}
+
+/*
+	Returns a reader of r, an uncompressed layer tarball, to unpack it
+	from, and a function to call once that is done for what was read.
+	The function reads what the unpacking left of r, so that the diff ID
+	covers all of it.
+*/
+
+func digestLayerStream(r io.Reader) (io.Reader, func() (layerDigests, error)) {
+	pipeReader, pipeWriter := io.Pipe()
+	hasher := sha256.New()
+	tee := io.TeeReader(r, io.MultiWriter(hasher, pipeWriter))
+	files := make(map[string]string)
+	done := make(chan error)
+	go func() {
+		err := readTarDigests(pipeReader, files)
+		/* The rest still has to be taken off the pipe, whatever it is */
+		io.Copy(ioutil.Discard, pipeReader)
+		done <- err
+	}()
+	return tee, func() (layerDigests, error) {
+		_, err := io.Copy(ioutil.Discard, tee)
+		pipeWriter.CloseWithError(err)
+		if tarErr := <-done; err == nil {
+			err = tarErr
+		}
+		return layerDigests{diffID: "sha256:" + hex.EncodeToString(hasher.Sum(nil)), files: files}, err
+	}
+}
+
+/*
+	Unpacks tarball into layerDir/fs with unpack and, if it is the layer
+	with diffID, writes its tree.json with the digests its files had in
+	the tarball. Returns the digest of the tree.json.
+*/
+
+func unpackLayer(tarball string, layerDir string, diffID string,
+	unpack func(r io.Reader, target string) error) (string, error) {
+	file, err := os.Open(tarball)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	reader, err := getDecompressedReader(file)
+	if err != nil {
+		return "", err
+	}
+	layerReader, finish := digestLayerStream(reader)
+	err = unpack(layerReader, layerDir+"/fs")
+	digests, finishErr := finish()
+	if err == nil {
+		err = finishErr
+	}
+	if err != nil {
+		return "", err
+	}
+	if digests.diffID != diffID {
+		return "", fmt.Errorf("layer has diff ID %s, expected %s", digests.diffID, diffID)
+	}
+	return storeLayerFileTree(layerDir, digests.files)
+}
+
+func compareFileTrees(expected []fileTreeEntry, actual []fileTreeEntry) []string {
+	var problems []string
+	actualByPath := make(map[string]fileTreeEntry)
+	for _, entry := range actual {
+		actualByPath[entry.Path] = entry
+	}
+	for _, want := range expected {
+		got, ok := actualByPath[want.Path]
+		delete(actualByPath, want.Path)
+		if !ok {
+			problems = append(problems, "missing "+want.Path)
+		} else if got != want {
+			problems = append(problems, "changed "+want.Path)
+		}
+	}
+	for _, entry := range actual {
+		if _, ok := actualByPath[entry.Path]; ok {
+			problems = append(problems, "unexpected "+entry.Path)
+		}
+	}
+	return problems
+}
+
+/*
+	Returns what is wrong with the image, if anything. Images stored
+	before we recorded file trees can only have their config checked,
+	and those stored before we recorded the digests of the trees by diff
+	ID have their files checked against trees we can't vouch for.
+*/
+
+func verifyImage(imageShaHex string) []string {
+	var problems []string
+	mani := manifest{}
+	if err := parseManifest(getManifestPathForImage(imageShaHex), &mani); err != nil || len(mani) == 0 {
+		return []string{"unreadable manifest"}
+	}
+	configDigest, err := getFileDigest(getConfigPathForImage(imageShaHex))
+	if err != nil {
+		return []string{"unreadable config"}
+	}
+	expectedConfig := strings.TrimSuffix(mani[0].Config, ".json")
+	if configDigest != "sha256:"+expectedConfig || !strings.HasPrefix(expectedConfig, imageShaHex) {
+		problems = append(problems, fmt.Sprintf("config digest is %s, expected sha256:%s",
+			configDigest, expectedConfig))
+	}
+	treeDigests := parseImageDetails(imageShaHex).LayerTrees
+	cfg := parseImageConfigFile(imageShaHex)
+	if len(cfg.RootFS.DiffIDs) != len(mani[0].Layers) {
+		problems = append(problems, fmt.Sprintf("config has %d diff IDs for %d layers",
+			len(cfg.RootFS.DiffIDs), len(mani[0].Layers)))
+	}
+
+	for i, layer := range mani[0].Layers {
+		layerName := getLayerDirName(layer)
+		if i < len(cfg.RootFS.DiffIDs) {
+			layerName = cfg.RootFS.DiffIDs[i].String()
+		}
+		treeDigest, recorded := treeDigests[layerName]
+		treeBytes, err := ioutil.ReadFile(getLayerTreePath(imageShaHex, layer))
+		if os.IsNotExist(err) {
+			if recorded {
+				problems = append(problems, fmt.Sprintf("layer %s: file tree missing", layerName))
+			} else {
+				log.Printf("No file tree recorded for layer %s, skipping it\n", layerName)
+			}
+			continue
+		}
+		if err == nil {
+			if !recorded {
+				log.Printf("No digest recorded for the file tree of layer %s\n", layerName)
+			} else if getDataDigest(treeBytes) != treeDigest {
+				problems = append(problems, fmt.Sprintf("layer %s: file tree doesn't match its digest", layerName))
+				continue
+			}
+		}
+		var expected []fileTreeEntry
+		if err == nil {
+			err = json.Unmarshal(treeBytes, &expected)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("layer %s: unreadable file tree", layerName))
+			continue
+		}
+		actual, err := getFileTree(getBasePathForImage(imageShaHex) + "/" + getLayerDirName(layer) + "/fs")
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("layer %s: %v", layerName, err))
+			continue
+		}
+		for _, problem := range compareFileTrees(expected, actual) {
+			problems = append(problems, fmt.Sprintf("layer %s: %s", layerName, problem))
+		}
+	}
+	return problems
+}
+
+/*
+	Moves a bad image out of the way, into /var/lib/gocker/quarantine,
+	where it can be looked at, but not run.
+*/
+
+func quarantineImage(imageShaHex string) {
+	if users := getImageUsers(imageShaHex); len(users) > 0 {
+		log.Printf("Not quarantining image %s as it is in use by: %s\n",
+			imageShaHex, strings.Join(users, ", "))
+		return
+	}
+	doOrDieWithMsg(createDirsIfDontExist([]string{getGockerQuarantinePath()}),
+		"Unable to create quarantine directory")
+	dst := getGockerQuarantinePath() + "/" + imageShaHex
+	doOrDieWithMsg(os.RemoveAll(dst), "Unable to remove old quarantined image")
+	doOrDieWithMsg(os.Rename(getBasePathForImage(imageShaHex), dst), "Unable to quarantine image")
+	removeImageMetadata(imageShaHex)
+	log.Printf("Quarantined image %s in %s\n", imageShaHex, dst)
+}
+
+/*
+	Pulls a bad image again by the digest it was pulled by and gives it
+	back its names. Images we didn't pull have no digest to pull by.
+*/
+
+func repullImage(imageShaHex string) {
+	details := parseImageDetails(imageShaHex)
+	if len(details.RepoDigests) == 0 {
+		log.Printf("Image %s wasn't pulled from a registry, quarantining it instead\n", imageShaHex)
+		quarantineImage(imageShaHex)
+		return
+	}
+	tags := getTagsForHash(imageShaHex)
+	deleteImageByHash(imageShaHex)
+	newImageShaHex := downloadImageIfRequired(details.RepoDigests[0], details.Platform)
+	for _, tag := range tags {
+		imgName, tagName := getImageNameAndTag(tag)
+		storeImageMetadata(imgName, tagName, newImageShaHex)
+	}
+	log.Printf("Pulled image %s again from %s\n", newImageShaHex, details.RepoDigests[0])
+}
+
+/*
+	Called for "gocker image verify". Verifies src or, without one, all
+	images, and returns whether they were all fine.
+*/
+
+func verifyImages(src string, quarantine bool, repull bool) bool {
+	imageHashes := getAllImageHashes()
+	if len(src) > 0 {
+		imageShaHex, exists := resolveImage(src)
+		if !exists {
+			log.Fatalf("No such image: %s\n", src)
+		}
+		imageHashes = []string{imageShaHex}
+	}
+	allGood := true
+	for _, imageShaHex := range imageHashes {
+		problems := verifyImage(imageShaHex)
+		if len(problems) == 0 {
+			fmt.Printf("%s: OK\n", imageShaHex)
+			continue
+		}
+		allGood = false
+		fmt.Printf("%s: FAILED\n", imageShaHex)
+		for _, problem := range problems {
+			fmt.Printf("\t%s\n", problem)
+		}
+		if repull {
+			repullImage(imageShaHex)
+		} else if quarantine {
+			quarantineImage(imageShaHex)
+		}
+	}
+	return allGood
+}
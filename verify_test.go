@@ -0,0 +1,62 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestUnpackLayerChecksDiffID(t *testing.T) {
+	dir := createTestDir(t)
+	defer os.RemoveAll(dir)
+	tarball := dir + "/layer.tar"
+	writeTestTarball(t, tarball, []testTarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/hostname", typeflag: tar.TypeReg, body: "layer\n"},
+		{name: "etc/hostname.bak", typeflag: tar.TypeLink, linkname: "etc/hostname"},
+	})
+	diffID, err := getFileDigest(tarball)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layerDir := dir + "/other"
+	if err := os.MkdirAll(layerDir+"/fs", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unpackLayer(tarball, layerDir, getDataDigest(nil), untarReader); err == nil {
+		t.Error("unpacked a layer whose diff ID doesn't match, want an error")
+	}
+
+	layerDir = dir + "/layer"
+	if err := os.MkdirAll(layerDir+"/fs", 0755); err != nil {
+		t.Fatal(err)
+	}
+	treeDigest, err := unpackLayer(tarball, layerDir, diffID, untarReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	treeBytes, err := ioutil.ReadFile(layerDir + "/tree.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getDataDigest(treeBytes) != treeDigest {
+		t.Errorf("tree digest is %s, tree.json has %s", treeDigest, getDataDigest(treeBytes))
+	}
+	var tree []fileTreeEntry
+	if err := json.Unmarshal(treeBytes, &tree); err != nil {
+		t.Fatal(err)
+	}
+	want := getDataDigest([]byte("layer\n"))
+	digests := make(map[string]string)
+	for _, entry := range tree {
+		digests[entry.Path] = entry.Digest
+	}
+	for _, path := range []string{"etc/hostname", "etc/hostname.bak"} {
+		if digests[path] != want {
+			t.Errorf("%s has digest %q, want %s", path, digests[path], want)
+		}
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/*
+	Containers mount host directories, volumes and tmpfs file systems
+	given with "-v" and "--mount", the way Docker does:
+
+	-v /host/path:/path[:ro]                       bind mount of a host path
+	-v name:/path[:ro]                             named volume, created on first use
+	-v /path                                       anonymous volume
+	--mount type=bind|volume|tmpfs,src=,dst=,readonly
+
+	Volumes are directories in /var/lib/gocker/volumes. A new volume gets
+	what the image has where it is mounted. Paths the image declares as
+	VOLUME get an anonymous volume unless something else is mounted
+	there. As containers are removed once they exit, so are their
+	anonymous volumes, while named ones stay for the next container.
+
+	What a container mounts is kept in "mounts.json" in its directory,
+	for "gocker system df" to tell which volumes are in use.
+*/
+
+type containerMount struct {
+	Type      string
+	Source    string
+	Target    string
+	ReadOnly  bool
+	Anonymous bool `json:",omitempty"`
+}
+
+var volumeNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+func getVolumePath(name string) string {
+	return getGockerVolumesPath() + "/" + name
+}
+
+func getContainerMountsPath(containerID string) string {
+	return getGockerContainersPath() + "/" + containerID + "/mounts.json"
+}
+
+/*
+	Parses what "-v" is passed. Anything that isn't a path before the
+	colon is the name of a volume.
+*/
+
+func parseVolumeFlag(spec string) (containerMount, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) == 1 {
+		return containerMount{Type: "volume", Target: parts[0], Anonymous: true}, validateMount(spec, parts[0])
+	}
+	if len(parts) > 3 {
+		return containerMount{}, fmt.Errorf("invalid volume %s, use src:dst[:ro]", spec)
+	}
+	mount := containerMount{Type: "volume", Source: parts[0], Target: parts[1]}
+	if filepath.IsAbs(parts[0]) {
+		mount.Type = "bind"
+	}
+	if len(parts) == 3 {
+		switch parts[2] {
+		case "ro":
+			mount.ReadOnly = true
+		case "rw":
+		default:
+			return containerMount{}, fmt.Errorf("invalid mode %s in volume %s, use ro or rw", parts[2], spec)
+		}
+	}
+	return mount, validateMount(spec, mount.Target)
+}
+
+/*
+	Parses what "--mount" is passed, which are comma separated key=value
+	pairs, as with "docker run".
+*/
+
+func parseMountFlag(spec string) (containerMount, error) {
+	mount := containerMount{Type: "volume"}
+	for _, field := range strings.Split(spec, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		key, value := strings.ToLower(kv[0]), ""
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+		switch key {
+		case "type":
+			mount.Type = value
+		case "src", "source":
+			mount.Source = value
+		case "dst", "destination", "target":
+			mount.Target = value
+		case "readonly", "ro":
+			if len(kv) == 1 || value == "true" || value == "1" {
+				mount.ReadOnly = true
+			} else if value != "false" && value != "0" {
+				return containerMount{}, fmt.Errorf("invalid value %s for %s in mount %s", value, key, spec)
+			}
+		default:
+			return containerMount{}, fmt.Errorf("unknown option %s in mount %s", key, spec)
+		}
+	}
+	switch mount.Type {
+	case "bind":
+		if !filepath.IsAbs(mount.Source) {
+			return containerMount{}, fmt.Errorf("bind mount %s needs an absolute src", spec)
+		}
+	case "volume":
+		mount.Anonymous = len(mount.Source) == 0
+	case "tmpfs":
+		if len(mount.Source) > 0 {
+			return containerMount{}, fmt.Errorf("tmpfs mount %s can't have a src", spec)
+		}
+	default:
+		return containerMount{}, fmt.Errorf("unknown type %s in mount %s, use bind, volume or tmpfs", mount.Type, spec)
+	}
+	return mount, validateMount(spec, mount.Target)
+}
+
+func validateMount(spec string, target string) error {
+	if !filepath.IsAbs(target) {
+		return fmt.Errorf("mount %s needs an absolute path in the container", spec)
+	}
+	if filepath.Clean(target) == "/" {
+		return fmt.Errorf("mount %s can't be on /", spec)
+	}
+	return nil
+}
+
+func createVolumeName() string {
+	randBytes := make([]byte, 32)
+	rand.Read(randBytes)
+	return hex.EncodeToString(randBytes)
+}
+
+/*
+	Works out what the container is to mount, from the flags and the
+	image's VOLUME paths, checking bind mounts and volume names, and
+	naming anonymous volumes. This happens before anything is mounted
+	for the container, as failing then leaves nothing behind.
+*/
+
+func resolveContainerMounts(imageShaHex string, mounts []containerMount) []containerMount {
+	targets := make(map[string]bool)
+	for _, mount := range mounts {
+		target := filepath.Clean(mount.Target)
+		if targets[target] {
+			log.Fatalf("Duplicate mount point: %s\n", target)
+		}
+		targets[target] = true
+	}
+	for target := range parseContainerConfig(imageShaHex).Config.Volumes {
+		if !targets[filepath.Clean(target)] {
+			mounts = append(mounts, containerMount{Type: "volume", Target: target, Anonymous: true})
+		}
+	}
+	for i := range mounts {
+		mount := &mounts[i]
+		mount.Target = filepath.Clean(mount.Target)
+		switch mount.Type {
+		case "bind":
+			if _, err := os.Stat(mount.Source); err != nil {
+				log.Fatalf("Unable to bind mount %s: %v\n", mount.Source, err)
+			}
+		case "volume":
+			if mount.Anonymous {
+				mount.Source = createVolumeName()
+			} else if !volumeNameRegexp.MatchString(mount.Source) {
+				log.Fatalf("Invalid volume name %s, only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed\n", mount.Source)
+			}
+		}
+	}
+	/* What is mounted in another mount has to come after it */
+	sort.SliceStable(mounts, func(i, j int) bool {
+		return mounts[i].Target < mounts[j].Target
+	})
+	return mounts
+}
+
+/*
+	Creates the volumes the container mounts that don't exist yet, with
+	what the image has where they are mounted, and records the mounts in
+	the container's directory. The container's root fs has to be mounted.
+*/
+
+func setupContainerMounts(containerID string, mounts []containerMount) {
+	if len(mounts) == 0 {
+		return
+	}
+	mntPath := getContainerFSHome(containerID) + "/mnt"
+	for _, mount := range mounts {
+		if _, err := os.Stat(getVolumePath(mount.Source)); mount.Type != "volume" || !os.IsNotExist(err) {
+			continue
+		}
+		doOrDieWithMsg(os.Mkdir(getVolumePath(mount.Source), 0755), "Unable to create volume")
+		imagePath, err := resolveInRoot(mntPath, mount.Target)
+		if info, statErr := os.Stat(imagePath); err != nil || statErr != nil || !info.IsDir() {
+			continue
+		}
+		if err := copyInRoots(mntPath, mount.Target+"/.", "", "/", getVolumePath(mount.Source), false); err != nil {
+			log.Printf("Warning: Unable to copy %s into volume %s: %v\n", mount.Target, mount.Source, err)
+		}
+	}
+	data, err := json.Marshal(mounts)
+	if err != nil {
+		log.Fatalf("Unable to marshal mounts: %v\n", err)
+	}
+	doOrDieWithMsg(ioutil.WriteFile(getContainerMountsPath(containerID), data, 0644), "Unable to record mounts")
+}
+
+func getContainerMounts(containerID string) []containerMount {
+	var mounts []containerMount
+	data, err := ioutil.ReadFile(getContainerMountsPath(containerID))
+	if err != nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, &mounts); err != nil {
+		log.Printf("Warning: Unable to parse mounts of container %s: %v\n", containerID, err)
+	}
+	return mounts
+}
+
+/*
+	The container's mount namespace starts out with the host's mounts.
+	Where those are shared, what we mount in the container would show
+	on the host too, and what the host mounts would show up in the
+	container, so this is called before anything is mounted there.
+*/
+
+func makeMountsPrivate() error {
+	return unix.Mount("", "/", "", unix.MS_PRIVATE|unix.MS_REC, "")
+}
+
+/*
+	Returns the mount points of what is mounted on or under dir, in the
+	order they were mounted, from /proc/self/mountinfo, where spaces and
+	such in them are escaped as octal.
+*/
+
+func getSubmounts(dir string) ([]string, error) {
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	unescape := strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+	var submounts []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mountPoint := unescape.Replace(fields[4])
+		if mountPoint == dir || strings.HasPrefix(mountPoint, dir+"/") {
+			submounts = append(submounts, mountPoint)
+		}
+	}
+	return submounts, scanner.Err()
+}
+
+/*
+	Makes a bind mount read-only, along with whatever a recursive bind
+	brought along under it, which would otherwise stay writable. Flags
+	such as nosuid that a mount has are kept, as remounting without them
+	would drop them.
+*/
+
+func remountReadOnly(target string) error {
+	submounts, err := getSubmounts(target)
+	if err != nil {
+		return err
+	}
+	for _, submount := range submounts {
+		var stat unix.Statfs_t
+		if err := unix.Statfs(submount, &stat); err != nil {
+			return err
+		}
+		flags := uintptr(stat.Flags) & (unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC |
+			unix.MS_NOATIME | unix.MS_NODIRATIME | unix.MS_RELATIME)
+		if err := unix.Mount("", submount, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY|flags, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+	Called in the container's mount namespace before it chroots into
+	mntPath. Mount points are looked up in mntPath, so that symlinks in
+	the image can't have us mount over the host's files. Returns what
+	was mounted, as the list can't be read once in the chroot.
+*/
+
+func mountContainerVolumes(containerID string, mntPath string) []containerMount {
+	mounts := getContainerMounts(containerID)
+	for _, mount := range mounts {
+		source := mount.Source
+		if mount.Type == "volume" {
+			source = getVolumePath(mount.Source)
+		}
+		target, err := resolveInRoot(mntPath, mount.Target)
+		if err != nil {
+			log.Fatalf("Unable to resolve mount point %s: %v\n", mount.Target, err)
+		}
+		info, err := os.Stat(source)
+		if mount.Type != "tmpfs" && err != nil {
+			log.Fatalf("Unable to mount %s: %v\n", source, err)
+		}
+		if mount.Type == "tmpfs" || info.IsDir() {
+			doOrDieWithMsg(os.MkdirAll(target, 0755), "Unable to create mount point")
+		} else if _, err := os.Stat(target); os.IsNotExist(err) {
+			doOrDieWithMsg(os.MkdirAll(filepath.Dir(target), 0755), "Unable to create mount point")
+			doOrDieWithMsg(ioutil.WriteFile(target, nil, 0644), "Unable to create mount point")
+		}
+
+		var flags uintptr
+		if mount.ReadOnly {
+			flags = unix.MS_RDONLY
+		}
+		if mount.Type == "tmpfs" {
+			if err := unix.Mount("tmpfs", target, "tmpfs", flags, ""); err != nil {
+				log.Fatalf("Unable to mount tmpfs on %s: %v\n", mount.Target, err)
+			}
+			continue
+		}
+		if err := unix.Mount(source, target, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			log.Fatalf("Unable to mount %s on %s: %v\n", source, mount.Target, err)
+		}
+		/* Bind mounts only become read-only once remounted */
+		if mount.ReadOnly {
+			if err := remountReadOnly(target); err != nil {
+				log.Fatalf("Unable to make %s read-only: %v\n", mount.Target, err)
+			}
+		}
+	}
+	return mounts
+}
+
+/*
+	Called in the container once its command exits with what
+	mountContainerVolumes() mounted, in the reverse order, so that what
+	is mounted inside a mount goes first.
+*/
+
+func unmountContainerVolumes(mounts []containerMount) {
+	for i := len(mounts) - 1; i >= 0; i-- {
+		doOrDie(unix.Unmount(mounts[i].Target, unix.MNT_DETACH))
+	}
+}
+
+/*
+	Called before the container's directory is removed.
+*/
+
+func removeAnonymousVolumes(containerID string) {
+	for _, mount := range getContainerMounts(containerID) {
+		if mount.Type == "volume" && mount.Anonymous {
+			os.RemoveAll(getVolumePath(mount.Source))
+		}
+	}
+}
+
+/*
+	Returns the volumes that containers which are still around mount.
+*/
+
+func getVolumesInUse() map[string]bool {
+	inUse := make(map[string]bool)
+	containers, _ := ioutil.ReadDir(getGockerContainersPath())
+	for _, entry := range containers {
+		for _, mount := range getContainerMounts(entry.Name()) {
+			if mount.Type == "volume" {
+				inUse[mount.Source] = true
+			}
+		}
+	}
+	return inUse
+}